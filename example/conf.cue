@@ -1,12 +1,13 @@
 apiVersion:     "mvela.oam.dev/v1alpha1"
 kind:           "Simple"
-managedCluster: *0 | int & >=0
+managedCluster: *2 | int & >=0
 kubeconfigOpts: {
-	output:            *"~/.vela/config/mvela.yaml" | string
-	updateEnvironment: *true | bool
+	output: *"/Users/qiaozp/.vela/kubeConfig" | string
 }
 helmOpts: {
-	type:      *"helm" | "local"
-	chartPath: *"" | string
-	version:   string
+	version: *"1.2.4" | string
 }
+registries: mirrors: "docker.io": endpoint: [
+	"https://hub-mirror.c.163.com",
+	"https://mirror.baidubce.com",
+]
@@ -3,14 +3,24 @@ module mvela
 go 1.16
 
 require (
+	cuelang.org/go v0.4.3
+	github.com/Masterminds/semver/v3 v3.1.1
 	github.com/docker/docker v20.10.12+incompatible
 	github.com/docker/go-connections v0.4.0
+	github.com/docker/go-units v0.4.0
 	github.com/kyokomi/emoji/v2 v2.2.8
+	github.com/pmezard/go-difflib v1.0.0
 	github.com/rancher/k3d/v5 v5.3.0
 	github.com/sirupsen/logrus v1.8.1
-	github.com/spf13/cobra v1.3.0
-	github.com/spf13/viper v1.10.1
-	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b // indirect
+	github.com/spf13/cobra v1.4.0
+	golang.org/x/net v0.0.0-20220107192237-5cfca573fb4d
+	golang.org/x/term v0.0.0-20210615171337-6886f2dfbf5b
+	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
 	helm.sh/helm/v3 v3.8.0
+	k8s.io/api v0.23.2
+	k8s.io/apiextensions-apiserver v0.23.1
+	k8s.io/apimachinery v0.23.2
+	k8s.io/cli-runtime v0.23.1
+	k8s.io/client-go v0.23.2
 	k8s.io/klog/v2 v2.40.1
 )
@@ -0,0 +1,110 @@
+// Package v1alpha2 is the current version of mvela configuration file
+package v1alpha2
+
+import "mvela/pkg/apis/v1alpha1"
+
+// APIVersion is the apiVersion of this version
+const APIVersion = "mvela.oam.dev/v1alpha2"
+
+// Config is the v1alpha2 configuration file. It declares a list of clusters instead of a cluster number.
+type Config struct {
+	ApiVersion     string           `json:"apiVersion" yaml:"apiVersion"`
+	Kind           string           `json:"kind" yaml:"kind"`
+	Clusters       []Cluster        `json:"clusters" yaml:"clusters"`
+	KubeconfigOpts KubeconfigOption `json:"kubeconfigOpts" yaml:"kubeconfigOpts"`
+	HelmOpts       HelmOpts         `json:"helmOpts" yaml:"helmOpts"`
+	Registries     Registry         `json:"registries" yaml:"registries"`
+	Storage        Storage          `json:"storage" yaml:"storage"`
+	Token          string           `json:"token" yaml:"token"`
+	Proxy          Proxy            `json:"proxy" yaml:"proxy"`
+	Releases       []Release        `json:"releases" yaml:"releases"`
+}
+
+// Cluster is one cluster in the environment, the first one is the control plane.
+// Fields left empty are set to defaults.
+type Cluster struct {
+	// Name of the cluster, default to mvela-cluster-control-plane for the first one and mvela-cluster-N for others
+	Name string `json:"name" yaml:"name"`
+	// Image is the k3s image of all nodes, default to rancher/k3s:latest
+	Image string `json:"image" yaml:"image"`
+	// Servers is the number of server nodes, default to 1
+	Servers int `json:"servers" yaml:"servers"`
+	// Agents is the number of agent nodes
+	Agents int `json:"agents" yaml:"agents"`
+	// Args are extra arguments passed to k3s server
+	Args []string `json:"args" yaml:"args"`
+	// Labels are added to all node containers of the cluster
+	Labels map[string]string `json:"labels" yaml:"labels"`
+	// APIPort is the host port to access Kubernetes API, default to 6443 plus the ordinal of cluster
+	APIPort int `json:"apiPort" yaml:"apiPort"`
+}
+
+// HelmOpts configures the vela-core Helm chart. Chart values are merged in Helm's order:
+// Values, then ValuesFiles one by one, then Set.
+type HelmOpts struct {
+	Type      string `json:"type" yaml:"type"`
+	ChartPath string `json:"chartPath" yaml:"chartPath"`
+	Version   string `json:"version" yaml:"version"`
+	// Values are chart values written inline
+	Values map[string]interface{} `json:"values" yaml:"values"`
+	// ValuesFiles are YAML files of chart values, like helm -f
+	ValuesFiles []string `json:"valuesFiles" yaml:"valuesFiles"`
+	// Set are chart values in the syntax of helm --set, like replicaCount=2
+	Set []string `json:"set" yaml:"set"`
+	// Verify the chart with its provenance file like helm --verify
+	Verify bool `json:"verify" yaml:"verify"`
+	// Keyring to verify the chart, default to ~/.gnupg/pubring.gpg
+	Keyring string `json:"keyring" yaml:"keyring"`
+	// Mirrors are URL templates of the chart archive tried in order after ChartPath, for chart source type url
+	Mirrors []string `json:"mirrors" yaml:"mirrors"`
+	// DownloadTimeout is the timeout of each chart download request like 30s, default to 2m
+	DownloadTimeout string `json:"downloadTimeout" yaml:"downloadTimeout"`
+	// DownloadAttempts is the number of tries of each chart URL, default to 3
+	DownloadAttempts int `json:"downloadAttempts" yaml:"downloadAttempts"`
+}
+
+// Release is a Helm release installed after vela-core. It's installed into clusters named in Clusters or matching
+// ClusterSelector, the control plane if neither is set.
+type Release struct {
+	Name string `json:"name" yaml:"name"`
+	// Namespace of the release, created if absent, default to default
+	Namespace string `json:"namespace" yaml:"namespace"`
+	// Chart is the chart name, default to Name
+	Chart string `json:"chart" yaml:"chart"`
+	// HelmOpts are the chart source, version and values like the ones of vela-core, version default to stable
+	HelmOpts HelmOpts `json:"helmOpts" yaml:"helmOpts"`
+	// Clusters are names of clusters to install into
+	Clusters []string `json:"clusters" yaml:"clusters"`
+	// ClusterSelector selects clusters to install into by their labels, like region=hangzhou,env!=test
+	ClusterSelector string `json:"clusterSelector" yaml:"clusterSelector"`
+}
+
+// Proxy configures HTTP proxies of each kind of traffic separately
+type Proxy struct {
+	// Chart is used to download vela-core chart and values files, HTTP(S)_PROXY in environment is used if not set
+	Chart ProxySettings `json:"chart" yaml:"chart"`
+	// Nodes is set as environment variables of k3s nodes to pull images, NO_PROXY is completed with cluster networks
+	Nodes ProxySettings `json:"nodes" yaml:"nodes"`
+	// API is used to access Kubernetes API of clusters, they are accessed directly if not set
+	API ProxySettings `json:"api" yaml:"api"`
+}
+
+// ProxySettings are proxies of HTTP and HTTPS requests, like HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+type ProxySettings struct {
+	HTTP  string `json:"http" yaml:"http"`
+	HTTPS string `json:"https" yaml:"https"`
+	// NoProxy are hosts, domains and CIDRs accessed directly
+	NoProxy []string `json:"noProxy" yaml:"noProxy"`
+}
+
+// Types unchanged since v1alpha1
+
+type (
+	KubeconfigOption = v1alpha1.KubeconfigOption
+	Storage          = v1alpha1.Storage
+	Registry         = v1alpha1.Registry
+	Mirror           = v1alpha1.Mirror
+	AuthConfig       = v1alpha1.AuthConfig
+	TLSConfig        = v1alpha1.TLSConfig
+	RegistryConfig   = v1alpha1.RegistryConfig
+)
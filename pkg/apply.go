@@ -0,0 +1,388 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/kyokomi/emoji/v2"
+	k3dClient "github.com/rancher/k3d/v5/pkg/client"
+	config "github.com/rancher/k3d/v5/pkg/config/v1alpha4"
+	"github.com/rancher/k3d/v5/pkg/runtimes"
+	k3d "github.com/rancher/k3d/v5/pkg/types"
+	"github.com/spf13/cobra"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/storage/driver"
+	"k8s.io/klog/v2"
+)
+
+// applyAction is what apply does to a cluster
+type applyAction string
+
+const (
+	applyCreate   applyAction = "create"
+	applyRecreate applyAction = "recreate"
+	applyDelete   applyAction = "delete"
+)
+
+// clusterChange is a cluster to change, Diffs are why it's recreated
+type clusterChange struct {
+	Name   string
+	Action applyAction
+	Diffs  []fieldDiff
+}
+
+// applyPlan is what apply does to make the running environment match config
+type applyPlan struct {
+	Clusters []clusterChange
+	// VelaCore are changes of vela-core in the control plane kept, it's upgraded if installed, or installed
+	VelaCore          []fieldDiff
+	VelaCoreInstalled bool
+}
+
+func (p applyPlan) empty() bool {
+	return len(p.Clusters) == 0 && len(p.VelaCore) == 0
+}
+
+// creates are the clusters to create, recreated ones included
+func (p applyPlan) creates() map[string]bool {
+	names := map[string]bool{}
+	for _, c := range p.Clusters {
+		if c.Action == applyCreate || c.Action == applyRecreate {
+			names[c.Name] = true
+		}
+	}
+	return names
+}
+
+func CmdApply(cmdConfig *Config) *cobra.Command {
+	var file string
+	var dryRun bool
+	var parallel int
+	var timeout time.Duration
+	cmd := cobra.Command{
+		Use:   "apply",
+		Short: "Make the running environment match config",
+		Long: "Compare config with the running clusters and vela-core, then create missing clusters, delete extra ones, " +
+			"recreate clusters whose image, nodes, API port, args, labels, proxy or registries changed, and upgrade " +
+			"vela-core if its chart version or values changed. The plan is printed before acting.",
+		Example: "mvela apply -f conf.yaml --dry-run",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg := *cmdConfig
+			if file != "" {
+				var err error
+				if cfg, err = ReadConfig(file); err != nil {
+					return configError(err)
+				}
+			}
+			if err := checkDocker(cmd.Context()); err != nil {
+				return err
+			}
+			if err := resolveSecrets(&cfg); err != nil {
+				return configError(err)
+			}
+			if !dryRun {
+				if err := ensureToken(&cfg); err != nil {
+					return err
+				}
+				if err := ensureHashKey(); err != nil {
+					return err
+				}
+			}
+			plan, runConfigs, err := PlanApply(cmd.Context(), cfg)
+			if err != nil {
+				return err
+			}
+			printApplyPlan(os.Stdout, cfg, plan)
+			if dryRun || plan.empty() {
+				return nil
+			}
+			return Apply(cmd.Context(), cfg, plan, runConfigs, parallel, timeout)
+		},
+	}
+	cmd.Flags().StringVarP(&file, "file", "f", "", "config file to apply, default to the one of -c")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "print the plan without changing anything")
+	cmd.Flags().IntVar(&parallel, "parallel", defaultParallel, "number of clusters created at the same time")
+	cmd.Flags().DurationVar(&timeout, "timeout", defaultReadyTimeout, "time to wait for clusters and vela-core to be ready after changes, 0 to skip")
+	return &cmd
+}
+
+// PlanApply compares cfg with the running environment, run configs of the clusters in cfg are returned along with
+// the plan. Nothing is changed.
+func PlanApply(ctx context.Context, cfg Config) (applyPlan, []config.ClusterConfig, error) {
+	running, runConfigs, err := observeEnvironment(ctx, cfg)
+	if err != nil {
+		return applyPlan{}, nil, err
+	}
+	plan := applyPlan{Clusters: planClusters(cfg, runConfigs, running)}
+
+	controlPlane := cfg.Clusters[0].Name
+	if plan.creates()[controlPlane] {
+		// vela-core is installed along with the control plane
+		return plan, runConfigs, nil
+	}
+	current, err := currentVelaCore(cfg)
+	if err != nil {
+		return applyPlan{}, nil, err
+	}
+	plan.VelaCoreInstalled = current != nil
+	if plan.VelaCore, err = velaCoreDiffs(cfg, current); err != nil {
+		return applyPlan{}, nil, err
+	}
+	return plan, runConfigs, nil
+}
+
+// planClusters compares clusters in cfg with the running ones, clusters not in cfg are deleted
+func planClusters(cfg Config, runConfigs []config.ClusterConfig, running map[string]*clusterState) []clusterChange {
+	var changes []clusterChange
+	desired := map[string]bool{}
+	for ord, r := range runConfigs {
+		name := r.Cluster.Name
+		desired[name] = true
+		got, ok := running[name]
+		if !ok {
+			changes = append(changes, clusterChange{Name: name, Action: applyCreate})
+			continue
+		}
+		if diffs := diffClusterState(desiredClusterState(r, cfg.Clusters[ord].Labels), *got); len(diffs) > 0 {
+			changes = append(changes, clusterChange{Name: name, Action: applyRecreate, Diffs: diffs})
+		}
+	}
+	var extra []string
+	for name := range running {
+		if !desired[name] {
+			extra = append(extra, name)
+		}
+	}
+	sort.Strings(extra)
+	for _, name := range extra {
+		changes = append(changes, clusterChange{Name: name, Action: applyDelete})
+	}
+	return changes
+}
+
+// currentVelaCore is the vela-core release in the control plane of cfg, nil if not installed
+func currentVelaCore(cfg Config) (*release.Release, error) {
+	actionConfig, err := helmActionConfig(kubeconfigPath(cfg, cfg.Clusters[0].Name), VelaCoreReleaseNamespace, cfg.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	current, err := action.NewGet(actionConfig).Run(VelaCoreReleaseName)
+	if errors.Is(err, driver.ErrReleaseNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, chartError(fmt.Errorf("fail to get vela-core release: %w", err))
+	}
+	return current, nil
+}
+
+// velaCoreDiffs compares the chart version and values of vela-core in cfg with the current release, which is nil
+// if not installed. Versions of local charts are not compared.
+func velaCoreDiffs(cfg Config, current *release.Release) ([]fieldDiff, error) {
+	if current == nil {
+		return []fieldDiff{{Field: "vela-core", Want: "installed", Got: "(none)"}}, nil
+	}
+	var diffs []fieldDiff
+	if cfg.HelmOpts.Type != ChartSourceLocal {
+		spec := velaCoreRelease(cfg.HelmOpts).HelmOpts.Version
+		match, err := versionMatcher(spec)
+		if err != nil {
+			return nil, configError(err)
+		}
+		got := current.Chart.Metadata.Version
+		if v, err := semver.NewVersion(got); err != nil || !match(v) {
+			diffs = append(diffs, fieldDiff{Field: "helmOpts.version", Want: spec, Got: got})
+		}
+	}
+	vals, err := chartValues(cfg.HelmOpts, chartGetters(cli.New(), chartHTTPClient(cfg.Proxy), downloadTimeout(cfg.HelmOpts)))
+	if err != nil {
+		return nil, configError(fmt.Errorf("invalid vela-core chart values: %w", err))
+	}
+	return append(diffs, valuesDiffs(vals, current.Config)...), nil
+}
+
+// valuesDiffs compares chart values top-level key by key
+func valuesDiffs(want, got map[string]interface{}) []fieldDiff {
+	want, errWant := normalizeValues(want)
+	got, errGot := normalizeValues(got)
+	if errWant != nil || errGot != nil {
+		return []fieldDiff{{Field: "helmOpts.values", Want: "(unknown)", Got: "(unknown)"}}
+	}
+	keys := map[string]bool{}
+	for k := range want {
+		keys[k] = true
+	}
+	for k := range got {
+		keys[k] = true
+	}
+	var sorted []string
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+	var diffs []fieldDiff
+	for _, k := range sorted {
+		w, wok := want[k]
+		g, gok := got[k]
+		if wok == gok && reflect.DeepEqual(w, g) {
+			continue
+		}
+		diffs = append(diffs, fieldDiff{Field: "helmOpts.values." + k, Want: valueString(w, wok), Got: valueString(g, gok)})
+	}
+	return diffs
+}
+
+func valueString(v interface{}, ok bool) string {
+	if !ok {
+		return "(unset)"
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
+
+// printApplyPlan prints what apply does in the order of config
+func printApplyPlan(w io.Writer, cfg Config, plan applyPlan) {
+	if plan.empty() {
+		emoji.Fprintln(w, ":white_check_mark: Running environment matches config, nothing to change")
+		return
+	}
+	emoji.Fprintln(w, ":clipboard: Plan:")
+	for _, c := range plan.Clusters {
+		switch c.Action {
+		case applyCreate:
+			fmt.Fprintf(w, "  + create %s\n", c.Name)
+		case applyRecreate:
+			fmt.Fprintf(w, "  ~ recreate %s\n", c.Name)
+		case applyDelete:
+			fmt.Fprintf(w, "  - delete %s\n", c.Name)
+		}
+		for _, d := range c.Diffs {
+			fmt.Fprintf(w, "      %s\n", d)
+		}
+	}
+	if len(plan.VelaCore) > 0 {
+		verb := "upgrade"
+		if !plan.VelaCoreInstalled {
+			verb = "install"
+		}
+		fmt.Fprintf(w, "  ~ %s vela-core in %s\n", verb, cfg.Clusters[0].Name)
+		for _, d := range plan.VelaCore {
+			fmt.Fprintf(w, "      %s\n", d)
+		}
+	}
+	for _, c := range plan.Clusters {
+		if c.Name == cfg.Clusters[0].Name && c.Action == applyRecreate {
+			emoji.Fprintln(w, ":warning: Recreating the control plane loses the Applications in it")
+		}
+	}
+}
+
+// Apply carries out plan: clusters are deleted first, then created with runConfigs, and vela-core is upgraded.
+// Clusters created are deleted if any of them fails.
+func Apply(ctx context.Context, cfg Config, plan applyPlan, runConfigs []config.ClusterConfig, parallel int, timeout time.Duration) error {
+	for _, c := range plan.Clusters {
+		if c.Action != applyDelete && c.Action != applyRecreate {
+			continue
+		}
+		if err := deleteCluster(ctx, cfg, c.Name, c.Action == applyDelete); err != nil {
+			return clusterError(fmt.Errorf("fail to delete cluster %s: %w", c.Name, err))
+		}
+	}
+
+	creates := plan.creates()
+	if len(creates) > 0 {
+		tx := &createTransaction{}
+		if err := ensureK3dNetwork(ctx, tx); err != nil {
+			return abortCreate(tx, false, clusterError(fmt.Errorf("fail to create docker network: %w", err)))
+		}
+		// proxy env needs the subnet of the network
+		nodeEnv, err := nodeProxyEnv(ctx, cfg.Proxy.Nodes)
+		if err != nil {
+			return abortCreate(tx, false, fmt.Errorf("fail to set proxy of nodes: %w", err))
+		}
+		if runConfigs, err = GetClusterRunConfig(cfg, nodeEnv); err != nil {
+			return abortCreate(tx, false, configError(fmt.Errorf("fail to get cluster-run configs: %w", err)))
+		}
+		var toCreate []config.ClusterConfig
+		for _, r := range runConfigs {
+			if creates[r.Cluster.Name] {
+				toCreate = append(toCreate, r)
+			}
+		}
+		if err = os.MkdirAll(cfg.KubeconfigOpts.Output, 0o755); err != nil {
+			return abortCreate(tx, false, fmt.Errorf("fail to create directory to save kubeconfig: %w", err))
+		}
+		errs, velaCoreErr := CreateClusters(ctx, cfg, toCreate, parallel, tx)
+		if len(errs) > 0 {
+			printClusterErrors(os.Stdout, cfg, errs)
+			return abortCreate(tx, false, clusterErrors(cfg, errs))
+		}
+		if velaCoreErr != nil {
+			return fmt.Errorf("fail to install vela-core: %w", velaCoreErr)
+		}
+	}
+
+	if len(plan.VelaCore) > 0 {
+		kubeconfig := kubeconfigPath(cfg, cfg.Clusters[0].Name)
+		if plan.VelaCoreInstalled {
+			if _, err := UpgradeVelaCore(ctx, kubeconfig, cfg.HelmOpts, cfg.Proxy, defaultUpgradeTimeout, false); err != nil {
+				return fmt.Errorf("fail to upgrade vela-core: %w", err)
+			}
+		} else if err := InstallVelaCore(kubeconfig, cfg.HelmOpts, cfg.Proxy); err != nil {
+			return fmt.Errorf("fail to install vela-core: %w", err)
+		}
+		// the chart hash recorded at create is out of date now
+		if err := recordChartHash(ctx, cfg); err != nil {
+			klog.Warningf("Fail to record hash of vela-core chart, diff may report it changed since created: %v", err)
+		}
+	}
+
+	var releaseErrs []error
+	if len(creates) > 0 {
+		releaseErrs = InstallReleases(cfg)
+	}
+	if timeout > 0 {
+		if err := WaitClustersReady(ctx, cfg, timeout, os.Stdout); err != nil {
+			return fmt.Errorf("KubeVela is not ready: %w", err)
+		}
+	}
+	if len(releaseErrs) > 0 {
+		printReleaseErrors(os.Stdout, releaseErrs)
+		return releaseErrors(releaseErrs, "apply")
+	}
+	emoji.Fprintln(os.Stdout, ":white_check_mark: Running environment matches config now")
+	return nil
+}
+
+// deleteCluster deletes the cluster if exists, along with its kubeconfig files if removeKubeconfig
+func deleteCluster(ctx context.Context, cfg Config, name string, removeKubeconfig bool) error {
+	cluster, err := k3dClient.ClusterGet(ctx, runtimes.SelectedRuntime, &k3d.Cluster{Name: name})
+	if err == nil {
+		klog.Infof("Deleting cluster %s", name)
+		if err = k3dClient.ClusterDelete(ctx, runtimes.SelectedRuntime, cluster, k3d.ClusterDeleteOpts{}); err != nil {
+			return err
+		}
+	}
+	if !removeKubeconfig {
+		return nil
+	}
+	kubeconfig := kubeconfigPath(cfg, name)
+	for _, f := range []string{kubeconfig, kubeconfig + "-internal"} {
+		if err = os.Remove(f); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
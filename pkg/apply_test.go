@@ -0,0 +1,99 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlanClusters(t *testing.T) {
+	cfg := CompleteConfig(Config{Kind: KindSimple, Clusters: []Cluster{{Name: "hub"}, {Name: "edge", Agents: 1}}})
+	runConfigs, err := GetClusterRunConfig(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// running clusters as created with cfg
+	running := func() map[string]*clusterState {
+		states := map[string]*clusterState{}
+		for ord, r := range runConfigs {
+			s := desiredClusterState(r, cfg.Clusters[ord].Labels)
+			states[s.Name] = &s
+		}
+		return states
+	}
+	cases := []struct {
+		name   string
+		modify func(states map[string]*clusterState)
+		want   map[string]applyAction
+	}{
+		{name: "matches", modify: func(map[string]*clusterState) {}, want: map[string]applyAction{}},
+		{
+			name:   "missing",
+			modify: func(states map[string]*clusterState) { delete(states, "edge") },
+			want:   map[string]applyAction{"edge": applyCreate},
+		},
+		{
+			name:   "extra",
+			modify: func(states map[string]*clusterState) { states["old"] = &clusterState{Name: "old"} },
+			want:   map[string]applyAction{"old": applyDelete},
+		},
+		{
+			name:   "changed",
+			modify: func(states map[string]*clusterState) { states["edge"].Agents = 2 },
+			want:   map[string]applyAction{"edge": applyRecreate},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			states := running()
+			c.modify(states)
+			got := map[string]applyAction{}
+			for _, change := range planClusters(cfg, runConfigs, states) {
+				got[change.Name] = change.Action
+				if change.Action == applyRecreate && len(change.Diffs) == 0 {
+					t.Errorf("expect diffs of recreated cluster %s", change.Name)
+				}
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("expect %v, got %v", c.want, got)
+			}
+		})
+	}
+}
+
+func TestValuesDiffs(t *testing.T) {
+	cases := []struct {
+		name string
+		want map[string]interface{}
+		got  map[string]interface{}
+		diff []string
+	}{
+		{name: "empty", diff: []string{}},
+		{
+			name: "YAML and JSON numbers are the same",
+			want: map[string]interface{}{"replicaCount": 2, "image": map[string]interface{}{"tag": "v1"}},
+			got:  map[string]interface{}{"replicaCount": float64(2), "image": map[string]interface{}{"tag": "v1"}},
+			diff: []string{},
+		},
+		{
+			name: "changed, added and removed",
+			want: map[string]interface{}{"replicaCount": 2, "logDebug": true},
+			got:  map[string]interface{}{"replicaCount": 1, "admissionWebhooks": map[string]interface{}{"enabled": false}},
+			diff: []string{
+				`helmOpts.values.admissionWebhooks: {"enabled":false} -> (unset)`,
+				"helmOpts.values.logDebug: (unset) -> true",
+				"helmOpts.values.replicaCount: 1 -> 2",
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			diffs := []string{}
+			for _, d := range valuesDiffs(c.want, c.got) {
+				diffs = append(diffs, d.String())
+			}
+			if !reflect.DeepEqual(diffs, c.diff) {
+				t.Errorf("expect %q, got %q", c.diff, diffs)
+			}
+		})
+	}
+}
@@ -0,0 +1,573 @@
+package pkg
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/go-units"
+	"gopkg.in/yaml.v3"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/getter"
+	"helm.sh/helm/v3/pkg/provenance"
+	"k8s.io/klog/v2"
+)
+
+const (
+	cacheIndexFile = "index.yaml"
+	provSuffix     = ".prov"
+	// importedSource is the prefix of source of charts imported from local files
+	importedSource = "file://"
+	importedDir    = "imported"
+	// partSuffix is the suffix of partially downloaded files
+	partSuffix = ".part"
+)
+
+// Defaults of chart downloading
+const (
+	defaultDownloadTimeout  = 2 * time.Minute
+	defaultDownloadAttempts = 3
+	initialDownloadBackoff  = time.Second
+	maxDownloadBackoff      = 30 * time.Second
+)
+
+// cacheEntry is a chart archive in cache
+type cacheEntry struct {
+	// Source is the URL or OCI reference the chart is downloaded from
+	Source string `yaml:"source"`
+	// Chart is the chart name
+	Chart   string `yaml:"chart"`
+	Version string `yaml:"version"`
+	// File is the path of chart archive relative to cache directory
+	File string `yaml:"file"`
+	// Digest is the sha256 digest of chart archive, like sha256:abcd...
+	Digest string `yaml:"digest"`
+	// Prov is the path of provenance file relative to cache directory, empty if not downloaded
+	Prov       string    `yaml:"prov,omitempty"`
+	Downloaded time.Time `yaml:"downloaded"`
+	LastUsed   time.Time `yaml:"lastUsed"`
+}
+
+func (e cacheEntry) imported() bool {
+	return strings.HasPrefix(e.Source, importedSource)
+}
+
+// is tells if e is of chart and version
+func (e cacheEntry) is(chart, version string) bool {
+	return e.Chart == chart && e.Version == version
+}
+
+// cacheIndex records the charts in cache directory
+type cacheIndex struct {
+	Entries []cacheEntry `yaml:"entries"`
+}
+
+// chartCache keeps downloaded charts in dir along with their digests
+type chartCache struct {
+	dir     string
+	getters getter.Providers
+	// keyring to verify provenance of charts, not verified if empty
+	keyring string
+	// timeout of each download request, defaultDownloadTimeout if not set
+	timeout time.Duration
+	// attempts to download from each source, defaultDownloadAttempts if not set
+	attempts int
+	// client downloads http(s) sources, http.DefaultClient if not set
+	client *http.Client
+}
+
+func (c *chartCache) indexPath() string {
+	return path.Join(c.dir, cacheIndexFile)
+}
+
+func (c *chartCache) loadIndex() (*cacheIndex, error) {
+	index := &cacheIndex{}
+	data, err := os.ReadFile(c.indexPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = yaml.Unmarshal(data, index); err != nil {
+		return nil, fmt.Errorf("invalid chart cache index %s: %w", c.indexPath(), err)
+	}
+	return index, nil
+}
+
+func (c *chartCache) saveIndex(index *cacheIndex) error {
+	data, err := yaml.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.indexPath(), func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+func (i *cacheIndex) find(source string) *cacheEntry {
+	for k := range i.Entries {
+		if i.Entries[k].Source == source {
+			return &i.Entries[k]
+		}
+	}
+	return nil
+}
+
+// findImported returns the latest imported chart of version
+func (i *cacheIndex) findImported(chart, version string) *cacheEntry {
+	var found *cacheEntry
+	for k, e := range i.Entries {
+		if e.imported() && e.is(chart, version) && (found == nil || e.Downloaded.After(found.Downloaded)) {
+			found = &i.Entries[k]
+		}
+	}
+	return found
+}
+
+func (i *cacheIndex) put(e cacheEntry) {
+	if old := i.find(e.Source); old != nil {
+		*old = e
+		return
+	}
+	i.Entries = append(i.Entries, e)
+}
+
+// cacheMu serializes getting charts from cache in this process, charts may be installed into clusters in parallel
+var cacheMu sync.Mutex
+
+// get returns the cached chart downloaded from any of sources. If absent or corrupted, it's downloaded from
+// sources in order. digest is the digest of the chart archive published by the chart repo, not checked if empty.
+func (c *chartCache) get(chart string, sources []string, version, digest string) (string, error) {
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	index, err := c.loadIndex()
+	if err != nil {
+		return "", err
+	}
+	var e *cacheEntry
+	for _, source := range sources {
+		if e = index.find(source); e != nil {
+			break
+		}
+	}
+	if e == nil {
+		// charts imported by users are preferred over downloading
+		e = index.findImported(chart, version)
+	}
+	if e != nil {
+		err = c.verify(*e)
+		if err == nil && digest != "" && e.Digest != digest {
+			err = fmt.Errorf("digest of %s is %s, expect %s published by the chart repo", path.Join(c.dir, e.File), e.Digest, digest)
+		}
+		if err == nil {
+			klog.Infof("Using cached chart %s", path.Join(c.dir, e.File))
+			e.LastUsed = time.Now()
+			if err = c.saveIndex(index); err != nil {
+				klog.Warningf("Fail to save chart cache index: %v", err)
+			}
+			return path.Join(c.dir, e.File), nil
+		}
+		klog.Warningf("Cached chart of %s is not usable, downloading again: %v", e.Source, err)
+	}
+
+	for i, source := range sources {
+		var downloaded cacheEntry
+		downloaded, err = c.download(chart, source, version)
+		if err == nil {
+			err = c.verify(downloaded)
+		}
+		if err == nil && digest != "" && downloaded.Digest != digest {
+			err = fmt.Errorf("digest of chart downloaded from %s is %s, expect %s published by the chart repo", source, downloaded.Digest, digest)
+			if rmErr := c.remove(downloaded); rmErr != nil {
+				klog.Warningf("Fail to remove the chart downloaded: %v", rmErr)
+			}
+		}
+		if err == nil {
+			if err = c.add(downloaded); err != nil {
+				return "", err
+			}
+			return path.Join(c.dir, downloaded.File), nil
+		}
+		if i < len(sources)-1 {
+			klog.Warningf("Fail to get chart from %s, trying next mirror: %v", source, err)
+		}
+	}
+	if file, ok := c.lookup(chart, version, digest); ok {
+		klog.Warningf("Using cached chart %s: %v", file, err)
+		return file, nil
+	}
+	return "", err
+}
+
+// lookup finds a usable cached chart of version from any source, for working offline. The chart archive must be
+// of digest if it's set.
+func (c *chartCache) lookup(chart, version, digest string) (string, bool) {
+	index, err := c.loadIndex()
+	if err != nil {
+		return "", false
+	}
+	usable := func(e cacheEntry) bool {
+		return (digest == "" || e.Digest == digest) && c.verify(e) == nil
+	}
+	if e := index.findImported(chart, version); e != nil && usable(*e) {
+		return path.Join(c.dir, e.File), true
+	}
+	for _, e := range index.Entries {
+		if e.is(chart, version) && usable(e) {
+			return path.Join(c.dir, e.File), true
+		}
+	}
+	return "", false
+}
+
+// versions lists the versions of cached charts of chart
+func (c *chartCache) versions(chart string) ([]string, error) {
+	index, err := c.loadIndex()
+	if err != nil {
+		return nil, err
+	}
+	var versions []string
+	for _, e := range index.Entries {
+		if e.Chart == chart {
+			versions = append(versions, e.Version)
+		}
+	}
+	return versions, nil
+}
+
+// add records e in index
+func (c *chartCache) add(e cacheEntry) error {
+	// read again, the index may be changed during downloading
+	index, err := c.loadIndex()
+	if err != nil {
+		return err
+	}
+	index.put(e)
+	if err = c.saveIndex(index); err != nil {
+		return fmt.Errorf("fail to save chart cache index: %w", err)
+	}
+	return nil
+}
+
+// remove deletes files of e from cache directory, the index is not changed
+func (c *chartCache) remove(e cacheEntry) error {
+	for _, f := range []string{e.File, e.Prov} {
+		if f == "" {
+			continue
+		}
+		if err := os.Remove(path.Join(c.dir, f)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	// only removed if empty
+	os.Remove(path.Dir(path.Join(c.dir, e.File)))
+	return nil
+}
+
+// importChart copies a chart archive, along with its .prov file if any, into cache
+func (c *chartCache) importChart(file string) (cacheEntry, error) {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return cacheEntry{}, err
+	}
+	ch, err := loader.LoadFile(abs)
+	if err != nil {
+		return cacheEntry{}, fmt.Errorf("%s is not a chart archive: %w", file, err)
+	}
+	// files of the same name from different paths are kept apart by directory, like downloads
+	sum := sha256.Sum256([]byte(importedSource + abs))
+	e := cacheEntry{
+		Source:     importedSource + abs,
+		Chart:      ch.Name(),
+		Version:    ch.Metadata.Version,
+		File:       path.Join(importedDir, hex.EncodeToString(sum[:4]), path.Base(abs)),
+		Downloaded: time.Now(),
+		LastUsed:   time.Now(),
+	}
+	if err = os.MkdirAll(path.Dir(path.Join(c.dir, e.File)), 0o755); err != nil {
+		return e, err
+	}
+	if e.Digest, err = copyFileAtomic(abs, path.Join(c.dir, e.File)); err != nil {
+		return e, err
+	}
+	if _, err = os.Stat(abs + provSuffix); err == nil {
+		e.Prov = e.File + provSuffix
+		if _, err = copyFileAtomic(abs+provSuffix, path.Join(c.dir, e.Prov)); err != nil {
+			return e, err
+		}
+	} else if err = os.Remove(path.Join(c.dir, e.File+provSuffix)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		// left by an earlier import, it's not of this archive
+		return e, err
+	}
+	return e, c.add(e)
+}
+
+// download downloads chart and its provenance if needed into cache directory
+func (c *chartCache) download(chart, source, version string) (cacheEntry, error) {
+	// provenance refers to the chart by its file name, keep it and separate sources by directory
+	sum := sha256.Sum256([]byte(source))
+	name := fmt.Sprintf("%s-%s.tgz", chart, version)
+	if u, err := url.Parse(source); err == nil && strings.HasSuffix(u.Path, ".tgz") {
+		name = path.Base(u.Path)
+	}
+	e := cacheEntry{
+		Source:     source,
+		Chart:      chart,
+		Version:    version,
+		File:       path.Join(hex.EncodeToString(sum[:4]), name),
+		Downloaded: time.Now(),
+		LastUsed:   time.Now(),
+	}
+	file := path.Join(c.dir, e.File)
+	if err := os.MkdirAll(path.Dir(file), 0o755); err != nil {
+		return e, err
+	}
+
+	klog.Infof("Downloading chart from %s", source)
+	if err := c.fetchFile(source, file); err != nil {
+		// only removed if empty
+		os.Remove(path.Dir(file))
+		return e, fmt.Errorf("fail to download chart: %w", err)
+	}
+	var err error
+	if e.Digest, err = fileDigest(file); err != nil {
+		return e, err
+	}
+
+	if c.keyring != "" {
+		e.Prov = e.File + provSuffix
+		if err = c.fetchFile(source+provSuffix, path.Join(c.dir, e.Prov)); err != nil {
+			return e, fmt.Errorf("fail to download provenance file: %w", err)
+		}
+	}
+	return e, nil
+}
+
+// fetchFile downloads source to file, retrying with exponential backoff. The content is kept in file.part until
+// complete, HTTP downloads continue from it with Range requests, even if interrupted in a previous run.
+func (c *chartCache) fetchFile(source, file string) error {
+	part := file + partSuffix
+	attempts := c.attempts
+	if attempts <= 0 {
+		attempts = defaultDownloadAttempts
+	}
+	backoff := initialDownloadBackoff
+	for attempt := 1; ; attempt++ {
+		err := c.fetch(source, part)
+		if err == nil {
+			return os.Rename(part, file)
+		}
+		var statusErr *httpStatusError
+		if attempt >= attempts || (errors.As(err, &statusErr) && !statusErr.temporary()) {
+			// keep partial content for next run
+			if info, statErr := os.Stat(part); statErr == nil && info.Size() == 0 {
+				os.Remove(part)
+			}
+			return err
+		}
+		klog.Warningf("Fail to download %s (attempt %d/%d), retrying in %s: %v", source, attempt, attempts, backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxDownloadBackoff {
+			backoff = maxDownloadBackoff
+		}
+	}
+}
+
+// fetch writes the content at source to part. HTTP downloads are appended to part if the server supports Range
+// requests, and show a progress bar if stdout is a terminal.
+func (c *chartCache) fetch(source, part string) error {
+	u, err := url.Parse(source)
+	if err != nil {
+		return err
+	}
+	timeout := c.timeout
+	if timeout <= 0 {
+		timeout = defaultDownloadTimeout
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		g, err := c.getters.ByScheme(u.Scheme)
+		if err != nil {
+			return err
+		}
+		data, err := g.Get(source, getter.WithTimeout(timeout))
+		if err != nil {
+			return err
+		}
+		return writeFileAtomic(part, func(w io.Writer) error {
+			_, err := data.WriteTo(w)
+			return err
+		})
+	}
+
+	f, err := os.OpenFile(part, os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	client := c.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case offset > 0 && resp.StatusCode == http.StatusPartialContent:
+		klog.Infof("Resuming download of %s from %s", source, units.HumanSize(float64(offset)))
+	case offset > 0 && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		if resp.Header.Get("Content-Range") == fmt.Sprintf("bytes */%d", offset) {
+			// downloaded completely in the last run
+			return f.Sync()
+		}
+		// part is stale, start over in next attempt
+		if err = f.Truncate(0); err != nil {
+			return err
+		}
+		return fmt.Errorf("GET %s: %s", source, resp.Status)
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+		if offset > 0 {
+			// server doesn't support Range, start over
+			if err = f.Truncate(0); err != nil {
+				return err
+			}
+			if offset, err = f.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		}
+	default:
+		return &httpStatusError{url: source, code: resp.StatusCode, status: resp.Status}
+	}
+
+	var w io.Writer = f
+	total := int64(-1)
+	if resp.ContentLength >= 0 {
+		total = offset + resp.ContentLength
+	}
+	if bar := newProgressBar(path.Base(u.Path), offset, total); bar != nil {
+		defer bar.finish()
+		w = io.MultiWriter(f, bar)
+	}
+	if _, err = io.Copy(w, resp.Body); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// httpStatusError is a non-2xx HTTP response
+type httpStatusError struct {
+	url    string
+	code   int
+	status string
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("GET %s: %s", e.url, e.status)
+}
+
+// temporary tells if the request may succeed if retried
+func (e *httpStatusError) temporary() bool {
+	return e.code >= 500 || e.code == http.StatusRequestTimeout || e.code == http.StatusTooManyRequests
+}
+
+// verify checks the digest of cached chart, and its provenance if keyring is set
+func (c *chartCache) verify(e cacheEntry) error {
+	file := path.Join(c.dir, e.File)
+	digest, err := fileDigest(file)
+	if err != nil {
+		return err
+	}
+	if digest != e.Digest {
+		return fmt.Errorf("digest of %s is %s, expect %s", file, digest, e.Digest)
+	}
+	if c.keyring == "" {
+		return nil
+	}
+	if e.Prov == "" {
+		return fmt.Errorf("no provenance file for %s", file)
+	}
+	signatory, err := provenance.NewFromKeyring(c.keyring, "")
+	if err != nil {
+		return fmt.Errorf("fail to load keyring %s: %w", c.keyring, err)
+	}
+	if _, err = signatory.Verify(file, path.Join(c.dir, e.Prov)); err != nil {
+		return fmt.Errorf("fail to verify provenance of %s: %w", file, err)
+	}
+	return nil
+}
+
+func fileDigest(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err = io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// copyFileAtomic copies src to dst with writeFileAtomic, it returns the digest of the file
+func copyFileAtomic(src, dst string) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	hash := sha256.New()
+	err = writeFileAtomic(dst, func(w io.Writer) error {
+		_, err := io.Copy(io.MultiWriter(w, hash), in)
+		return err
+	})
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil)), err
+}
+
+// writeFileAtomic writes file through a temporary file renamed into place, so file is either complete or untouched
+func writeFileAtomic(file string, write func(w io.Writer) error) error {
+	tmp, err := os.CreateTemp(path.Dir(file), "."+path.Base(file)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err = write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
@@ -0,0 +1,393 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/kyokomi/emoji/v2"
+	"github.com/spf13/cobra"
+	"k8s.io/klog/v2"
+)
+
+// CmdCache is for commands managing the artifacts cached in ~/.vela/cache
+func CmdCache() *cobra.Command {
+	cmd := cobra.Command{
+		Use:   "cache",
+		Short: "Manage cached vela-core charts",
+		Long:  fmt.Sprintf("Manage vela-core charts cached in %s", CachePath),
+		// override root one, only prune needs the config file
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			setupLogger()
+			return nil
+		},
+	}
+	cmd.AddCommand(
+		CmdCacheList(),
+		CmdCacheImport(),
+		CmdCacheExport(),
+		CmdCachePrune(),
+		CmdCacheVerify(),
+	)
+	return &cmd
+}
+
+func CmdCacheList() *cobra.Command {
+	cmd := cobra.Command{
+		Use:     "list",
+		Aliases: []string{"ls"},
+		Short:   "List cached charts",
+		Long:    "List cached charts with their size, digest and last use",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cache := &chartCache{dir: CachePath}
+			index, err := cache.loadIndex()
+			if err != nil {
+				return chartError(fmt.Errorf("fail to read chart cache index: %w", err))
+			}
+			sortCacheEntries(index.Entries)
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+			fmt.Fprintln(w, "CHART\tVERSION\tSOURCE\tSIZE\tDIGEST\tLAST USED")
+			for _, e := range index.Entries {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", e.Chart, e.Version, e.Source, units.HumanSize(float64(cache.size(e))),
+					shortDigest(e.Digest), units.HumanDuration(time.Since(e.LastUsed))+" ago")
+			}
+			return w.Flush()
+		},
+	}
+	return &cmd
+}
+
+func CmdCacheImport() *cobra.Command {
+	cmd := cobra.Command{
+		Use:   "import FILE...",
+		Short: "Add chart archives to cache",
+		Long: "Add chart archives to cache, the .prov file next to an archive is imported too. " +
+			"Imported charts are used before downloading the same version.",
+		Example: "mvela cache import ./vela-core-1.2.4.tgz",
+		Args:    usageArgs(cobra.MinimumNArgs(1)),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cache := &chartCache{dir: CachePath}
+			for _, file := range args {
+				e, err := cache.importChart(file)
+				if err != nil {
+					return chartError(fmt.Errorf("fail to import chart %s: %w", file, err))
+				}
+				emoji.Fprintf(os.Stdout, ":white_check_mark: Imported %s as version %s\n", file, e.Version)
+			}
+			return nil
+		},
+	}
+	return &cmd
+}
+
+func CmdCacheExport() *cobra.Command {
+	var output, chart string
+	cmd := cobra.Command{
+		Use:     "export VERSION",
+		Short:   "Copy a cached chart out of cache",
+		Long:    "Copy a cached chart, along with its .prov file if any, to share it with another machine",
+		Example: "mvela cache export 1.2.4 -o /media/usb",
+		Args:    usageArgs(cobra.ExactArgs(1)),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cache := &chartCache{dir: CachePath}
+			index, err := cache.loadIndex()
+			if err != nil {
+				return chartError(fmt.Errorf("fail to read chart cache index: %w", err))
+			}
+			var found *cacheEntry
+			for i, e := range index.Entries {
+				if e.is(chart, args[0]) && cache.verify(e) == nil && (found == nil || e.Downloaded.After(found.Downloaded)) {
+					found = &index.Entries[i]
+				}
+			}
+			if found == nil {
+				return chartError(fmt.Errorf("no usable cached chart %s of version %s, check with `mvela cache list`", chart, args[0]))
+			}
+
+			dst := output
+			if info, err := os.Stat(output); err == nil && info.IsDir() {
+				dst = path.Join(output, path.Base(found.File))
+			}
+			if _, err = copyFileAtomic(path.Join(cache.dir, found.File), dst); err != nil {
+				return fmt.Errorf("fail to export chart: %w", err)
+			}
+			if found.Prov != "" {
+				if _, err = copyFileAtomic(path.Join(cache.dir, found.Prov), dst+provSuffix); err != nil {
+					return fmt.Errorf("fail to export provenance file: %w", err)
+				}
+			}
+			emoji.Fprintf(os.Stdout, ":white_check_mark: Exported chart %s to %s\n", found.Version, dst)
+			return nil
+		},
+	}
+	cmd.Flags().StringVarP(&output, "output", "o", ".", "file or directory to write the chart")
+	cmd.Flags().StringVar(&chart, "chart", velaCoreChartName, "name of the chart")
+	return &cmd
+}
+
+func CmdCachePrune() *cobra.Command {
+	var olderThan string
+	var unreferenced, all, dryRun bool
+	cmd := cobra.Command{
+		Use:   "prune",
+		Short: "Remove cached charts",
+		Long: "Remove cached charts by last use or by version. Files left in cache directory by mvela but unknown to " +
+			"the index, like partial downloads, are removed too. Other files are left alone.",
+		Example: "mvela cache prune --older-than 30d --unreferenced",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if olderThan == "" && !unreferenced && !all {
+				return withCode(ExitUsage, errors.New("specify what to remove with --older-than, --unreferenced or --all"))
+			}
+			var age time.Duration
+			if olderThan != "" {
+				var err error
+				if age, err = parseAge(olderThan); err != nil {
+					return withCode(ExitUsage, fmt.Errorf("invalid --older-than: %w", err))
+				}
+			}
+			cache := &chartCache{dir: CachePath}
+			var referenced map[string]bool
+			if unreferenced {
+				cfg, err := ReadConfig(flag.ConfigFile)
+				if err != nil {
+					return configError(err)
+				}
+				referenced = referencedCharts(cfg, cache)
+			}
+
+			index, err := cache.loadIndex()
+			if err != nil {
+				return chartError(fmt.Errorf("fail to read chart cache index: %w", err))
+			}
+			untracked := cache.untracked(index)
+			var kept []cacheEntry
+			var freed int64
+			failed := 0
+			for _, e := range index.Entries {
+				var reasons []string
+				if all {
+					reasons = append(reasons, "--all")
+				}
+				if age > 0 && time.Since(e.LastUsed) > age {
+					reasons = append(reasons, "last used "+units.HumanDuration(time.Since(e.LastUsed))+" ago")
+				}
+				if unreferenced && !referenced[e.Chart+"@"+e.Version] {
+					reasons = append(reasons, "not referenced in config")
+				}
+				if len(reasons) == 0 {
+					kept = append(kept, e)
+					continue
+				}
+				freed += cache.size(e)
+				klog.Infof("Removing chart %s %s from %s: %s", e.Chart, e.Version, e.Source, strings.Join(reasons, ", "))
+				if dryRun {
+					continue
+				}
+				if err = cache.remove(e); err != nil {
+					klog.ErrorS(err, "Fail to remove cached chart", "file", e.File)
+					kept = append(kept, e)
+					failed++
+				}
+			}
+
+			index.Entries = kept
+			for _, file := range untracked {
+				if info, err := os.Stat(file); err == nil {
+					freed += info.Size()
+				}
+				klog.Infof("Removing %s: unknown to cache index", file)
+				if !dryRun {
+					if err = os.Remove(file); err != nil {
+						klog.ErrorS(err, "Fail to remove file", "file", file)
+						failed++
+					}
+					if dir := path.Dir(file); dir != cache.dir {
+						// only removed if empty
+						os.Remove(dir)
+					}
+				}
+			}
+			if dryRun {
+				emoji.Fprintf(os.Stdout, ":information_source: %s would be freed\n", units.HumanSize(float64(freed)))
+				return nil
+			}
+			if err = cache.saveIndex(index); err != nil {
+				return fmt.Errorf("fail to save chart cache index: %w", err)
+			}
+			if failed > 0 {
+				return fmt.Errorf("fail to remove %d file(s)", failed)
+			}
+			emoji.Fprintf(os.Stdout, ":white_check_mark: %s freed\n", units.HumanSize(float64(freed)))
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&olderThan, "older-than", "", "remove charts not used for this long, like 720h or 30d")
+	cmd.Flags().BoolVar(&unreferenced, "unreferenced", false, "remove charts of versions other than the ones vela-core and releases in config resolve to")
+	cmd.Flags().BoolVar(&all, "all", false, "remove all cached charts")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "only print what would be removed")
+	return &cmd
+}
+
+func CmdCacheVerify() *cobra.Command {
+	var keyring string
+	cmd := cobra.Command{
+		Use:   "verify",
+		Short: "Check digests of cached charts",
+		Long:  "Check digests of cached charts, provenance files are verified too if --keyring is set",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cache := &chartCache{dir: CachePath}
+			index, err := cache.loadIndex()
+			if err != nil {
+				return chartError(fmt.Errorf("fail to read chart cache index: %w", err))
+			}
+			if keyring, err = expandHome(keyring); err != nil {
+				return withCode(ExitUsage, fmt.Errorf("invalid --keyring: %w", err))
+			}
+			sortCacheEntries(index.Entries)
+			failed := 0
+			for _, e := range index.Entries {
+				entryCache := *cache
+				if e.Prov != "" {
+					entryCache.keyring = keyring
+				}
+				if err = entryCache.verify(e); err != nil {
+					failed++
+					emoji.Fprintf(os.Stdout, ":x: %s %s from %s: %v\n", e.Chart, e.Version, e.Source, err)
+					continue
+				}
+				emoji.Fprintf(os.Stdout, ":white_check_mark: %s %s from %s\n", e.Chart, e.Version, e.Source)
+			}
+			if failed > 0 {
+				return chartError(fmt.Errorf("%d cached chart(s) are corrupted, they will be downloaded again on use", failed))
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&keyring, "keyring", "", "keyring to verify provenance files")
+	return &cmd
+}
+
+// referencedCharts are the cached charts vela-core and releases in config resolve to, like vela-core@1.2.4
+func referencedCharts(cfg Config, cache *chartCache) map[string]bool {
+	referenced := map[string]bool{}
+	for _, r := range append([]Release{velaCoreRelease(cfg.HelmOpts)}, cfg.Releases...) {
+		spec := r.HelmOpts.Version
+		if !isExactVersion(spec) {
+			cached, err := cache.versions(r.Chart)
+			if err != nil {
+				continue
+			}
+			if spec, err = pickVersion(spec, cached); err != nil {
+				continue
+			}
+		}
+		referenced[r.Chart+"@"+spec] = true
+	}
+	return referenced
+}
+
+// size is the total size of files of e
+func (c *chartCache) size(e cacheEntry) int64 {
+	var size int64
+	for _, f := range []string{e.File, e.Prov} {
+		if f == "" {
+			continue
+		}
+		if info, err := os.Stat(path.Join(c.dir, f)); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+// cacheDirRegexp matches directories of downloaded charts, named by the hash of their sources, see download
+var cacheDirRegexp = regexp.MustCompile(`^[0-9a-f]{8}$`)
+
+// isCacheFile tells if rel, a path relative to cache directory, is named like the files mvela writes there: chart
+// archives, provenance files, partial downloads and temporary files
+func isCacheFile(rel string) bool {
+	dir, name := path.Split(rel)
+	if i := strings.Index(name, ".tmp-"); strings.HasPrefix(name, ".") && i > 0 {
+		// left by writeFileAtomic
+		name = name[1:i]
+	}
+	switch dir = strings.TrimSuffix(dir, "/"); {
+	case dir == "":
+		return name == cacheIndexFile
+	case strings.HasPrefix(dir, importedDir+"/"):
+		// named after the imported files
+		return cacheDirRegexp.MatchString(strings.TrimPrefix(dir, importedDir+"/"))
+	case !cacheDirRegexp.MatchString(dir):
+		return false
+	}
+	name = strings.TrimSuffix(strings.TrimSuffix(name, partSuffix), provSuffix)
+	return strings.HasSuffix(name, ".tgz")
+}
+
+// untracked returns files in cache directory not recorded in index, only the ones named like cache files are
+// returned, see isCacheFile
+func (c *chartCache) untracked(index *cacheIndex) []string {
+	known := map[string]bool{cacheIndexFile: true}
+	for _, e := range index.Entries {
+		known[e.File] = true
+		known[e.Prov] = true
+	}
+	var files []string
+	err := filepath.Walk(c.dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(c.dir, file)
+		if err != nil || info.IsDir() {
+			return err
+		}
+		if rel = filepath.ToSlash(rel); !known[rel] && isCacheFile(rel) {
+			files = append(files, file)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		klog.ErrorS(err, "Fail to walk cache directory")
+	}
+	return files
+}
+
+func sortCacheEntries(entries []cacheEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Chart != entries[j].Chart {
+			return entries[i].Chart < entries[j].Chart
+		}
+		if entries[i].Version != entries[j].Version {
+			return entries[i].Version < entries[j].Version
+		}
+		return entries[i].Source < entries[j].Source
+	})
+}
+
+func shortDigest(digest string) string {
+	if len(digest) > len("sha256:")+12 {
+		return digest[:len("sha256:")+12]
+	}
+	return digest
+}
+
+// parseAge parses durations like time.ParseDuration, with d for days in addition
+func parseAge(s string) (time.Duration, error) {
+	if days := strings.TrimSuffix(s, "d"); days != s {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
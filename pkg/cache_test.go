@@ -0,0 +1,335 @@
+package pkg
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheIndex(t *testing.T) {
+	old := time.Now().Add(-time.Hour)
+	index := &cacheIndex{}
+	index.put(cacheEntry{Source: "https://a/vela-core-1.0.0.tgz", Chart: "vela-core", Version: "1.0.0", File: "a"})
+	index.put(cacheEntry{Source: importedSource + "/tmp/old.tgz", Chart: "vela-core", Version: "1.0.0", File: "old", Downloaded: old})
+	index.put(cacheEntry{Source: importedSource + "/tmp/new.tgz", Chart: "vela-core", Version: "1.0.0", File: "new", Downloaded: time.Now()})
+	index.put(cacheEntry{Source: "https://a/vela-core-1.0.0.tgz", Chart: "vela-core", Version: "1.0.0", File: "b"})
+
+	if len(index.Entries) != 3 {
+		t.Fatalf("expect entry of the same source replaced, got %v", index.Entries)
+	}
+	if e := index.find("https://a/vela-core-1.0.0.tgz"); e == nil || e.File != "b" {
+		t.Errorf("expect the latest entry of source, got %v", e)
+	}
+	if e := index.find("https://b/vela-core-1.0.0.tgz"); e != nil {
+		t.Errorf("expect nothing found, got %v", e)
+	}
+	if e := index.findImported("vela-core", "1.0.0"); e == nil || e.File != "new" {
+		t.Errorf("expect the latest imported chart, got %v", e)
+	}
+	if e := index.findImported("vela-core", "2.0.0"); e != nil {
+		t.Errorf("expect nothing found, got %v", e)
+	}
+}
+
+func TestCacheIndexSaveLoad(t *testing.T) {
+	c := &chartCache{dir: t.TempDir()}
+	index, err := c.loadIndex()
+	if err != nil || len(index.Entries) != 0 {
+		t.Fatalf("expect empty index without index file, got %v, %v", index, err)
+	}
+	e := cacheEntry{Source: "https://a/b.tgz", Chart: "b", Version: "1.0.0", File: "x/b.tgz", Digest: "sha256:00"}
+	if err = c.add(e); err != nil {
+		t.Fatal(err)
+	}
+	if index, err = c.loadIndex(); err != nil || len(index.Entries) != 1 || index.Entries[0].Digest != e.Digest {
+		t.Errorf("expect entry saved, got %v, %v", index, err)
+	}
+	if err = os.WriteFile(c.indexPath(), []byte("entries: {"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.loadIndex(); err == nil || !strings.Contains(err.Error(), "invalid chart cache index") {
+		t.Errorf("expect invalid index error, got %v", err)
+	}
+}
+
+func TestCacheGet(t *testing.T) {
+	content := "chart archive"
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.URL.Path != "/vela-core-1.0.0.tgz" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(content))
+	}))
+	defer server.Close()
+	c := &chartCache{dir: t.TempDir(), attempts: 1}
+	source := server.URL + "/vela-core-1.0.0.tgz"
+
+	file, err := c.get(velaCoreChartName, []string{server.URL + "/missing.tgz", source}, "1.0.0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(file); string(data) != content {
+		t.Fatalf("expect chart downloaded from the second source, got %q", data)
+	}
+	if path.Base(file) != "vela-core-1.0.0.tgz" {
+		t.Errorf("expect file named after URL, got %s", file)
+	}
+
+	atomic.StoreInt32(&requests, 0)
+	if _, err = c.get(velaCoreChartName, []string{source}, "1.0.0", ""); err != nil || requests != 0 {
+		t.Fatalf("expect cached chart used, got %d request(s), %v", requests, err)
+	}
+
+	// corrupted charts are downloaded again
+	if err = os.WriteFile(file, []byte("corrupted"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.get(velaCoreChartName, []string{source}, "1.0.0", ""); err != nil || requests != 1 {
+		t.Fatalf("expect chart downloaded again, got %d request(s), %v", requests, err)
+	}
+	if data, _ := os.ReadFile(file); string(data) != content {
+		t.Errorf("expect corrupted chart replaced, got %q", data)
+	}
+}
+
+// charts may be installed into clusters in parallel, each chart is downloaded once
+func TestCacheGetParallel(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte("chart archive"))
+	}))
+	defer server.Close()
+	c := &chartCache{dir: t.TempDir(), attempts: 1}
+	source := server.URL + "/vela-core-1.0.0.tgz"
+
+	errs := make(chan error, 4)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			_, err := c.get(velaCoreChartName, []string{source}, "1.0.0", "")
+			errs <- err
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("expect chart downloaded once, got %d request(s)", requests)
+	}
+	if versions, _ := c.versions(velaCoreChartName); len(versions) != 1 {
+		t.Errorf("expect one cache entry, got %v", versions)
+	}
+}
+
+func TestCacheVerify(t *testing.T) {
+	c := &chartCache{dir: t.TempDir()}
+	if err := os.WriteFile(path.Join(c.dir, "a.tgz"), []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	digest, err := fileDigest(path.Join(c.dir, "a.tgz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name  string
+		entry cacheEntry
+		// keyring is set to verify provenance
+		keyring string
+		err     string
+	}{
+		{name: "valid", entry: cacheEntry{File: "a.tgz", Digest: digest}},
+		{name: "digest mismatch", entry: cacheEntry{File: "a.tgz", Digest: "sha256:00"}, err: "expect sha256:00"},
+		{name: "missing", entry: cacheEntry{File: "b.tgz", Digest: digest}, err: "no such file"},
+		{name: "no provenance", entry: cacheEntry{File: "a.tgz", Digest: digest}, keyring: "pubring.gpg", err: "no provenance file"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			vc := *c
+			vc.keyring = tc.keyring
+			err := vc.verify(tc.entry)
+			if tc.err == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+				t.Fatalf("expect error %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestIsCacheFile(t *testing.T) {
+	for rel, want := range map[string]bool{
+		"index.yaml":                             true,
+		".index.yaml.tmp-123":                    true,
+		"0a1b2c3d/vela-core-1.2.4.tgz":           true,
+		"0a1b2c3d/vela-core-1.2.4.tgz.prov":      true,
+		"0a1b2c3d/vela-core-1.2.4.tgz.part":      true,
+		"0a1b2c3d/vela-core-1.2.4.tgz.prov.part": true,
+		"0a1b2c3d/.vela-core-1.2.4.tgz.tmp-123":  true,
+		"imported/0a1b2c3d/my-chart.tar.gz":      true,
+		"imported/0a1b2c3d/my-chart.tar.gz.prov": true,
+		"imported/my-chart.tar.gz":               false,
+		"imported/x/my-chart.tar.gz":             false,
+		"notes.txt":                              false,
+		"0a1b2c3d/notes.txt":                     false,
+		"backup/vela-core-1.2.4.tgz":             false,
+		"0a1b2c3d/x/vela-core-1.2.4.tgz":         false,
+	} {
+		if got := isCacheFile(rel); got != want {
+			t.Errorf("%s: expect %v, got %v", rel, want, got)
+		}
+	}
+}
+
+func TestFetchFileResume(t *testing.T) {
+	content := "0123456789"
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		http.ServeContent(w, r, "chart.tgz", time.Time{}, strings.NewReader(content))
+	}))
+	defer server.Close()
+	c := &chartCache{dir: t.TempDir(), attempts: 1}
+	file := path.Join(c.dir, "chart.tgz")
+
+	// left by an interrupted download
+	if err := os.WriteFile(file+partSuffix, []byte(content[:4]), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.fetchFile(server.URL+"/chart.tgz", file); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(file); string(data) != content {
+		t.Errorf("expect %q, got %q", content, data)
+	}
+	if len(ranges) != 1 || ranges[0] != "bytes=4-" {
+		t.Errorf("expect download resumed from byte 4, got ranges %q", ranges)
+	}
+	if _, err := os.Stat(file + partSuffix); !os.IsNotExist(err) {
+		t.Errorf("expect partial file renamed, got %v", err)
+	}
+}
+
+func TestFetchFileRetry(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch n := atomic.AddInt32(&requests, 1); {
+		case r.URL.Path == "/missing.tgz":
+			http.NotFound(w, r)
+		case n == 1:
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte("chart"))
+		}
+	}))
+	defer server.Close()
+	c := &chartCache{dir: t.TempDir(), attempts: 2}
+
+	if err := c.fetchFile(server.URL+"/chart.tgz", path.Join(c.dir, "chart.tgz")); err != nil || requests != 2 {
+		t.Fatalf("expect success after a retry, got %d request(s), %v", requests, err)
+	}
+	atomic.StoreInt32(&requests, 0)
+	err := c.fetchFile(server.URL+"/missing.tgz", path.Join(c.dir, "missing.tgz"))
+	if err == nil || requests != 1 {
+		t.Fatalf("expect no retry on 404, got %d request(s), %v", requests, err)
+	}
+	if _, err = os.Stat(path.Join(c.dir, "missing.tgz"+partSuffix)); !os.IsNotExist(err) {
+		t.Errorf("expect empty partial file removed, got %v", err)
+	}
+}
+
+func TestImportChart(t *testing.T) {
+	c := &chartCache{dir: t.TempDir()}
+	src := t.TempDir()
+	var entries []cacheEntry
+	for i, dir := range []string{path.Join(src, "a"), path.Join(src, "b")} {
+		file := path.Join(dir, "vela-core-1.2.4.tgz")
+		writeChartArchive(t, file, "1.2.4", fmt.Sprintf("description: chart %d\n", i))
+		if i == 0 {
+			if err := os.WriteFile(file+provSuffix, []byte("prov"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		e, err := c.importChart(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Chart != velaCoreChartName || e.Version != "1.2.4" || !e.imported() {
+			t.Errorf("unexpected entry %+v", e)
+		}
+		entries = append(entries, e)
+	}
+	if entries[0].File == entries[1].File {
+		t.Fatalf("expect archives of the same name kept apart, got %s", entries[0].File)
+	}
+	if entries[0].Prov == "" || entries[1].Prov != "" {
+		t.Errorf("expect only the first one with provenance, got %q and %q", entries[0].Prov, entries[1].Prov)
+	}
+	for _, e := range entries {
+		if err := c.verify(e); err != nil {
+			t.Errorf("expect %s verified, got %v", e.File, err)
+		}
+		if !isCacheFile(e.File) {
+			t.Errorf("expect %s named like a cache file", e.File)
+		}
+	}
+	if err := c.remove(entries[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.verify(entries[1]); err != nil {
+		t.Errorf("expect the other archive kept, got %v", err)
+	}
+
+	// importing again without provenance drops the old one
+	if err := os.Remove(path.Join(src, "a", "vela-core-1.2.4.tgz"+provSuffix)); err != nil {
+		t.Fatal(err)
+	}
+	e, err := c.importChart(path.Join(src, "a", "vela-core-1.2.4.tgz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(path.Join(c.dir, e.File+provSuffix)); e.Prov != "" || !os.IsNotExist(err) {
+		t.Errorf("expect no provenance left, got %q, %v", e.Prov, err)
+	}
+}
+
+// writeChartArchive writes a chart archive of vela-core at version to file, extra is appended to its Chart.yaml
+func writeChartArchive(t *testing.T, file, version, extra string) {
+	t.Helper()
+	if err := os.MkdirAll(path.Dir(file), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	chartYAML := "apiVersion: v2\nname: vela-core\nversion: " + version + "\n" + extra
+	if err = tw.WriteHeader(&tar.Header{Name: "vela-core/Chart.yaml", Mode: 0o644, Size: int64(len(chartYAML))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tw.Write([]byte(chartYAML)); err != nil {
+		t.Fatal(err)
+	}
+	if err = tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,276 @@
+package pkg
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/getter"
+	helmregistry "helm.sh/helm/v3/pkg/registry"
+	"helm.sh/helm/v3/pkg/repo"
+	"k8s.io/klog/v2"
+)
+
+// Chart source types of HelmOpts.Type
+const (
+	ChartSourceLocal = "local"
+	ChartSourceURL   = "url"
+	ChartSourceRepo  = "repo"
+	ChartSourceOCI   = "oci"
+)
+
+const (
+	velaCoreChartName = "vela-core"
+	// DefaultChartURL is the chart archive URL used by type url if chartPath is not set
+	DefaultChartURL = "https://kubevelacharts.oss-cn-hangzhou.aliyuncs.com/core/vela-core-{version}.tgz"
+	// DefaultChartRepo is the KubeVela Helm repo used by type repo if chartPath is not set
+	DefaultChartRepo = "https://charts.kubevela.net/core"
+	// chartVersionPlaceholder in chartPath of type url is replaced by the chart version
+	chartVersionPlaceholder = "{version}"
+)
+
+var chartSourceTypes = []string{ChartSourceLocal, ChartSourceURL, ChartSourceRepo, ChartSourceOCI}
+
+// chartSource is where vela-core chart comes from
+type chartSource interface {
+	// locate returns the path of chart archive or directory of version, remote charts are downloaded to cache
+	locate(version string) (string, error)
+	// versions lists the chart versions available
+	versions() ([]string, error)
+}
+
+// newChartCache returns the cache of remote charts downloaded with client, charts are verified with keyring if opts.Verify
+func newChartCache(opts HelmOpts, settings *cli.EnvSettings, client *http.Client) (*chartCache, error) {
+	cache := &chartCache{
+		dir:      CachePath,
+		attempts: opts.DownloadAttempts,
+		client:   client,
+	}
+	if opts.DownloadTimeout != "" {
+		timeout, err := time.ParseDuration(opts.DownloadTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid helmOpts.downloadTimeout: %w", err)
+		}
+		cache.timeout = timeout
+	}
+	cache.getters = chartGetters(settings, client, cache.timeout)
+	if opts.Verify {
+		keyring, err := expandHome(opts.Keyring)
+		if err != nil {
+			return nil, err
+		}
+		if keyring == "" {
+			keyring = defaultKeyring()
+		}
+		cache.keyring = keyring
+	}
+	return cache, nil
+}
+
+// newChartSource picks the source of chart by HelmOpts.Type, type url is the default. Only vela-core has default
+// chartPath.
+func newChartSource(chart string, opts HelmOpts, cache *chartCache) (chartSource, error) {
+	chartPath := opts.ChartPath
+	if chartPath == "" && chart != velaCoreChartName {
+		return nil, fmt.Errorf("chartPath of chart %s is not set", chart)
+	}
+	switch opts.Type {
+	case ChartSourceLocal:
+		return localChart{path: chartPath}, nil
+	case "", ChartSourceURL:
+		if chartPath == "" {
+			chartPath = DefaultChartURL
+		}
+		return urlChart{chart: chart, urls: append([]string{chartPath}, opts.Mirrors...), cache: cache}, nil
+	case ChartSourceRepo:
+		if chartPath == "" {
+			chartPath = DefaultChartRepo
+		}
+		return repoChart{chart: chart, repoURL: chartPath, cache: cache}, nil
+	case ChartSourceOCI:
+		return ociChart{chart: chart, ref: chartPath, cache: cache}, nil
+	}
+	return nil, fmt.Errorf("unknown chart source type %q, expect one of %s", opts.Type, strings.Join(chartSourceTypes, "|"))
+}
+
+// downloadTimeout is the timeout of each download request of opts, helmOpts.downloadTimeout is validated on
+// loading config
+func downloadTimeout(opts HelmOpts) time.Duration {
+	if timeout, err := time.ParseDuration(opts.DownloadTimeout); err == nil && timeout > 0 {
+		return timeout
+	}
+	return defaultDownloadTimeout
+}
+
+// defaultKeyring is the keyring Helm uses to verify charts by default
+func defaultKeyring() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return path.Join(home, ".gnupg", "pubring.gpg")
+}
+
+// localChart is a chart archive or unpacked chart directory on disk, for vela-core developers
+type localChart struct {
+	path string
+}
+
+func (c localChart) locate(string) (string, error) {
+	file, err := expandHome(c.path)
+	if err != nil {
+		return "", err
+	}
+	if _, err = os.Stat(file); err != nil {
+		return "", fmt.Errorf("local chart not found: %w", err)
+	}
+	return file, nil
+}
+
+// versions of local chart is the version in its Chart.yaml
+func (c localChart) versions() ([]string, error) {
+	file, err := c.locate("")
+	if err != nil {
+		return nil, err
+	}
+	ch, err := loader.Load(file)
+	if err != nil {
+		return nil, err
+	}
+	return []string{ch.Metadata.Version}, nil
+}
+
+// urlChart is a chart archive at an URL and its mirrors, {version} in them is replaced by chart version
+type urlChart struct {
+	chart string
+	// urls are tried in order
+	urls  []string
+	cache *chartCache
+}
+
+func (c urlChart) chartURLs(version string) []string {
+	var urls []string
+	for _, u := range c.urls {
+		urls = append(urls, strings.ReplaceAll(u, chartVersionPlaceholder, version))
+	}
+	return urls
+}
+
+func (c urlChart) locate(version string) (string, error) {
+	return c.cache.get(c.chart, c.chartURLs(version), version, "")
+}
+
+// versions are listed from index.yaml next to the chart archives, like a Helm repo. Mirrors are tried in order.
+func (c urlChart) versions() ([]string, error) {
+	var versions []string
+	var err error
+	for i, u := range c.urls {
+		if versions, err = repoVersions(u[:strings.LastIndex(u, "/")+1], c.chart, c.cache.getters); err == nil {
+			return versions, nil
+		}
+		if i < len(c.urls)-1 {
+			klog.Warningf("Fail to list chart versions, trying next mirror: %v", err)
+		}
+	}
+	return nil, err
+}
+
+// repoChart is a chart in a classic Helm repo, resolved by its index.yaml
+type repoChart struct {
+	chart   string
+	repoURL string
+	cache   *chartCache
+}
+
+func (c repoChart) locate(version string) (string, error) {
+	index, err := loadRepoIndex(c.repoURL, c.cache.getters)
+	if err != nil {
+		if file, ok := c.cache.lookup(c.chart, version, ""); ok {
+			klog.Warningf("Using cached chart %s: %v", file, err)
+			return file, nil
+		}
+		return "", err
+	}
+	cv, err := index.Get(c.chart, version)
+	if err != nil {
+		return "", fmt.Errorf("%s %s not found in chart repo %s", c.chart, version, c.repoURL)
+	}
+	if len(cv.URLs) == 0 {
+		return "", fmt.Errorf("%s %s has no download URL in chart repo %s", c.chart, version, c.repoURL)
+	}
+	chartURL, err := repo.ResolveReferenceURL(c.repoURL, cv.URLs[0])
+	if err != nil {
+		return "", err
+	}
+	return c.cache.get(c.chart, []string{chartURL}, cv.Version, repoDigest(cv.Digest))
+}
+
+// repoDigest converts the digest of chart archive in repo index, which is hex of sha256, to the form in cache.
+// It's empty if the index doesn't have it.
+func repoDigest(digest string) string {
+	if digest == "" {
+		return ""
+	}
+	return "sha256:" + strings.TrimPrefix(digest, "sha256:")
+}
+
+func (c repoChart) versions() ([]string, error) {
+	return repoVersions(c.repoURL, c.chart, c.cache.getters)
+}
+
+// ociChart is a chart in OCI registry, like oci://ghcr.io/kubevela/vela-core
+type ociChart struct {
+	chart string
+	ref   string
+	cache *chartCache
+}
+
+func (c ociChart) locate(version string) (string, error) {
+	// OCI tags can't contain +
+	return c.cache.get(c.chart, []string{c.ref + ":" + strings.ReplaceAll(version, "+", "_")}, version, "")
+}
+
+// versions are the tags of the chart in registry
+func (c ociChart) versions() ([]string, error) {
+	client, err := helmregistry.NewClient()
+	if err != nil {
+		return nil, err
+	}
+	return client.Tags(strings.TrimPrefix(c.ref, helmregistry.OCIScheme+"://"))
+}
+
+// loadRepoIndex downloads index.yaml of the Helm repo at repoURL
+func loadRepoIndex(repoURL string, getters getter.Providers) (*repo.IndexFile, error) {
+	r, err := repo.NewChartRepository(&repo.Entry{Name: "mvela", URL: repoURL}, getters)
+	if err != nil {
+		return nil, err
+	}
+	// don't leave index files in Helm cache
+	if r.CachePath, err = os.MkdirTemp("", "mvela-repo"); err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(r.CachePath)
+	indexFile, err := r.DownloadIndexFile()
+	if err != nil {
+		return nil, fmt.Errorf("fail to download index of chart repo %s: %w", repoURL, err)
+	}
+	return repo.LoadIndexFile(indexFile)
+}
+
+// repoVersions lists versions of chart in the Helm repo at repoURL
+func repoVersions(repoURL, chart string, getters getter.Providers) ([]string, error) {
+	index, err := loadRepoIndex(repoURL, getters)
+	if err != nil {
+		return nil, err
+	}
+	var versions []string
+	for _, cv := range index.Entries[chart] {
+		versions = append(versions, cv.Version)
+	}
+	return versions, nil
+}
@@ -0,0 +1,148 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/getter"
+)
+
+func TestNewChartSource(t *testing.T) {
+	cache := &chartCache{}
+	cases := []struct {
+		name  string
+		chart string
+		opts  HelmOpts
+		want  chartSource
+		err   string
+	}{
+		{name: "default", chart: velaCoreChartName, want: urlChart{chart: velaCoreChartName, urls: []string{DefaultChartURL}, cache: cache}},
+		{
+			name:  "url with mirrors",
+			chart: velaCoreChartName,
+			opts:  HelmOpts{Type: ChartSourceURL, ChartPath: "https://a/c-{version}.tgz", Mirrors: []string{"https://b/c-{version}.tgz"}},
+			want:  urlChart{chart: velaCoreChartName, urls: []string{"https://a/c-{version}.tgz", "https://b/c-{version}.tgz"}, cache: cache},
+		},
+		{name: "default repo", chart: velaCoreChartName, opts: HelmOpts{Type: ChartSourceRepo}, want: repoChart{chart: velaCoreChartName, repoURL: DefaultChartRepo, cache: cache}},
+		{name: "local", chart: velaCoreChartName, opts: HelmOpts{Type: ChartSourceLocal, ChartPath: "./charts"}, want: localChart{path: "./charts"}},
+		{name: "oci", chart: "c", opts: HelmOpts{Type: ChartSourceOCI, ChartPath: "oci://r.io/c"}, want: ociChart{chart: "c", ref: "oci://r.io/c", cache: cache}},
+		{name: "no chartPath of other charts", chart: "c", opts: HelmOpts{Type: ChartSourceRepo}, err: "chartPath of chart c is not set"},
+		{name: "unknown type", chart: velaCoreChartName, opts: HelmOpts{Type: "git"}, err: `unknown chart source type "git"`},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := newChartSource(c.chart, c.opts, cache)
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("expect error %q, got %v", c.err, err)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(got, c.want) {
+				t.Errorf("expect %+v, got %+v, %v", c.want, got, err)
+			}
+		})
+	}
+}
+
+func TestURLChartURLs(t *testing.T) {
+	c := urlChart{urls: []string{"https://a/vela-core-{version}.tgz", "https://b/{version}/vela-core.tgz", "https://c/vela-core.tgz"}}
+	want := []string{"https://a/vela-core-1.2.4.tgz", "https://b/1.2.4/vela-core.tgz", "https://c/vela-core.tgz"}
+	if got := c.chartURLs("1.2.4"); !equalStrings(got, want) {
+		t.Errorf("expect %v, got %v", want, got)
+	}
+}
+
+func TestLocalChart(t *testing.T) {
+	dir := path.Join(t.TempDir(), "vela-core")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(dir, "Chart.yaml"), []byte("apiVersion: v2\nname: vela-core\nversion: 1.2.4\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c := localChart{path: dir}
+	if file, err := c.locate("1.0.0"); err != nil || file != dir {
+		t.Errorf("expect the chart directory whatever the version, got %s, %v", file, err)
+	}
+	if versions, err := c.versions(); err != nil || !equalStrings(versions, []string{"1.2.4"}) {
+		t.Errorf("expect version in Chart.yaml, got %v, %v", versions, err)
+	}
+	missing := localChart{path: path.Join(dir, "none")}
+	if _, err := missing.locate(""); err == nil || !strings.Contains(err.Error(), "local chart not found") {
+		t.Errorf("expect chart not found, got %v", err)
+	}
+}
+
+func TestRepoChartDigest(t *testing.T) {
+	content := "chart archive"
+	served := content
+	sum := sha256.Sum256([]byte(content))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/index.yaml":
+			fmt.Fprintf(w, "apiVersion: v1\nentries:\n  vela-core:\n  - name: vela-core\n    version: 1.0.0\n    digest: %x\n    urls: [vela-core-1.0.0.tgz]\n", sum)
+		case "/vela-core-1.0.0.tgz":
+			w.Write([]byte(served))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	cache := &chartCache{dir: t.TempDir(), attempts: 1, getters: getter.All(cli.New())}
+	c := repoChart{chart: velaCoreChartName, repoURL: server.URL, cache: cache}
+
+	// a tampered or truncated download is rejected
+	served = content[:5]
+	_, err := c.locate("1.0.0")
+	if err == nil || !strings.Contains(err.Error(), "published by the chart repo") {
+		t.Fatalf("expect digest mismatch, got %v", err)
+	}
+	if versions, _ := cache.versions(velaCoreChartName); len(versions) != 0 {
+		t.Errorf("expect nothing cached, got %v", versions)
+	}
+
+	served = content
+	file, err := c.locate("1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(file); string(data) != content {
+		t.Errorf("expect the chart downloaded, got %q", data)
+	}
+
+	// the cached one is replaced if it differs from the repo
+	if err = os.WriteFile(file, []byte("republished"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	index, err := cache.loadIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.Entries[0].Digest, _ = fileDigest(file)
+	if err = cache.saveIndex(index); err != nil {
+		t.Fatal(err)
+	}
+	if file, err = c.locate("1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(file); string(data) != content {
+		t.Errorf("expect the chart downloaded again, got %q", data)
+	}
+}
+
+func TestRepoDigest(t *testing.T) {
+	for digest, want := range map[string]string{"": "", "abcd": "sha256:abcd", "sha256:abcd": "sha256:abcd"} {
+		if got := repoDigest(digest); got != want {
+			t.Errorf("%s: expect %q, got %q", digest, want, got)
+		}
+	}
+}
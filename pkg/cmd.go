@@ -7,11 +7,8 @@ import (
 	l "github.com/rancher/k3d/v5/pkg/logger"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
-	"k8s.io/klog/v2"
 )
 
-const VelaCoreVersion = "1.2.2"
-
 type rootFlag struct {
 	Debug      bool
 	ConfigFile string
@@ -28,42 +25,79 @@ func NewCmdMVela() *cobra.Command {
 	rootCmd := cobra.Command{
 		Use:   "mvela",
 		Short: "mvela is a tool helps run KubeVela in Docker",
-		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			setupLogger()
 			cmdConfig, err = ReadConfig(flag.ConfigFile)
-
 			if err != nil {
-				klog.ErrorS(err, "fail to read config file")
-				os.Exit(1)
-			}
-			l.Log().SetLevel(logrus.FatalLevel)
-			if flag.Debug {
-				l.Log().SetLevel(logrus.DebugLevel)
-				debugMode = true
+				return configError(err)
 			}
+			return nil
 		},
 		Run: func(cmd *cobra.Command, args []string) {
 			fmt.Println("reserved for merge in vela CLI")
 		},
+		// errors are printed by Execute
+		SilenceErrors: true,
+		SilenceUsage:  true,
 	}
+	rootCmd.SetFlagErrorFunc(func(cmd *cobra.Command, err error) error {
+		return withCode(ExitUsage, err)
+	})
 	rootCmd.PersistentFlags().StringVarP(&flag.ConfigFile, "config", "c", "", "set configuration file")
 	rootCmd.PersistentFlags().BoolVar(&flag.Debug, "debug", false, "print debug logs")
 	rootCmd.AddCommand(
 		CmdCreate(&cmdConfig),
+		CmdApply(&cmdConfig),
+		CmdDiff(&cmdConfig),
 		CmdDelete(&cmdConfig),
+		CmdUpgrade(&cmdConfig),
+		CmdRollback(&cmdConfig),
+		CmdUpgradeTest(&cmdConfig),
+		CmdConfig(),
+		CmdCache(),
 	)
 
+	markCommandsRun(&rootCmd)
 	return &rootCmd
 }
 
+// commandRun is set once a command starts running, errors before that are caused by invalid usage
+var commandRun bool
+
+func markCommandsRun(cmd *cobra.Command) {
+	if run := cmd.RunE; run != nil {
+		cmd.RunE = func(cmd *cobra.Command, args []string) error {
+			commandRun = true
+			return run(cmd, args)
+		}
+	}
+	for _, c := range cmd.Commands() {
+		markCommandsRun(c)
+	}
+}
+
+func setupLogger() {
+	l.Log().SetLevel(logrus.FatalLevel)
+	if flag.Debug {
+		l.Log().SetLevel(logrus.DebugLevel)
+		debugMode = true
+	}
+}
+
+// Execute runs mvela and exits with the code of error if any, see ExitCode
 func Execute() {
 	cmd := NewCmdMVela()
-	err := cmd.ParseFlags(os.Args)
-	if err != nil {
-		klog.ErrorS(err, "parse fail")
+	c, err := cmd.ExecuteC()
+	if err == nil {
 		return
 	}
-	err = cmd.Execute()
-	if err != nil {
-		klog.ErrorS(err, "execute fail")
+	code := exitCodeOf(err)
+	if code == ExitFailure && !commandRun {
+		code = ExitUsage
+	}
+	printError(os.Stderr, err, flag.Debug)
+	if code == ExitUsage {
+		fmt.Fprintf(os.Stderr, "Run '%s --help' for usage.\n", c.CommandPath())
 	}
+	os.Exit(int(code))
 }
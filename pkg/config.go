@@ -3,17 +3,30 @@ package pkg
 import (
 	_ "embed"
 	"errors"
+	"fmt"
 	"os"
 	"path"
+	"reflect"
+	"sort"
+	"strings"
+
+	"mvela/pkg/apis/v1alpha1"
+	"mvela/pkg/apis/v1alpha2"
 
 	config "github.com/rancher/k3d/v5/pkg/config/v1alpha4"
-	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
 	"k8s.io/klog/v2"
 )
 
 const (
 	configName string = "mvela"
 	k3dPrefix  string = "k3d"
+
+	// configFileEnv is the environment variable to specify config file
+	configFileEnv = "MVELA_CONFIG"
+
+	DefaultK3sImage = "rancher/k3s:latest"
+	DefaultAPIPort  = 6443
 )
 
 // VelaDir is ~/.vela
@@ -31,11 +44,23 @@ func VelaDir() string {
 	return velaDir
 }
 
+// expandHome replaces leading ~/ in file with home directory
+func expandHome(file string) (string, error) {
+	if !strings.HasPrefix(file, "~/") {
+		return file, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(home, file[2:]), nil
+}
+
 func initDefaultConfig() (Config, error) {
 	velaDir := VelaDir()
 	return Config{
-		ApiVersion:     "mvela.oam.dev/v1alpha1",
-		Kind:           "Simple",
+		ApiVersion:     v1alpha2.APIVersion,
+		Kind:           KindSimple,
 		ManagedCluster: 1,
 		KubeconfigOpts: KubeconfigOption{
 			Output: path.Join(velaDir, "kubeConfig"),
@@ -43,50 +68,257 @@ func initDefaultConfig() (Config, error) {
 	}, nil
 }
 
+// loadedConfig is the completed config with where its fields come from
+type loadedConfig struct {
+	Config
+	// Lines are the lines of fields set in File
+	Lines fieldLines
+	// Envs are the environment variables overriding fields, indexed by field path
+	Envs map[string]string
+	// Generated are the files keeping values generated by mvela, indexed by field path
+	Generated map[string]string
+}
+
 func ReadConfig(ConfigFile string) (Config, error) {
-	res := Config{}
-	if ConfigFile == "" {
-		_, err := os.Stat("example/conf.yaml")
-		if err != nil && errors.Is(err, os.ErrNotExist) {
-			return initDefaultConfig()
-		}
-		ConfigFile = "example/conf.yaml"
-		klog.Infof("Using config file: %s\n", ConfigFile)
-	}
-	// for reading keys with dot
-	v := viper.NewWithOptions(viper.KeyDelimiter("::"))
-	v.SetConfigFile(ConfigFile)
-	err := bindEnv(v)
+	lc, err := loadConfig(ConfigFile)
 	if err != nil {
-		klog.Error("Fail to bind environment to mvela config")
+		return Config{}, err
 	}
+	return lc.Config, nil
+}
 
-	err = v.ReadInConfig()
+// loadConfig reads config from file and environment, the result is validated and completed
+func loadConfig(ConfigFile string) (*loadedConfig, error) {
+	res, err := initDefaultConfig()
+	if err != nil {
+		return nil, err
+	}
+	ConfigFile, err = findConfigFile(ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	lines := fieldLines{}
+	if ConfigFile != "" {
+		lines, err = loadConfigFile(ConfigFile, &res)
+		if err != nil {
+			return nil, err
+		}
+		res.File = ConfigFile
+	}
+
+	envs, errs := applyEnv(&res)
+	for field := range envs {
+		// values in file are overridden
+		for f := range lines {
+			if f == field || strings.HasPrefix(f, field+".") || strings.HasPrefix(f, field+"[") {
+				delete(lines, f)
+			}
+		}
+	}
 
+	if errs = append(errs, validateConfig(res, lines)...); len(errs) != 0 {
+		sortFieldErrors(errs)
+		if ConfigFile == "" {
+			return nil, fmt.Errorf("invalid config: %w", errs)
+		}
+		return nil, fmt.Errorf("invalid config file %s: %w", ConfigFile, errs)
+	}
+
+	generated := map[string]string{}
+	if res.Storage.Endpoint != "" && res.Token == "" {
+		// it's generated by create or apply if there is none yet, see ensureToken
+		if res.Token, err = readToken(); err != nil {
+			return nil, err
+		}
+		generated["token"] = tokenFile()
+	}
+	// reportConf(res)
+
+	return &loadedConfig{Config: CompleteConfig(res), Lines: lines, Envs: envs, Generated: generated}, nil
+}
+
+// configSearchPaths are places to look for config file if it's not specified by -c or $MVELA_CONFIG, in order
+func configSearchPaths() []string {
+	paths := []string{".mvela.yaml", path.Join(VelaDir(), "mvela.yaml")}
+	if configDir, err := os.UserConfigDir(); err == nil {
+		paths = append(paths, path.Join(configDir, configName, "mvela.yaml"))
+	}
+	return paths
+}
+
+// findConfigFile finds config file in order: -c flag, $MVELA_CONFIG, ./.mvela.yaml, ~/.vela/mvela.yaml and
+// $XDG_CONFIG_HOME/mvela/mvela.yaml. It returns empty string if no config file found, defaults are used then.
+func findConfigFile(flagFile string) (string, error) {
+	if flagFile != "" {
+		klog.Infof("Using config file: %s (from -c flag)", flagFile)
+		return flagFile, nil
+	}
+	if envFile := os.Getenv(configFileEnv); envFile != "" {
+		klog.Infof("Using config file: %s (from $%s)", envFile, configFileEnv)
+		return envFile, nil
+	}
+	for _, p := range configSearchPaths() {
+		_, err := os.Stat(p)
+		if err == nil {
+			klog.Infof("Using config file: %s", p)
+			return p, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", fmt.Errorf("fail to check config file %s: %w", p, err)
+		}
+	}
+	klog.Info("No config file found, using default configuration")
+	return "", nil
+}
+
+// readConfigFile returns the content of config file as YAML or JSON. CUE file is evaluated and validated
+// against the schema, the line of each field is returned in this case.
+func readConfigFile(file string) ([]byte, fieldLines, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("fail to read config file: %w", err)
+	}
+	if !isCUEFile(file) {
+		return data, nil, nil
+	}
+	data, lines, err := evalCUEConfig(file, data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid config file %s: %w", file, err)
+	}
+	return data, lines, nil
+}
+
+// loadConfigFile reads config file onto c, returns the line of each field
+func loadConfigFile(file string, c *Config) (fieldLines, error) {
+	data, cueLines, err := readConfigFile(file)
+	if err != nil {
+		return nil, err
+	}
+	lines, err := decodeConfig(data, c)
 	if err != nil {
-		klog.ErrorS(err, "Fail to read config file")
+		return nil, fmt.Errorf("invalid config file %s: %w", file, err)
+	}
+	if cueLines != nil {
+		return cueLines, nil
 	}
+	return lines, nil
+}
 
-	err = v.Unmarshal(&res)
+// decodeConfig decodes YAML data onto c according to its apiVersion. Unknown fields and values
+// of wrong type are reported all together. It returns the line of each field for further validation.
+func decodeConfig(data []byte, c *Config) (fieldLines, error) {
+	doc := yaml.Node{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	lines := fieldLines{}
+	refs := secretRefs{}
+	if len(doc.Content) == 0 {
+		return lines, nil
+	}
+	root := doc.Content[0]
+	version, err := detectAPIVersion(root)
 	if err != nil {
-		klog.ErrorS(err, "Fail to unmarshal config file, exiting")
-		os.Exit(1)
+		return nil, err
 	}
-	// reportConf(res)
+	switch version {
+	case v1alpha1.APIVersion:
+		in := toV1alpha1(*c)
+		if err := decodeVersioned(root, &in, lines, refs); err != nil {
+			return nil, err
+		}
+		*c = fromV1alpha1(in)
+	case v1alpha2.APIVersion:
+		in := toV1alpha2(*c)
+		if err := decodeVersioned(root, &in, lines, refs); err != nil {
+			return nil, err
+		}
+		*c = fromV1alpha2(in)
+		// managedCluster is the number of clusters declared
+		if line, ok := lines["clusters"]; ok {
+			lines["managedCluster"] = line
+		}
+	}
+	c.SecretRefs = refs
+	return lines, nil
+}
+
+// detectAPIVersion reads apiVersion of config file, files without apiVersion are seen as v1alpha1
+func detectAPIVersion(root *yaml.Node) (string, error) {
+	if root.Kind != yaml.MappingNode {
+		return "", FieldErrors{{Field: "(root)", Line: root.Line, Detail: "expect a mapping"}}
+	}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value != "apiVersion" {
+			continue
+		}
+		value := root.Content[i+1]
+		if !contains(supportedAPIVersions, value.Value) {
+			return "", FieldErrors{{Field: "apiVersion", Line: value.Line,
+				Detail: fmt.Sprintf("unsupported apiVersion %q, expect one of %s", value.Value, strings.Join(supportedAPIVersions, ", "))}}
+		}
+		return value.Value, nil
+	}
+	return v1alpha1.APIVersion, nil
+}
 
-	return CompleteConfig(res), nil
+// decodeVersioned checks node against the type of out then decodes it, secret references are taken into refs
+func decodeVersioned(node *yaml.Node, out interface{}, lines fieldLines, refs secretRefs) error {
+	var errs FieldErrors
+	checkNode(node, reflect.TypeOf(out).Elem(), "", lines, refs, &errs)
+	if len(errs) != 0 {
+		sortFieldErrors(errs)
+		return errs
+	}
+	return node.Decode(out)
 }
 
-// CompleteConfig validate and complete the config
+// CompleteConfig complete the config, it should be validated before
 func CompleteConfig(origin Config) Config {
 	complete := origin
-	if origin.ManagedCluster < 1 {
+	if len(origin.Clusters) > origin.ManagedCluster {
+		complete.ManagedCluster = len(origin.Clusters)
+	}
+	if complete.ManagedCluster < 1 {
 		klog.Infof("Invalid configuration for managedCluster field: %d, set to 1", origin.ManagedCluster)
 		complete.ManagedCluster = 1
 	}
+	complete.Clusters = make([]Cluster, complete.ManagedCluster)
+	copy(complete.Clusters, origin.Clusters)
+	for ord := range complete.Clusters {
+		complete.Clusters[ord] = completeCluster(ord, complete.Clusters[ord])
+	}
+	complete.Releases = make([]Release, len(origin.Releases))
+	for i, r := range origin.Releases {
+		complete.Releases[i] = completeRelease(r)
+	}
 	return complete
 }
 
+// completeCluster fills the cluster settings left empty with defaults
+func completeCluster(ordinal int, c Cluster) Cluster {
+	if c.Name == "" {
+		c.Name = defaultClusterName(ordinal)
+	}
+	if c.Image == "" {
+		c.Image = DefaultK3sImage
+	}
+	if c.Servers < 1 {
+		c.Servers = 1
+	}
+	if c.APIPort == 0 {
+		c.APIPort = DefaultAPIPort + ordinal
+	}
+	return c
+}
+
+func defaultClusterName(ordinal int) string {
+	if isControlPlane(ordinal) {
+		return "mvela-cluster-control-plane"
+	}
+	return fmt.Sprintf("mvela-cluster-%d", ordinal)
+}
+
 func getKubeconfigOptions() config.SimpleConfigOptionsKubeconfig {
 	opts := config.SimpleConfigOptionsKubeconfig{
 		UpdateDefaultKubeconfig: true,
@@ -95,16 +327,53 @@ func getKubeconfigOptions() config.SimpleConfigOptionsKubeconfig {
 	return opts
 }
 
-func GetClusterRunConfig(cmdConfig Config) ([]config.ClusterConfig, error) {
+// kubeconfigPath is where kubeconfig of cluster is written
+func kubeconfigPath(cfg Config, cluster string) string {
+	return path.Join(cfg.KubeconfigOpts.Output, cluster)
+}
+
+// clusterOrdinal is the index of cluster in cfg, -1 if it's not declared
+func clusterOrdinal(cfg Config, cluster string) int {
+	for ord, c := range cfg.Clusters {
+		if c.Name == cluster {
+			return ord
+		}
+	}
+	return -1
+}
+
+// GetClusterRunConfig returns k3d configs of all clusters, nodeEnv is set in all nodes. Nodes are labeled with their
+// owner and hashes of settings.
+func GetClusterRunConfig(cmdConfig Config, nodeEnv []string) ([]config.ClusterConfig, error) {
 	managedCluster := cmdConfig.ManagedCluster
 	runConfigs := []config.ClusterConfig{}
+	hashKey, err := readHashKey()
+	if err != nil {
+		return nil, err
+	}
+	// the chart is hashed for the control plane, its version is resolved once
+	var chart interface{}
+	if managedCluster > 0 {
+		if chart, err = chartSettings(cmdConfig); err != nil {
+			klog.Warningf("Fail to resolve vela-core chart, it's not hashed: %v", err)
+		}
+	}
 	for ord := 0; ord < managedCluster; ord++ {
-		cluster, err := getClusterConfig(ord, cmdConfig.Storage, cmdConfig.Token)
+		cluster, err := getClusterConfig(ord, cmdConfig.Clusters[ord], cmdConfig.Storage, cmdConfig.Token)
 		if err != nil {
-			klog.ErrorS(err, "Fail to get cluster config")
-			return nil, err
+			return nil, fmt.Errorf("cluster %s: %w", cmdConfig.Clusters[ord].Name, err)
+		}
+		createOpts := getClusterCreateOpts(cmdConfig.Registries, cmdConfig.Clusters[ord].Labels, nodeEnv)
+		for k, v := range ownerLabels(cmdConfig) {
+			createOpts.GlobalLabels[k] = v
+		}
+		hashLabels, err := settingsHashLabels(cmdConfig, ord, hashKey, chart)
+		if err != nil {
+			return nil, fmt.Errorf("cluster %s: fail to hash settings: %w", cmdConfig.Clusters[ord].Name, err)
+		}
+		for k, v := range hashLabels {
+			createOpts.GlobalLabels[k] = v
 		}
-		createOpts := getClusterCreateOpts(cmdConfig.Registries)
 		kubeconfigOpts := getKubeconfigOptions()
 		runConfigs = append(runConfigs, config.ClusterConfig{
 			Cluster:           cluster,
@@ -115,23 +384,124 @@ func GetClusterRunConfig(cmdConfig Config) ([]config.ClusterConfig, error) {
 	return runConfigs, nil
 }
 
-func bindEnv(v *viper.Viper) error {
-	if err := v.BindEnv("storage::endpoint", "DATASTORE_ENDPOINT"); err != nil {
-		return err
+// envPrefix is the prefix of environment variables overriding config fields
+const envPrefix = "MVELA_"
+
+// envAliases are environment variables kept for compatibility, indexed by field path
+var envAliases = map[string][]string{
+	"storage.endpoint":  {"DATASTORE_ENDPOINT"},
+	"storage.ca_file":   {"DATASTORE_CAFILE"},
+	"storage.cert_file": {"DATASTORE_CERTFILE"},
+	"storage.key_file":  {"DATASTORE_KEYFILE"},
+	"token":             {"TOKEN"},
+}
+
+// envBinding binds a config field to environment variables, the first one set wins
+type envBinding struct {
+	Field string
+	Envs  []string
+	value reflect.Value
+}
+
+// envName derives environment variable name from field path, like MVELA_HELMOPTS_VERSION for helmOpts.version
+func envName(field string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(field, ".", "_"))
+}
+
+// bindEnv binds every field of c to environment variables. Fields of nested structs are bound one by one,
+// other fields like clusters are bound as a whole and their value is parsed as YAML.
+func bindEnv(v reflect.Value, path string) []envBinding {
+	var bindings []envBinding
+	for name, f := range yamlFields(v.Type()) {
+		field := joinPath(path, name)
+		if field == "apiVersion" {
+			// it's the version of config file only
+			continue
+		}
+		value := v.FieldByIndex(f.Index)
+		if value.Kind() == reflect.Struct {
+			bindings = append(bindings, bindEnv(value, field)...)
+			continue
+		}
+		bindings = append(bindings, envBinding{
+			Field: field,
+			Envs:  append([]string{envName(field)}, envAliases[field]...),
+			value: value,
+		})
 	}
-	if err := v.BindEnv("storage::ca_file", "DATASTORE_CAFILE"); err != nil {
-		return err
+	sort.Slice(bindings, func(i, j int) bool { return bindings[i].Field < bindings[j].Field })
+	return bindings
+}
+
+// applyEnv overrides config with environment variables, it returns the variables used indexed by field path
+func applyEnv(c *Config) (map[string]string, FieldErrors) {
+	envs := map[string]string{}
+	var errs FieldErrors
+	if c.SecretRefs == nil {
+		c.SecretRefs = secretRefs{}
 	}
-	if err := v.BindEnv("storage::key_file", "DATASTORE_KEYFILE"); err != nil {
+	for _, b := range bindEnv(reflect.ValueOf(c).Elem(), "") {
+		for _, env := range b.Envs {
+			value, ok := os.LookupEnv(env)
+			if !ok || value == "" {
+				continue
+			}
+			// references in file are overridden
+			for f := range c.SecretRefs {
+				if f == b.Field || strings.HasPrefix(f, b.Field+".") || strings.HasPrefix(f, b.Field+"[") {
+					delete(c.SecretRefs, f)
+				}
+			}
+			if err := setFromEnv(b.value, b.Field, value, c.SecretRefs); err != nil {
+				errs = append(errs, FieldError{Field: b.Field, Detail: fmt.Sprintf("invalid value of %s: %v", env, err)})
+			}
+			envs[b.Field] = env
+			break
+		}
+	}
+	return envs, errs
+}
+
+// setFromEnv sets field value from environment variable, non-string value is parsed as YAML. Secret references in
+// it are taken into refs.
+func setFromEnv(v reflect.Value, field string, value string, refs secretRefs) error {
+	if v.Kind() == reflect.String {
+		v.SetString(value)
+		return nil
+	}
+	node := yaml.Node{}
+	if err := yaml.Unmarshal([]byte(value), &node); err != nil {
 		return err
 	}
-	if err := v.BindEnv("token", "TOKEN"); err != nil {
+	if len(node.Content) == 0 {
+		return nil
+	}
+	var errs FieldErrors
+	checkNode(node.Content[0], v.Type(), field, fieldLines{}, refs, &errs)
+	if len(errs) != 0 {
+		return fmt.Errorf("%s: %s", errs[0].Field, errs[0].Detail)
+	}
+	for f, ref := range refs {
+		if strings.HasPrefix(f, field+".") || strings.HasPrefix(f, field+"[") {
+			// lines of environment variables mean nothing in config file
+			ref.line = 0
+			refs[f] = ref
+		}
+	}
+	out := reflect.New(v.Type())
+	if err := node.Content[0].Decode(out.Interface()); err != nil {
 		return err
 	}
+	v.Set(out.Elem())
 	return nil
 }
 
 func reportConf(c Config) {
 	klog.Info("Gonna use configuration")
-	klog.Info(c)
+	out, err := renderConfig(&loadedConfig{Config: c}, false, false)
+	if err != nil {
+		klog.ErrorS(err, "Fail to render config")
+		return
+	}
+	klog.Info(string(out))
 }
@@ -0,0 +1,311 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"mvela/pkg/apis/v1alpha2"
+
+	"github.com/kyokomi/emoji/v2"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+	"k8s.io/klog/v2"
+)
+
+// CmdConfig is for commands operating on the configuration file only, they never touch Docker
+func CmdConfig() *cobra.Command {
+	cmd := cobra.Command{
+		Use:   "config",
+		Short: "Manage mvela configuration file",
+		Long:  "Manage mvela configuration file",
+		// override root one, the config file may be invalid here
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			setupLogger()
+			return nil
+		},
+	}
+	cmd.AddCommand(
+		CmdConfigValidate(),
+		CmdConfigMigrate(),
+		CmdConfigExport(),
+		CmdConfigView(),
+		CmdConfigInit(),
+	)
+	return &cmd
+}
+
+func CmdConfigValidate() *cobra.Command {
+	cmd := cobra.Command{
+		Use:     "validate",
+		Short:   "Validate the configuration file",
+		Long:    "Validate the configuration file, report all problems with their line numbers",
+		Example: "mvela config validate -c conf.yaml",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			lc, err := loadConfig(flag.ConfigFile)
+			if err != nil {
+				return configError(err)
+			}
+			emoji.Fprintln(os.Stdout, ":white_check_mark: Config is valid")
+			if lc.Token == "" && lc.Generated["token"] != "" {
+				fmt.Printf("token: %s, kept in %s\n", tokenPending, lc.Generated["token"])
+			}
+			return nil
+		},
+	}
+	return &cmd
+}
+
+func CmdConfigMigrate() *cobra.Command {
+	var output string
+	cmd := cobra.Command{
+		Use:     "migrate",
+		Short:   "Rewrite a configuration file in the latest version",
+		Long:    "Rewrite a configuration file in the latest version, the original file is kept with .bak suffix",
+		Example: "mvela config migrate -c conf.yaml",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			file, err := requireConfigFile()
+			if err != nil {
+				return err
+			}
+			original, err := os.ReadFile(file)
+			if err != nil {
+				return configError(fmt.Errorf("fail to read config file: %w", err))
+			}
+			c := Config{}
+			if _, err = loadConfigFile(file, &c); err != nil {
+				return configError(err)
+			}
+			if c.ApiVersion == v1alpha2.APIVersion {
+				klog.Infof("%s is already %s, nothing to do", file, v1alpha2.APIVersion)
+				return nil
+			}
+			// secret references are kept as they are in the file, so don't use the decoded config
+			data, _, err := readConfigFile(file)
+			if err != nil {
+				return configError(err)
+			}
+			migrated, err := migrateV1alpha1(data, CompleteConfig(c).ManagedCluster)
+			if err != nil {
+				return configError(fmt.Errorf("fail to migrate config: %w", err))
+			}
+
+			if output == "" && isCUEFile(file) {
+				klog.Info("Won't overwrite CUE file with YAML, printing the result")
+				output = "-"
+			}
+			if output == "-" {
+				fmt.Print(string(migrated))
+				return nil
+			}
+			if output == "" {
+				output = file
+				if err = os.WriteFile(file+".bak", original, 0o600); err != nil {
+					return fmt.Errorf("fail to backup config file: %w", err)
+				}
+				klog.Infof("Original config file is saved to %s.bak", file)
+			}
+			if err = os.WriteFile(output, migrated, 0o600); err != nil {
+				return fmt.Errorf("fail to write migrated config file: %w", err)
+			}
+			emoji.Fprintf(os.Stdout, ":white_check_mark: Migrated %s to %s\n", file, v1alpha2.APIVersion)
+			return nil
+		},
+	}
+	cmd.Flags().StringVarP(&output, "output", "o", "", "file to write migrated config, default to overwrite the original one, - for stdout")
+	return &cmd
+}
+
+func CmdConfigExport() *cobra.Command {
+	var format string
+	cmd := cobra.Command{
+		Use:     "export",
+		Short:   "Print the evaluated configuration file",
+		Long:    "Print the evaluated configuration file, CUE file is evaluated and validated against the schema",
+		Example: "mvela config export -c conf.cue --format yaml > conf.yaml",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			file, err := requireConfigFile()
+			if err != nil {
+				return err
+			}
+			if _, err = loadConfigFile(file, &Config{}); err != nil {
+				return configError(err)
+			}
+			data, _, err := readConfigFile(file)
+			if err != nil {
+				return configError(err)
+			}
+			var out []byte
+			switch format {
+			case "yaml":
+				node := yaml.Node{}
+				if err = yaml.Unmarshal(data, &node); err == nil {
+					out, err = marshalConfig(resetStyle(&node), false)
+				}
+			case "json":
+				if isCUEFile(file) {
+					// CUE is exported as JSON already, keep the field order
+					buf := bytes.Buffer{}
+					err = json.Indent(&buf, data, "", "  ")
+					out = buf.Bytes()
+				} else {
+					var content interface{}
+					if err = yaml.Unmarshal(data, &content); err == nil {
+						out, err = json.MarshalIndent(content, "", "  ")
+					}
+				}
+				out = append(out, '\n')
+			default:
+				return withCode(ExitUsage, fmt.Errorf("unsupported format %s, expect yaml or json", format))
+			}
+			if err != nil {
+				return fmt.Errorf("fail to export config: %w", err)
+			}
+			fmt.Print(string(out))
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&format, "format", "yaml", "output format, yaml or json")
+	return &cmd
+}
+
+func CmdConfigView() *cobra.Command {
+	var showOrigin, reveal bool
+	cmd := cobra.Command{
+		Use:     "view",
+		Short:   "Print the effective configuration",
+		Long:    "Print the effective configuration merged from defaults, config file and environment variables",
+		Example: "mvela config view --show-origin",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			lc, err := loadConfig(flag.ConfigFile)
+			if err != nil {
+				return configError(err)
+			}
+			out, err := renderConfig(lc, showOrigin, reveal)
+			if err != nil {
+				return fmt.Errorf("fail to render config: %w", err)
+			}
+			fmt.Print(string(out))
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&showOrigin, "show-origin", false, "comment each field with where it comes from: default, file:line or env")
+	cmd.Flags().BoolVar(&reveal, "reveal", false, "print secrets like token and credentials in proxy URLs in plain text")
+	return &cmd
+}
+
+// migrateV1alpha1 rewrites v1alpha1 config file to v1alpha2, managedCluster is replaced with a list
+// of default clusters. Other fields and comments are kept.
+func migrateV1alpha1(data []byte, clusters int) ([]byte, error) {
+	doc := yaml.Node{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	root := resetStyle(doc.Content[0])
+
+	clusterList := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	for ord := 0; ord < clusters; ord++ {
+		clusterList.Content = append(clusterList.Content, &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Content: []*yaml.Node{
+			{Kind: yaml.ScalarNode, Tag: "!!str", Value: "name"},
+			{Kind: yaml.ScalarNode, Tag: "!!str", Value: defaultClusterName(ord)},
+		}})
+	}
+	apiVersion := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: v1alpha2.APIVersion}
+
+	var hasVersion, hasClusters bool
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		switch key := root.Content[i]; key.Value {
+		case "apiVersion":
+			apiVersion.LineComment = root.Content[i+1].LineComment
+			root.Content[i+1] = apiVersion
+			hasVersion = true
+		case "managedCluster":
+			key.Value = "clusters"
+			clusterList.HeadComment = root.Content[i+1].HeadComment
+			key.LineComment = root.Content[i+1].LineComment
+			root.Content[i+1] = clusterList
+			hasClusters = true
+		}
+	}
+	if !hasClusters {
+		root.Content = append([]*yaml.Node{{Kind: yaml.ScalarNode, Tag: "!!str", Value: "clusters"}, clusterList}, root.Content...)
+	}
+	if !hasVersion {
+		key := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "apiVersion"}
+		// keep the comment at the top of file
+		key.HeadComment, root.Content[0].HeadComment = root.Content[0].HeadComment, ""
+		root.Content = append([]*yaml.Node{key, apiVersion}, root.Content...)
+	}
+	return marshalConfig(&doc, false)
+}
+
+// requireConfigFile finds the config file to operate on, it's an error if there is none
+func requireConfigFile() (string, error) {
+	file, err := findConfigFile(flag.ConfigFile)
+	if err != nil {
+		return "", configError(fmt.Errorf("fail to find config file: %w", err))
+	}
+	if file == "" {
+		return "", configError(errors.New("config file is required, specify it by -c"))
+	}
+	return file, nil
+}
+
+// marshalConfig marshals a config file to YAML, empty fields are omitted to keep it short if prune
+func marshalConfig(c interface{}, prune bool) ([]byte, error) {
+	node, ok := c.(*yaml.Node)
+	if !ok {
+		node = &yaml.Node{}
+		if err := node.Encode(c); err != nil {
+			return nil, err
+		}
+	}
+	if prune {
+		pruneEmpty(node)
+	}
+	buf := bytes.Buffer{}
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(node); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// resetStyle resets node to block style, JSON data is parsed to flow style
+func resetStyle(node *yaml.Node) *yaml.Node {
+	node.Style = 0
+	for _, n := range node.Content {
+		resetStyle(n)
+	}
+	return node
+}
+
+// pruneEmpty removes fields with zero value from mapping nodes, it returns true if node itself is empty
+func pruneEmpty(node *yaml.Node) bool {
+	switch node.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, n := range node.Content {
+			pruneEmpty(n)
+		}
+		return node.Kind == yaml.SequenceNode && len(node.Content) == 0
+	case yaml.MappingNode:
+		content := node.Content[:0]
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if !pruneEmpty(node.Content[i+1]) {
+				content = append(content, node.Content[i], node.Content[i+1])
+			}
+		}
+		node.Content = content
+		return len(content) == 0
+	case yaml.ScalarNode:
+		return node.Tag == "!!null" || node.Value == "" || (node.Tag == "!!int" && node.Value == "0") ||
+			(node.Tag == "!!bool" && node.Value == "false")
+	}
+	return false
+}
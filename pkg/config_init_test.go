@@ -0,0 +1,160 @@
+package pkg
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestFindConfigFile(t *testing.T) {
+	old := velaDir
+	velaDir = t.TempDir()
+	defer func() { velaDir = old }()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	configHome := t.TempDir()
+	setEnv(t, "XDG_CONFIG_HOME", configHome)
+	setEnv(t, configFileEnv, "")
+
+	xdgFile := path.Join(configHome, configName, "mvela.yaml")
+	homeFile := path.Join(velaDir, "mvela.yaml")
+	for _, f := range []string{xdgFile, homeFile, ".mvela.yaml"} {
+		if err = os.MkdirAll(path.Dir(f), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// files are created from the last one searched, each one takes over the ones after it
+	steps := []struct {
+		create string
+		env    string
+		flag   string
+		want   string
+	}{
+		{want: ""},
+		{create: xdgFile, want: xdgFile},
+		{create: homeFile, want: homeFile},
+		{create: ".mvela.yaml", want: ".mvela.yaml"},
+		{env: "env.yaml", want: "env.yaml"},
+		{flag: "flag.yaml", want: "flag.yaml"},
+	}
+	for _, s := range steps {
+		if s.create != "" {
+			if err = os.WriteFile(s.create, nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if s.env != "" {
+			setEnv(t, configFileEnv, s.env)
+		}
+		if got, err := findConfigFile(s.flag); err != nil || got != s.want {
+			t.Errorf("expect %q, got %q, %v", s.want, got, err)
+		}
+	}
+}
+
+func TestInitConfigFile(t *testing.T) {
+	old := flag.ConfigFile
+	defer func() { flag.ConfigFile = old }()
+	setEnv(t, configFileEnv, "env.yaml")
+	flag.ConfigFile = "flag.yaml"
+	if got := initConfigFile(); got != "flag.yaml" {
+		t.Errorf("expect the -c flag first, got %s", got)
+	}
+	flag.ConfigFile = ""
+	if got := initConfigFile(); got != "env.yaml" {
+		t.Errorf("expect $%s then, got %s", configFileEnv, got)
+	}
+	setEnv(t, configFileEnv, "")
+	if got := initConfigFile(); got != path.Join(VelaDir(), "mvela.yaml") {
+		t.Errorf("expect the default file at last, got %s", got)
+	}
+}
+
+func TestPromptInit(t *testing.T) {
+	cases := []struct {
+		name     string
+		input    string
+		clusters int
+		endpoint string
+		token    string
+		mirrors  []string
+	}{
+		{name: "defaults", input: "\n\n\n", clusters: 1},
+		{name: "defaults at EOF", input: "", clusters: 0},
+		{
+			name:     "answers",
+			input:    "0\n3\nmysql://db\nsecret\nhttps://a, https://b\n",
+			clusters: 3,
+			endpoint: "mysql://db",
+			token:    "secret",
+			mirrors:  []string{"https://a", "https://b"},
+		},
+		{name: "last answer without newline", input: "2\n\nhttps://a", clusters: 2, mirrors: []string{"https://a"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			opts := initOptions{}
+			out := bytes.Buffer{}
+			clusters, err := promptInit(strings.NewReader(c.input), &out, &opts)
+			if c.clusters == 0 {
+				if err == nil {
+					t.Fatal("expect an error without answers")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if clusters != c.clusters || opts.StorageEndpoint != c.endpoint || opts.Token != c.token || !equalStrings(opts.Mirrors, c.mirrors) {
+				t.Errorf("expect %d cluster(s), %q, %q and %v, got %d, %q, %q and %v",
+					c.clusters, c.endpoint, c.token, c.mirrors, clusters, opts.StorageEndpoint, opts.Token, opts.Mirrors)
+			}
+		})
+	}
+}
+
+func TestInitTemplate(t *testing.T) {
+	cases := []struct {
+		name string
+		opts initOptions
+	}{
+		{name: "defaults", opts: initOptions{Clusters: []initCluster{{Name: "mvela-cluster-control-plane", APIPort: DefaultAPIPort}}}},
+		{
+			name: "answers",
+			opts: initOptions{
+				Clusters:        []initCluster{{Name: "mvela-cluster-control-plane", APIPort: DefaultAPIPort}, {Name: "mvela-cluster-1", APIPort: DefaultAPIPort + 1}},
+				Mirrors:         []string{"https://mirror"},
+				StorageEndpoint: "mysql://db",
+				Token:           "secret",
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			c.opts.APIVersion = "mvela.oam.dev/v1alpha2"
+			c.opts.K3sImage = DefaultK3sImage
+			c.opts.KubeconfigOutput = "/tmp/kube"
+			c.opts.Version = DefaultSemver
+			buf := bytes.Buffer{}
+			if err := initTemplate.Execute(&buf, c.opts); err != nil {
+				t.Fatal(err)
+			}
+			cfg := Config{}
+			if _, err := decodeConfig(buf.Bytes(), &cfg); err != nil {
+				t.Fatalf("expect a valid config file, got %v\n%s", err, buf.String())
+			}
+			if len(cfg.Clusters) != len(c.opts.Clusters) || cfg.Storage.Endpoint != c.opts.StorageEndpoint || cfg.Token != c.opts.Token {
+				t.Errorf("expect answers in config file, got %+v", cfg)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package pkg
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeConfig(t *testing.T) {
+	cases := []struct {
+		name string
+		data string
+		// errs are the expected messages of field errors, in order
+		errs []string
+	}{
+		{
+			name: "valid",
+			data: "kind: Simple\nmanagedCluster: 2\nstorage:\n  endpoint: mysql://db\n",
+		},
+		{
+			name: "empty",
+			data: "",
+		},
+		{
+			name: "unknown field",
+			data: "kind: Simple\nmanagedcluster: 2\n",
+			errs: []string{`line 2: managedcluster: unknown field, did you mean "managedCluster"?`},
+		},
+		{
+			name: "unknown nested field",
+			data: "kind: Simple\nstorage:\n  endpoint: mysql://db\n  password: x\n",
+			errs: []string{"line 4: storage.password: unknown field"},
+		},
+		{
+			name: "wrong types",
+			data: "managedCluster: two\nhelmOpts: chart\nkind: Simple\n",
+			errs: []string{
+				`line 1: managedCluster: expect a value of type int, got "two"`,
+				"line 2: helmOpts: expect a mapping",
+			},
+		},
+		{
+			name: "not a mapping",
+			data: "- kind\n",
+			errs: []string{"line 1: (root): expect a mapping"},
+		},
+		{
+			name: "unsupported apiVersion",
+			data: "apiVersion: mvela.oam.dev/v1\n",
+			errs: []string{"line 1: apiVersion: unsupported apiVersion"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := decodeConfig([]byte(c.data), &Config{})
+			if len(c.errs) == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			errs, ok := err.(FieldErrors)
+			if !ok {
+				t.Fatalf("expect FieldErrors, got %v", err)
+			}
+			if len(errs) != len(c.errs) {
+				t.Fatalf("expect %d error(s), got %v", len(c.errs), errs)
+			}
+			for i, want := range c.errs {
+				if got := errs[i].Error(); !strings.HasPrefix(got, want) {
+					t.Errorf("error %d: expect %q, got %q", i, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeConfigLines(t *testing.T) {
+	data := "kind: Simple\nstorage:\n  endpoint: mysql://db\n  ca_file: ca.pem\n"
+	c := Config{}
+	lines, err := decodeConfig([]byte(data), &c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Storage.CAFile != "ca.pem" {
+		t.Errorf("expect storage.ca_file decoded, got %q", c.Storage.CAFile)
+	}
+	for field, want := range map[string]int{"kind": 1, "storage": 3, "storage.ca_file": 4, "storage.cert_file": 3, "token": 0} {
+		if got := lines.lineOf(field); got != want {
+			t.Errorf("line of %s: expect %d, got %d", field, want, got)
+		}
+	}
+}
+
+// setEnv sets environment variable name during the test
+func setEnv(t *testing.T, name, value string) {
+	old, ok := os.LookupEnv(name)
+	if err := os.Setenv(name, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(name, old)
+		} else {
+			os.Unsetenv(name)
+		}
+	})
+}
+
+func TestEnvName(t *testing.T) {
+	for field, want := range map[string]string{
+		"token":             "MVELA_TOKEN",
+		"helmOpts.version":  "MVELA_HELMOPTS_VERSION",
+		"storage.ca_file":   "MVELA_STORAGE_CA_FILE",
+		"proxy.nodes.https": "MVELA_PROXY_NODES_HTTPS",
+	} {
+		if got := envName(field); got != want {
+			t.Errorf("env of %s: expect %s, got %s", field, want, got)
+		}
+	}
+}
+
+func TestBindEnv(t *testing.T) {
+	c := Config{}
+	bindings := map[string][]string{}
+	for _, b := range bindEnv(reflect.ValueOf(&c).Elem(), "") {
+		bindings[b.Field] = b.Envs
+	}
+	for field, want := range map[string][]string{
+		"managedCluster":   {"MVELA_MANAGEDCLUSTER"},
+		"clusters":         {"MVELA_CLUSTERS"},
+		"helmOpts.version": {"MVELA_HELMOPTS_VERSION"},
+		"storage.endpoint": {"MVELA_STORAGE_ENDPOINT", "DATASTORE_ENDPOINT"},
+		"token":            {"MVELA_TOKEN", "TOKEN"},
+	} {
+		if got := bindings[field]; !equalStrings(got, want) {
+			t.Errorf("envs of %s: expect %v, got %v", field, want, got)
+		}
+	}
+	for _, field := range []string{"apiVersion", "helmOpts", "storage"} {
+		if _, ok := bindings[field]; ok {
+			t.Errorf("expect %s not bound", field)
+		}
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	setEnv(t, "MVELA_HELMOPTS_VERSION", "1.2.3")
+	setEnv(t, "MVELA_MANAGEDCLUSTER", "3")
+	setEnv(t, "MVELA_CLUSTERS", "[{name: hub, agents: 2}]")
+	setEnv(t, "DATASTORE_ENDPOINT", "mysql://alias")
+	setEnv(t, "MVELA_TOKEN", "")
+	setEnv(t, "TOKEN", "from-alias")
+
+	c := Config{HelmOpts: HelmOpts{Version: "1.0.0"}, Storage: Storage{Endpoint: "mysql://file"}}
+	envs, errs := applyEnv(&c)
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if c.HelmOpts.Version != "1.2.3" || c.ManagedCluster != 3 || c.Storage.Endpoint != "mysql://alias" || c.Token != "from-alias" {
+		t.Errorf("fields not overridden: %+v", c)
+	}
+	if len(c.Clusters) != 1 || c.Clusters[0].Name != "hub" || c.Clusters[0].Agents != 2 {
+		t.Errorf("expect clusters parsed from YAML, got %+v", c.Clusters)
+	}
+	for field, want := range map[string]string{"helmOpts.version": "MVELA_HELMOPTS_VERSION", "storage.endpoint": "DATASTORE_ENDPOINT", "token": "TOKEN"} {
+		if envs[field] != want {
+			t.Errorf("env of %s: expect %s, got %q", field, want, envs[field])
+		}
+	}
+}
+
+func TestApplyEnvInvalid(t *testing.T) {
+	setEnv(t, "MVELA_MANAGEDCLUSTER", "many")
+	setEnv(t, "MVELA_CLUSTERS", "[{nmae: hub}]")
+	_, errs := applyEnv(&Config{})
+	if got := fieldsOf(errs); !equalStrings(got, []string{"clusters", "managedCluster"}) {
+		t.Errorf("expect errors of clusters and managedCluster, got %v", errs)
+	}
+}
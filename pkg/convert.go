@@ -0,0 +1,72 @@
+package pkg
+
+import (
+	"mvela/pkg/apis/v1alpha1"
+	"mvela/pkg/apis/v1alpha2"
+)
+
+// supportedAPIVersions are config file versions can be read, the last one is the current version
+var supportedAPIVersions = []string{v1alpha1.APIVersion, v1alpha2.APIVersion}
+
+func fromV1alpha1(in v1alpha1.Config) Config {
+	return Config{
+		ApiVersion:     in.ApiVersion,
+		Kind:           in.Kind,
+		ManagedCluster: in.ManagedCluster,
+		KubeconfigOpts: in.KubeconfigOpts,
+		HelmOpts:       HelmOpts{Type: in.HelmOpts.Type, ChartPath: in.HelmOpts.ChartPath, Version: in.HelmOpts.Version},
+		Registries:     in.Registries,
+		Storage:        in.Storage,
+		Token:          in.Token,
+	}
+}
+
+// toV1alpha1 converts config to v1alpha1, fields added since then are dropped
+func toV1alpha1(c Config) v1alpha1.Config {
+	return v1alpha1.Config{
+		ApiVersion:     v1alpha1.APIVersion,
+		Kind:           c.Kind,
+		ManagedCluster: c.ManagedCluster,
+		KubeconfigOpts: c.KubeconfigOpts,
+		HelmOpts:       v1alpha1.HelmOpts{Type: c.HelmOpts.Type, ChartPath: c.HelmOpts.ChartPath, Version: c.HelmOpts.Version},
+		Registries:     c.Registries,
+		Storage:        c.Storage,
+		Token:          c.Token,
+	}
+}
+
+func fromV1alpha2(in v1alpha2.Config) Config {
+	return Config{
+		ApiVersion:     in.ApiVersion,
+		Kind:           in.Kind,
+		ManagedCluster: len(in.Clusters),
+		Clusters:       in.Clusters,
+		KubeconfigOpts: in.KubeconfigOpts,
+		HelmOpts:       in.HelmOpts,
+		Registries:     in.Registries,
+		Storage:        in.Storage,
+		Token:          in.Token,
+		Proxy:          in.Proxy,
+		Releases:       in.Releases,
+	}
+}
+
+// toV1alpha2 converts config to v1alpha2, clusters not declared are filled with empty item
+func toV1alpha2(c Config) v1alpha2.Config {
+	clusters := append([]Cluster{}, c.Clusters...)
+	for len(clusters) < c.ManagedCluster {
+		clusters = append(clusters, Cluster{})
+	}
+	return v1alpha2.Config{
+		ApiVersion:     v1alpha2.APIVersion,
+		Kind:           c.Kind,
+		Clusters:       clusters,
+		KubeconfigOpts: c.KubeconfigOpts,
+		HelmOpts:       c.HelmOpts,
+		Registries:     c.Registries,
+		Storage:        c.Storage,
+		Token:          c.Token,
+		Proxy:          c.Proxy,
+		Releases:       c.Releases,
+	}
+}
@@ -0,0 +1,91 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+
+	"mvela/pkg/apis/v1alpha1"
+	"mvela/pkg/apis/v1alpha2"
+)
+
+func TestConvertV1alpha1(t *testing.T) {
+	in := v1alpha1.Config{
+		ApiVersion:     v1alpha1.APIVersion,
+		Kind:           KindSimple,
+		ManagedCluster: 3,
+		KubeconfigOpts: KubeconfigOption{Output: "/tmp/kube"},
+		HelmOpts:       v1alpha1.HelmOpts{Type: ChartSourceURL, ChartPath: "https://charts/vela-core.tgz", Version: "1.2.3"},
+		Storage:        Storage{Endpoint: "mysql://db"},
+		Token:          "secret",
+	}
+	c := fromV1alpha1(in)
+	if c.ManagedCluster != 3 || len(c.Clusters) != 0 {
+		t.Errorf("expect 3 managed clusters and none declared, got %d and %v", c.ManagedCluster, c.Clusters)
+	}
+	if c.HelmOpts.ChartPath != in.HelmOpts.ChartPath || c.HelmOpts.Version != "1.2.3" || c.Token != "secret" {
+		t.Errorf("fields are lost in conversion: %+v", c)
+	}
+	if out := toV1alpha1(c); !reflect.DeepEqual(out, in) {
+		t.Errorf("expect %+v after round trip, got %+v", in, out)
+	}
+}
+
+func TestConvertV1alpha2(t *testing.T) {
+	c := Config{
+		ApiVersion:     v1alpha2.APIVersion,
+		Kind:           KindSimple,
+		ManagedCluster: 3,
+		Clusters:       []Cluster{{Name: "hub", Agents: 2}},
+		HelmOpts:       HelmOpts{Set: []string{"replicaCount=2"}},
+	}
+	out := toV1alpha2(c)
+	if len(out.Clusters) != 3 || out.Clusters[0].Name != "hub" || out.Clusters[2].Name != "" {
+		t.Fatalf("expect declared cluster followed by 2 empty ones, got %+v", out.Clusters)
+	}
+	back := fromV1alpha2(out)
+	if back.ManagedCluster != 3 || len(back.Clusters) != 3 {
+		t.Errorf("expect 3 managed clusters, got %d and %d declared", back.ManagedCluster, len(back.Clusters))
+	}
+	if !reflect.DeepEqual(back.HelmOpts, c.HelmOpts) {
+		t.Errorf("expect helmOpts %+v, got %+v", c.HelmOpts, back.HelmOpts)
+	}
+}
+
+func TestDecodeConfigVersions(t *testing.T) {
+	cases := []struct {
+		name     string
+		data     string
+		clusters int
+		declared int
+		fail     bool
+	}{
+		{name: "no apiVersion is v1alpha1", data: "kind: Simple\nmanagedCluster: 2\n", clusters: 2},
+		{name: "v1alpha1", data: "apiVersion: mvela.oam.dev/v1alpha1\nmanagedCluster: 2\n", clusters: 2},
+		{name: "clusters not in v1alpha1", data: "apiVersion: mvela.oam.dev/v1alpha1\nclusters: []\n", fail: true},
+		{
+			name:     "v1alpha2",
+			data:     "apiVersion: mvela.oam.dev/v1alpha2\nclusters:\n- name: hub\n- agents: 1\n",
+			clusters: 2,
+			declared: 2,
+		},
+		{name: "managedCluster not in v1alpha2", data: "apiVersion: mvela.oam.dev/v1alpha2\nmanagedCluster: 2\n", fail: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := Config{}
+			_, err := decodeConfig([]byte(c.data), &cfg)
+			if c.fail {
+				if err == nil {
+					t.Fatal("expect an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if cfg.ManagedCluster != c.clusters || len(cfg.Clusters) != c.declared {
+				t.Errorf("expect %d clusters with %d declared, got %d with %d", c.clusters, c.declared, cfg.ManagedCluster, len(cfg.Clusters))
+			}
+		})
+	}
+}
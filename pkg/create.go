@@ -3,10 +3,13 @@ package pkg
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"path"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/client"
@@ -16,128 +19,310 @@ import (
 	"github.com/rancher/k3d/v5/pkg/runtimes"
 	k3dTypes "github.com/rancher/k3d/v5/pkg/types"
 	"github.com/spf13/cobra"
+	"helm.sh/helm/v3/pkg/cli"
 	"k8s.io/klog/v2"
 )
 
 var (
-	DefaultConfigFile    = "./example/conf.yaml"
-	dockerCli            client.APIClient
+	dockerCli client.APIClient
+	// dockerCliErr is why dockerCli can't be created, it's reported by checkDocker
+	dockerCliErr         error
 	controlPlaneKubeConf string
 )
 
 func init() {
-	var err error
-	dockerCli, err = client.NewClientWithOpts(client.FromEnv)
-	if err != nil {
-		panic(err)
-	}
+	dockerCli, dockerCliErr = client.NewClientWithOpts(client.FromEnv)
 }
 
 func CmdCreate(cmdConfig *Config) *cobra.Command {
+	var valuesFiles, set []string
+	var timeout time.Duration
+	var parallel int
+	var keepOnFailure bool
 	cmd := cobra.Command{
-		Use:   "create",
-		Short: "Create a all-in-one vela environment",
-		Long:  "Create a all-in-one vela image and run it",
-		Run: func(cmd *cobra.Command, args []string) {
+		Use:     "create",
+		Short:   "Create a all-in-one vela environment",
+		Long:    "Create a all-in-one vela image and run it",
+		Example: "mvela create --set replicaCount=2 -f vela-values.yaml",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// flags are applied after the config file, like helm
+			cmdConfig.HelmOpts.ValuesFiles = append(cmdConfig.HelmOpts.ValuesFiles, valuesFiles...)
+			cmdConfig.HelmOpts.Set = append(cmdConfig.HelmOpts.Set, set...)
+			// fail before creating clusters
+			if _, err := chartValues(cmdConfig.HelmOpts, chartGetters(cli.New(), chartHTTPClient(cmdConfig.Proxy), downloadTimeout(cmdConfig.HelmOpts))); err != nil {
+				return configError(fmt.Errorf("invalid vela-core chart values: %w", err))
+			}
+			if err := checkDocker(cmd.Context()); err != nil {
+				return err
+			}
+			if err := resolveSecrets(cmdConfig); err != nil {
+				return configError(err)
+			}
+			if err := ensureToken(cmdConfig); err != nil {
+				return err
+			}
+			if err := ensureHashKey(); err != nil {
+				return err
+			}
+
+			// steps changing anything are recorded, they are undone if create fails
+			tx := &createTransaction{}
+			// clusters share the docker network, create it before k3d does it concurrently
+			if err := ensureK3dNetwork(cmd.Context(), tx); err != nil {
+				return abortCreate(tx, keepOnFailure, clusterError(fmt.Errorf("fail to create docker network: %w", err)))
+			}
+
+			nodeEnv, err := nodeProxyEnv(cmd.Context(), cmdConfig.Proxy.Nodes)
+			if err != nil {
+				return abortCreate(tx, keepOnFailure, fmt.Errorf("fail to set proxy of nodes: %w", err))
+			}
+
 			// create k3d
-			runConfigs, err := GetClusterRunConfig(*cmdConfig)
+			runConfigs, err := GetClusterRunConfig(*cmdConfig, nodeEnv)
 			if err != nil {
-				klog.ErrorS(err, "Fail to get cluster-run configs")
+				return abortCreate(tx, keepOnFailure, configError(fmt.Errorf("fail to get cluster-run configs: %w", err)))
 			}
 
 			// Check cluster existence and create all cluster based on flag
 			klog.Infof("Making sure directory exists %s\n", cmdConfig.KubeconfigOpts.Output)
 			err = os.MkdirAll(cmdConfig.KubeconfigOpts.Output, 0o755)
 			if err != nil {
-				klog.ErrorS(err, "Fail to create directory to save kubeconfig")
+				return abortCreate(tx, keepOnFailure, fmt.Errorf("fail to create directory to save kubeconfig: %w", err))
 			}
 
-			// check cluster existence
-			for ord, r := range runConfigs {
-				klog.Infof("Creating Cluster No.%d: %s", ord, r.Cluster.Name)
-				RunClusterIfNotExist(cmd.Context(), r)
-				// kubeconfig
-				KubeConfigOutput := path.Join(cmdConfig.KubeconfigOpts.Output, r.Cluster.Name)
-				WriteKubeConfig(cmd.Context(), KubeConfigOutput, r.Cluster)
-
-				// Update KUBECONFIG if control plane
-				if isControlPlane(ord) {
-					klog.Info("Setting KUBECONFIG to " + KubeConfigOutput)
-					err = os.Setenv("KUBECONFIG", KubeConfigOutput)
-					if err != nil {
-						klog.ErrorS(err, "Fail to set environment var KUBECONFIG")
-					}
-
-					controlPlaneKubeConf = KubeConfigOutput
-					// install helm chart
-					err = InstallVelaCore(cmdConfig.HelmOpts)
-					if err != nil {
-						klog.ErrorS(err, "Fail to Install helm chart, you can install manually later")
-					} else {
-						klog.Info("Successfully installed vela-core helm chart")
-					}
-				}
+			errs, velaCoreErr := CreateClusters(cmd.Context(), *cmdConfig, runConfigs, parallel, tx)
+			if len(errs) > 0 {
+				printClusterErrors(os.Stdout, *cmdConfig, errs)
+				return abortCreate(tx, keepOnFailure, clusterErrors(*cmdConfig, errs))
+			}
+
+			// clusters are complete, the environment is kept from here on
+			var releaseErrs []error
+			if velaCoreErr != nil {
+				releaseErrs = append(releaseErrs, velaCoreErr)
+			}
+			releaseErrs = append(releaseErrs, InstallReleases(*cmdConfig)...)
+			var readyErr error
+			// vela-core can't be ready if it's not installed
+			if timeout > 0 && velaCoreErr == nil {
+				readyErr = WaitClustersReady(cmd.Context(), *cmdConfig, timeout, os.Stdout)
+			}
+			if err = createFailure(os.Stdout, releaseErrs, readyErr); err != nil {
+				return err
 			}
 
 			// feedback
 			printGuide(*cmdConfig)
+			return nil
 		},
 	}
+	cmd.Flags().StringSliceVarP(&valuesFiles, "values", "f", nil, "specify vela-core chart values in a YAML file, can be repeated")
+	cmd.Flags().StringArrayVar(&set, "set", nil, "set vela-core chart values on the command line, can be repeated (e.g. --set replicaCount=2)")
+	cmd.Flags().DurationVar(&timeout, "timeout", defaultReadyTimeout, "time to wait for nodes, KubeVela CRDs and vela-core controllers to be ready, 0 to skip")
+	cmd.Flags().IntVar(&parallel, "parallel", defaultParallel, "number of clusters created at the same time")
+	cmd.Flags().BoolVar(&keepOnFailure, "keep-on-failure", false, "keep the docker network, clusters and kubeconfigs created if a cluster fails to create. "+
+		"They're kept anyway if only vela-core, releases or readiness fail")
 	return &cmd
 }
 
+// defaultParallel is the number of clusters created at the same time by default
+const defaultParallel = 3
+
 func isControlPlane(ord int) bool {
 	return ord == 0
 }
 
-func RunClusterIfNotExist(ctx context.Context, cluster config.ClusterConfig) {
+// abortCreate undoes steps in tx unless keep, err failed create is returned. It's for clusters failed to create,
+// see createFailure for the failures after that.
+func abortCreate(tx *createTransaction, keep bool, err error) error {
+	if keep {
+		printKept(os.Stdout, tx.names())
+	} else {
+		undone, errs := tx.rollback(context.Background())
+		printRollback(os.Stdout, undone, errs)
+	}
+	return err
+}
+
+// createFailure reports releases failed to install and the readiness error after clusters are created, the error of
+// create is returned if any. The environment is kept for debugging and retrying.
+func createFailure(w io.Writer, releaseErrs []error, readyErr error) error {
+	if len(releaseErrs) == 0 && readyErr == nil {
+		return nil
+	}
+	if len(releaseErrs) > 0 {
+		printReleaseErrors(w, releaseErrs)
+	}
+	emoji.Fprintln(w, ":pushpin: Clusters and kubeconfigs are kept, run `mvela create` again to retry, or `mvela delete` to clean up")
+	if readyErr != nil {
+		return fmt.Errorf("KubeVela is not ready: %w", readyErr)
+	}
+	return releaseErrors(releaseErrs, "create")
+}
+
+// CreateClusters creates clusters of runConfigs and installs vela-core into the control plane, at most parallel
+// clusters at a time. runConfigs can be part of the clusters in cfg. Clusters are started in order, so the control
+// plane is installed while sub-clusters are created. Changes of clusters are recorded in tx, errors of clusters are
+// returned by cluster name, along with the error of vela-core.
+func CreateClusters(ctx context.Context, cfg Config, runConfigs []config.ClusterConfig, parallel int, tx *createTransaction) (map[string]error, error) {
+	var names []string
+	byName := map[string]config.ClusterConfig{}
+	for _, r := range runConfigs {
+		names = append(names, r.Cluster.Name)
+		byName[r.Cluster.Name] = r
+	}
+	// logs are shown after the progress
+	logs := captureLogs()
+	progress := newClusterProgress(names)
+	var velaCoreErr error
+	errs := runParallel(names, parallel, func(name string) error {
+		ord := clusterOrdinal(cfg, name)
+		err := createCluster(ctx, cfg, ord, byName[name], progress, tx)
+		if err != nil || !isControlPlane(ord) {
+			progress.finish(name, err)
+			return err
+		}
+		progress.update(name, "installing vela-core")
+		if velaCoreErr = InstallVelaCore(kubeconfigPath(cfg, name), cfg.HelmOpts, cfg.Proxy); velaCoreErr != nil {
+			velaCoreErr = fmt.Errorf("vela-core in cluster %s: %w", name, velaCoreErr)
+		} else {
+			klog.Info("Successfully installed vela-core helm chart")
+			// vela-core may be upgraded in an existing control plane, whose labels have the chart it's created with
+			if err = recordChartHash(ctx, cfg); err != nil {
+				klog.Warningf("Fail to record hash of vela-core chart: %v", err)
+			}
+		}
+		progress.finish(name, velaCoreErr)
+		return nil
+	})
+	progress.close()
+	logs.restore()
+	return errs, velaCoreErr
+}
+
+// runParallel runs fn with each of names, at most parallel at a time, they're started in order. Errors are returned
+// by name.
+func runParallel(names []string, parallel int, fn func(name string) error) map[string]error {
+	if parallel < 1 {
+		parallel = 1
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	errs := map[string]error{}
+	sem := make(chan struct{}, parallel)
+	for _, name := range names {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(name string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := fn(name); err != nil {
+				mu.Lock()
+				errs[name] = err
+				mu.Unlock()
+			}
+		}(name)
+	}
+	wg.Wait()
+	return errs
+}
+
+// createCluster creates a cluster if not exist and writes its kubeconfig and the internal one for joining it
+func createCluster(ctx context.Context, cfg Config, ord int, r config.ClusterConfig, progress *clusterProgress, tx *createTransaction) error {
+	name := r.Cluster.Name
+	progress.update(name, "creating cluster")
+	recordCluster(ctx, tx, &r.Cluster)
+	if err := RunClusterIfNotExist(ctx, r); err != nil {
+		return clusterError(err)
+	}
+	progress.update(name, "writing kubeconfig")
+	kubeconfig := kubeconfigPath(cfg, name)
+	if err := recordFile(tx, "kubeconfig", kubeconfig); err != nil {
+		return clusterError(err)
+	}
+	if !isControlPlane(ord) {
+		if err := recordFile(tx, "join kubeconfig", kubeconfig+"-internal"); err != nil {
+			return clusterError(err)
+		}
+	}
+	if err := WriteKubeConfig(ctx, kubeconfig, r.Cluster, isControlPlane(ord)); err != nil {
+		return clusterError(err)
+	}
+	if isControlPlane(ord) {
+		controlPlaneKubeConf = kubeconfig
+	}
+	return nil
+}
+
+// printClusterErrors reports clusters failed to create in the order of config
+func printClusterErrors(w io.Writer, cfg Config, errs map[string]error) {
+	emoji.Fprintf(w, ":x: %d of %d cluster(s) failed, run `mvela create` again to retry\n", len(errs), len(cfg.Clusters))
+	for _, c := range cfg.Clusters {
+		if err, ok := errs[c.Name]; ok {
+			fmt.Fprintf(w, "  %s: %v\n", c.Name, err)
+		}
+	}
+}
+
+// clusterErrors is the error of clusters failed to create, with the exit code of the first failed one in config
+func clusterErrors(cfg Config, errs map[string]error) error {
+	for _, c := range cfg.Clusters {
+		if err, ok := errs[c.Name]; ok {
+			return withCode(exitCodeOf(err), fmt.Errorf("%d of %d cluster(s) failed, first %s: %w", len(errs), len(cfg.Clusters), c.Name, err))
+		}
+	}
+	return nil
+}
+
+func RunClusterIfNotExist(ctx context.Context, cluster config.ClusterConfig) error {
 	if _, err := k3dClient.ClusterGet(ctx, runtimes.SelectedRuntime, &cluster.Cluster); err == nil {
 		klog.Infof("Detect an existing cluster: %s", cluster.Cluster.Name)
-		return
+		return nil
 	}
 	err := k3dClient.ClusterRun(ctx, runtimes.SelectedRuntime, &cluster)
 	if err != nil {
-		klog.ErrorS(err, "Fail to create cluster", "cluster-name", cluster.Cluster.Name)
-		return
+		return fmt.Errorf("fail to create cluster: %w", err)
 	}
 	klog.Infof("Successfully create cluster: %s", cluster.Cluster.Name)
+	return nil
 }
 
 // WriteKubeConfig write kubeconfig to output.
 // There are two kinds of kubeconfig:
-// mvela-cluster-n for accessing cluster from host. mvela-cluster-n-internal for accessing between clusters
-func WriteKubeConfig(ctx context.Context, output string, cluster k3dTypes.Cluster) {
+// mvela-cluster-n for accessing cluster from host. mvela-cluster-n-internal for accessing between clusters, control plane doesn't need it
+func WriteKubeConfig(ctx context.Context, output string, cluster k3dTypes.Cluster, controlPlane bool) error {
 	_, err := os.Stat(output)
 	if err == nil {
 		klog.Infof("Overwriting the mvela kubeconfig at %s", output)
 	}
 	kubeconfigOpt := k3dClient.WriteKubeConfigOptions{UpdateExisting: false, OverwriteExisting: true, UpdateCurrentContext: false}
-	if _, err = k3dClient.KubeconfigGetWrite(ctx, runtimes.SelectedRuntime, &cluster, output, &kubeconfigOpt); err == nil {
-		klog.Info("Successfully generate kubeconfig file at ", output)
-	} else {
-		klog.ErrorS(err, "Fail to write kubeconfig")
+	if _, err = k3dClient.KubeconfigGetWrite(ctx, runtimes.SelectedRuntime, &cluster, output, &kubeconfigOpt); err != nil {
+		return fmt.Errorf("fail to write kubeconfig: %w", err)
 	}
+	klog.Info("Successfully generate kubeconfig file at ", output)
 
-	if !strings.Contains(cluster.Name, "control-plane") {
+	if !controlPlane {
 		err = generateInternal(ctx, output, cluster.Name)
 		if err != nil {
-			klog.Error("Fail to write internal kubeconfig, unable to use vela join now")
+			return fmt.Errorf("fail to write internal kubeconfig, unable to use vela join now: %w", err)
 		}
 	}
+	return nil
 }
 
 func generateInternal(ctx context.Context, kubeconfigFile string, clusterName string) error {
 	klog.Info("Generating kubeconfig files for inter-cluster accessibility")
 	fb, err := os.ReadFile(kubeconfigFile)
 	if err != nil {
-		klog.ErrorS(err, "Fail to read kubeconfig file")
+		return err
 	}
 	// find cluster name
 
 	networks, err := dockerCli.NetworkInspect(ctx, "k3d-mvela", types.NetworkInspectOptions{})
 	if err != nil {
-		klog.ErrorS(err, "Fail to inspect docker network")
-		return err
+		return fmt.Errorf("fail to inspect docker network: %w", err)
 	}
 	var containerIP string
 	cs := networks.Containers
@@ -147,12 +332,11 @@ func generateInternal(ctx context.Context, kubeconfigFile string, clusterName st
 		}
 	}
 	kubeConfig := string(fb)
-	re := regexp.MustCompile(`0.0.0.0:\d{4}`)
+	re := regexp.MustCompile(`0.0.0.0:\d+`)
 	internalKubeConfig := re.ReplaceAllString(kubeConfig, fmt.Sprintf("%s:6443", containerIP))
 
 	err = os.WriteFile(fmt.Sprintf("%s-internal", kubeconfigFile), []byte(internalKubeConfig), 0o600)
 	if err != nil {
-		klog.ErrorS(err, "Fail to write internal kubeconfig", "cluster", clusterName)
 		return err
 	}
 	return nil
@@ -164,8 +348,8 @@ func printGuide(cfg Config) {
 	emoji.Fprintf(os.Stdout, ":pushpin: First run `export KUBECONFIG=%s` to connect to cluster\n", controlPlaneKubeConf)
 	emoji.Fprintf(os.Stdout, ":telescope: Second run `vela components` to see usable components,\n")
 	if cfg.ManagedCluster > 1 {
-		internalCfg := path.Join(cfg.KubeconfigOpts.Output, "mvela-cluster-1-internal")
-		subCfg := path.Join(cfg.KubeconfigOpts.Output, "mvela-cluster-1")
+		internalCfg := path.Join(cfg.KubeconfigOpts.Output, cfg.Clusters[1].Name+"-internal")
+		subCfg := path.Join(cfg.KubeconfigOpts.Output, cfg.Clusters[1].Name)
 		emoji.Fprintf(os.Stdout, ":link: Join sub-clusters, run `vela cluster join %s`, or more with other number\n", internalCfg)
 		emoji.Fprintf(os.Stdout, ":key: Check sub-clusters, run `KUBECONFIG=%s kubectl get pod -A`, or more with other number\n", subCfg)
 	}
@@ -0,0 +1,133 @@
+package pkg
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunParallel(t *testing.T) {
+	names := []string{"hub", "edge-1", "edge-2", "edge-3", "edge-4"}
+	cases := []struct {
+		name     string
+		parallel int
+		max      int32
+	}{
+		{name: "one at a time", parallel: 0, max: 1},
+		{name: "bounded", parallel: 2, max: 2},
+		{name: "all at once", parallel: 10, max: 5},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var running, max int32
+			var mu sync.Mutex
+			var started []string
+			errs := runParallel(names, c.parallel, func(name string) error {
+				mu.Lock()
+				started = append(started, name)
+				mu.Unlock()
+				n := atomic.AddInt32(&running, 1)
+				defer atomic.AddInt32(&running, -1)
+				for {
+					m := atomic.LoadInt32(&max)
+					if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+						break
+					}
+				}
+				time.Sleep(20 * time.Millisecond)
+				if strings.HasSuffix(name, "-2") || strings.HasSuffix(name, "-4") {
+					return errors.New("fail to create " + name)
+				}
+				return nil
+			})
+			if max != c.max {
+				t.Errorf("expect at most %d running, got %d", c.max, max)
+			}
+			if c.max == 1 && !equalStrings(started, names) {
+				t.Errorf("expect started in order, got %v", started)
+			}
+			if len(errs) != 2 || errs["edge-2"] == nil || errs["edge-4"] == nil {
+				t.Errorf("expect errors of every failed one, got %v", errs)
+			}
+		})
+	}
+}
+
+func TestClusterErrors(t *testing.T) {
+	cfg := Config{Clusters: []Cluster{{Name: "hub"}, {Name: "edge-1"}, {Name: "edge-2"}}}
+	if err := clusterErrors(cfg, map[string]error{}); err != nil {
+		t.Errorf("expect no error, got %v", err)
+	}
+	errs := map[string]error{
+		"edge-2": timeoutError(errors.New("not ready")),
+		"edge-1": clusterError(errors.New("port is taken")),
+	}
+	err := clusterErrors(cfg, errs)
+	if err == nil || err.Error() != "2 of 3 cluster(s) failed, first edge-1: port is taken" {
+		t.Errorf("expect the first failed one in config, got %v", err)
+	}
+	if code := exitCodeOf(err); code != ExitCluster {
+		t.Errorf("expect exit code of the first failed one, got %d", code)
+	}
+
+	buf := bytes.Buffer{}
+	printClusterErrors(&buf, cfg, errs)
+	got := buf.String()
+	first, second := strings.Index(got, "edge-1: port is taken"), strings.Index(got, "edge-2: not ready")
+	if !strings.Contains(got, "2 of 3 cluster(s) failed") || first < 0 || second < first {
+		t.Errorf("expect failed clusters printed in order of config, got %q", got)
+	}
+}
+
+func TestCreateFailure(t *testing.T) {
+	releaseErr := chartError(errors.New("release default/a in cluster hub: not found"))
+	cases := []struct {
+		name        string
+		releaseErrs []error
+		readyErr    error
+		want        string
+		code        ExitCode
+		printed     []string
+	}{
+		{name: "succeeded"},
+		{
+			name:        "release failed",
+			releaseErrs: []error{releaseErr},
+			want:        "1 release(s) failed to install, run `mvela create` again to retry, first: release default/a in cluster hub: not found",
+			code:        ExitChart,
+			printed:     []string{"1 release(s) failed to install", "Clusters and kubeconfigs are kept"},
+		},
+		{
+			name:        "not ready",
+			releaseErrs: []error{releaseErr},
+			readyErr:    timeoutError(errors.New("2 problem(s) remain after waiting 5m0s")),
+			want:        "KubeVela is not ready: 2 problem(s) remain after waiting 5m0s",
+			code:        ExitTimeout,
+			printed:     []string{"1 release(s) failed to install", "Clusters and kubeconfigs are kept"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			buf := bytes.Buffer{}
+			err := createFailure(&buf, c.releaseErrs, c.readyErr)
+			if c.want == "" {
+				if err != nil || buf.Len() != 0 {
+					t.Fatalf("expect nothing reported, got %v, %q", err, buf.String())
+				}
+				return
+			}
+			if err == nil || err.Error() != c.want || exitCodeOf(err) != c.code {
+				t.Errorf("expect %q with exit code %d, got %v with %d", c.want, c.code, err, exitCodeOf(err))
+			}
+			for _, p := range c.printed {
+				if !strings.Contains(buf.String(), p) {
+					t.Errorf("expect %q printed, got %q", p, buf.String())
+				}
+			}
+		})
+	}
+}
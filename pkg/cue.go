@@ -0,0 +1,167 @@
+package pkg
+
+import (
+	_ "embed"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"cuelang.org/go/cue"
+	"cuelang.org/go/cue/cuecontext"
+	cueerrors "cuelang.org/go/cue/errors"
+
+	"mvela/pkg/apis/v1alpha1"
+	"mvela/pkg/apis/v1alpha2"
+)
+
+// configSchema is the CUE schema of config file, one definition for each apiVersion
+//
+//go:embed schema.cue
+var configSchema string
+
+// schemaDefinitions maps apiVersion to CUE definition and Go type of config file
+var schemaDefinitions = map[string]struct {
+	definition string
+	goType     reflect.Type
+}{
+	v1alpha1.APIVersion: {"#V1alpha1", reflect.TypeOf(v1alpha1.Config{})},
+	v1alpha2.APIVersion: {"#V1alpha2", reflect.TypeOf(v1alpha2.Config{})},
+}
+
+func isCUEFile(file string) bool {
+	return strings.HasSuffix(file, ".cue")
+}
+
+// evalCUEConfig evaluates CUE config file, unifies it with the schema and exports it as JSON.
+// The line of each field in CUE file is returned too.
+func evalCUEConfig(file string, data []byte) ([]byte, fieldLines, error) {
+	ctx := cuecontext.New()
+	value := ctx.CompileBytes(data, cue.Filename(file))
+	if err := value.Err(); err != nil {
+		return nil, nil, cueFieldErrors(file, err, nil)
+	}
+
+	version := v1alpha1.APIVersion
+	if apiVersion := value.LookupPath(cue.ParsePath("apiVersion")); apiVersion.Exists() {
+		if version, _ = apiVersion.String(); !contains(supportedAPIVersions, version) {
+			return nil, nil, FieldErrors{{Field: "apiVersion", Line: apiVersion.Pos().Line(),
+				Detail: fmt.Sprintf("unsupported apiVersion %q, expect one of %s", version, strings.Join(supportedAPIVersions, ", "))}}
+		}
+	}
+	def := schemaDefinitions[version]
+	lines := fieldLines{}
+	cueLines(value, def.goType, "", lines)
+
+	schema := ctx.CompileString(configSchema, cue.Filename("schema.cue"))
+	if err := schema.Err(); err != nil {
+		return nil, nil, fmt.Errorf("invalid embedded config schema: %w", err)
+	}
+	// apiVersion is filled by schema if absent
+	unified := schema.LookupPath(cue.ParsePath(def.definition)).Unify(value)
+	if err := unified.Validate(cue.Concrete(true)); err != nil {
+		return nil, nil, cueFieldErrors(file, err, def.goType)
+	}
+	out, err := unified.MarshalJSON()
+	if err != nil {
+		return nil, nil, cueFieldErrors(file, err, def.goType)
+	}
+	return out, lines, nil
+}
+
+// cueLines walks CUE value along with type t and records the line of every field
+func cueLines(v cue.Value, t reflect.Type, path string, lines fieldLines) {
+	if path != "" {
+		lines[path] = v.Pos().Line()
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct, reflect.Map:
+		it, err := v.Fields()
+		if err != nil {
+			return
+		}
+		for it.Next() {
+			label := unquoteLabel(it.Selector().String())
+			if t.Kind() == reflect.Map {
+				cueLines(it.Value(), t.Elem(), fmt.Sprintf("%s[%s]", path, label), lines)
+			} else if f, ok := yamlFields(t)[label]; ok {
+				cueLines(it.Value(), f.Type, joinPath(path, label), lines)
+			}
+		}
+	case reflect.Slice:
+		it, err := v.List()
+		if err != nil {
+			return
+		}
+		for i := 0; it.Next(); i++ {
+			cueLines(it.Value(), t.Elem(), fmt.Sprintf("%s[%d]", path, i), lines)
+		}
+	}
+}
+
+// cueFieldErrors converts CUE errors to FieldErrors, positions in the config file are preferred over ones in schema
+func cueFieldErrors(file string, err error, t reflect.Type) FieldErrors {
+	var errs FieldErrors
+	for _, e := range cueerrors.Errors(err) {
+		fe := FieldError{Field: cueFieldPath(e.Path(), t)}
+		for _, pos := range cueerrors.Positions(e) {
+			if pos.Filename() == file {
+				fe.Line = pos.Line()
+				break
+			}
+		}
+		format, args := e.Msg()
+		fe.Detail = fmt.Sprintf(format, args...)
+		if fe.Field == "" {
+			fe.Field = "(root)"
+		}
+		errs = append(errs, fe)
+	}
+	sortFieldErrors(errs)
+	return errs
+}
+
+// cueFieldPath formats CUE path like the YAML path in FieldError, t tells map keys from struct fields
+func cueFieldPath(segments []string, t reflect.Type) string {
+	path := ""
+	if len(segments) > 0 && strings.HasPrefix(segments[0], "#") {
+		// path in schema definition
+		segments = segments[1:]
+	}
+	for _, seg := range segments {
+		seg = unquoteLabel(seg)
+		if t == nil {
+			path = joinPath(path, seg)
+			continue
+		}
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		switch t.Kind() {
+		case reflect.Map, reflect.Slice:
+			path = fmt.Sprintf("%s[%s]", path, seg)
+			t = t.Elem()
+		case reflect.Struct:
+			path = joinPath(path, seg)
+			if f, ok := yamlFields(t)[seg]; ok {
+				t = f.Type
+			} else {
+				t = nil
+			}
+		default:
+			path = joinPath(path, seg)
+			t = nil
+		}
+	}
+	return path
+}
+
+func unquoteLabel(label string) string {
+	if unquoted, err := strconv.Unquote(label); err == nil {
+		return unquoted
+	}
+	return label
+}
@@ -0,0 +1,99 @@
+package pkg
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestEvalCUEConfig(t *testing.T) {
+	cases := []struct {
+		name string
+		data string
+		// want are fields expected in the exported JSON
+		want map[string]interface{}
+		// errs are the expected field errors, in order
+		errs []string
+	}{
+		{
+			name: "v1alpha1 by default",
+			data: "managedCluster: 1 + 2\nkind: \"Simple\"\n",
+			want: map[string]interface{}{"apiVersion": "mvela.oam.dev/v1alpha1", "managedCluster": float64(3)},
+		},
+		{
+			name: "v1alpha2 with comprehension",
+			data: "apiVersion: \"mvela.oam.dev/v1alpha2\"\nclusters: [for n in [\"hub\", \"edge\"] {name: n}]\n",
+			want: map[string]interface{}{"apiVersion": "mvela.oam.dev/v1alpha2"},
+		},
+		{
+			name: "syntax error",
+			data: "managedCluster: [\n",
+			errs: []string{"line "},
+		},
+		{
+			name: "unsupported apiVersion",
+			data: "kind: \"Simple\"\napiVersion: \"mvela.oam.dev/v1\"\n",
+			errs: []string{"line 2: apiVersion: unsupported apiVersion"},
+		},
+		{
+			name: "schema violation",
+			data: "kind: \"Simple\"\nmanagedCluster: -1\n",
+			errs: []string{"line 2: managedCluster: "},
+		},
+		{
+			name: "unknown field",
+			data: "managedClusters: 2\n",
+			errs: []string{"line 1: (root): field not allowed: managedClusters"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			out, _, err := evalCUEConfig("mvela.cue", []byte(c.data))
+			if len(c.errs) > 0 {
+				errs, ok := err.(FieldErrors)
+				if !ok || len(errs) != len(c.errs) {
+					t.Fatalf("expect %d field error(s), got %v", len(c.errs), err)
+				}
+				for i, want := range c.errs {
+					if got := errs[i].Error(); !strings.HasPrefix(got, want) {
+						t.Errorf("error %d: expect %q, got %q", i, want, got)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got := map[string]interface{}{}
+			if err = json.Unmarshal(out, &got); err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range c.want {
+				if got[k] != v {
+					t.Errorf("%s: expect %v, got %v", k, v, got[k])
+				}
+			}
+		})
+	}
+}
+
+func TestEvalCUEConfigLines(t *testing.T) {
+	data := "apiVersion: \"mvela.oam.dev/v1alpha2\"\nclusters: [\n\t{name: \"hub\"},\n\t{\n\t\tname: \"edge\"\n\t},\n]\n"
+	_, lines, err := evalCUEConfig("mvela.cue", []byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for field, want := range map[string]int{"apiVersion": 1, "clusters[0].name": 3, "clusters[1].name": 5} {
+		if got := lines.lineOf(field); got != want {
+			t.Errorf("line of %s: expect %d, got %d", field, want, got)
+		}
+	}
+}
+
+func TestIsCUEFile(t *testing.T) {
+	for file, want := range map[string]bool{"mvela.cue": true, "mvela.yaml": false, "cue": false} {
+		if got := isCUEFile(file); got != want {
+			t.Errorf("%s: expect %v, got %v", file, want, got)
+		}
+	}
+}
@@ -1,7 +1,7 @@
 package pkg
 
 import (
-	"strings"
+	"fmt"
 
 	k3dClient "github.com/rancher/k3d/v5/pkg/client"
 	"github.com/rancher/k3d/v5/pkg/runtimes"
@@ -14,44 +14,48 @@ func CmdDelete(cmdConfig *Config) *cobra.Command {
 	cmd := cobra.Command{
 		Use:   "delete",
 		Short: "Delete all-in-one vela environment",
-		Long:  "Delete all-in-one vela environment",
-		Run: func(cmd *cobra.Command, args []string) {
+		Long: "Delete clusters of the environment along with their kubeconfigs. Clusters are the ones created from " +
+			"the config file or declared in it, or named like mvela-cluster if they're created before nodes are labeled",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := checkDocker(cmd.Context()); err != nil {
+				return err
+			}
 			clusterList, err := k3dClient.ClusterList(cmd.Context(), runtimes.SelectedRuntime)
 			if err != nil {
-				klog.ErrorS(err, "Fail to list clusters")
-				return
+				return clusterError(fmt.Errorf("fail to list clusters: %w", err))
 			}
 
-			if len(clusterList) == 0 {
-				klog.Error("No clusters to delete, run `mvela create` first")
+			mvelaClusters := ownedClusters(*cmdConfig, clusterList)
+			if len(mvelaClusters) == 0 {
+				klog.Warning("No clusters to delete, run `mvela create` first")
 			}
 
-			mvelaClusters := []*k3d.Cluster{}
-			for _, c := range clusterList {
-				if isMvelaCluster(c.Name) {
-					mvelaClusters = append(mvelaClusters, c)
-				}
-			}
-
-			// check cluster existence
 			for _, r := range mvelaClusters {
-				err = k3dClient.ClusterDelete(cmd.Context(), runtimes.SelectedRuntime, r, k3d.ClusterDeleteOpts{
-					SkipRegistryCheck: false,
-				})
-				if err != nil {
-					klog.ErrorS(err, "Fail to delete cluster")
-					return
+				// kubeconfigs go along with the cluster
+				if err = deleteCluster(cmd.Context(), *cmdConfig, r.Name, true); err != nil {
+					return clusterError(fmt.Errorf("fail to delete cluster %s: %w", r.Name, err))
 				}
 				klog.Infof("Successfully delete cluster: %s", r.Name)
-
-				// delete Kubeconfig
-
 			}
+			return nil
 		},
 	}
 	return &cmd
 }
 
-func isMvelaCluster(name string) bool {
-	return strings.Contains(name, "mvela-cluster")
+// ownedClusters are the clusters in the environment of cfg, see ownsCluster
+func ownedClusters(cfg Config, clusters []*k3d.Cluster) []*k3d.Cluster {
+	var owned []*k3d.Cluster
+	for _, c := range clusters {
+		for _, n := range c.Nodes {
+			if n.Role == k3d.ServerRole && ownsCluster(cfg, c.Name, n.RuntimeLabels) {
+				if n.RuntimeLabels[managedLabel] == "" {
+					klog.Warningf("Cluster %s has no owner labels, it's matched by name", c.Name)
+				}
+				owned = append(owned, c)
+				break
+			}
+		}
+	}
+	return owned
 }
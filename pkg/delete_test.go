@@ -0,0 +1,60 @@
+package pkg
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+
+	k3d "github.com/rancher/k3d/v5/pkg/types"
+)
+
+func TestOwnedClusters(t *testing.T) {
+	cfg := Config{File: "/etc/mvela/conf.yaml", Clusters: []Cluster{{Name: "hub"}}}
+	cluster := func(name string, labels map[string]string) *k3d.Cluster {
+		return &k3d.Cluster{Name: name, Nodes: []*k3d.Node{
+			{Role: k3d.LoadBalancerRole, RuntimeLabels: map[string]string{}},
+			{Role: k3d.ServerRole, RuntimeLabels: labels},
+		}}
+	}
+	clusters := []*k3d.Cluster{
+		cluster("hub", ownerLabels(cfg)),
+		cluster("edge", ownerLabels(cfg)),
+		cluster("other", ownerLabels(Config{File: "/etc/mvela/other.yaml"})),
+		cluster("mvela-cluster-1", map[string]string{}),
+		cluster("dev", map[string]string{}),
+		cluster(upgradeTestClusterName, map[string]string{upgradeTestLabel: "true"}),
+	}
+	var got []string
+	for _, c := range ownedClusters(cfg, clusters) {
+		got = append(got, c.Name)
+	}
+	if want := []string{"hub", "edge", "mvela-cluster-1"}; !equalStrings(got, want) {
+		t.Errorf("expect %v, got %v", want, got)
+	}
+}
+
+func TestDeleteClusterKubeconfigs(t *testing.T) {
+	cfg := Config{KubeconfigOpts: KubeconfigOption{Output: t.TempDir()}}
+	kubeconfig := kubeconfigPath(cfg, "mvela-absent-cluster")
+	for _, f := range []string{kubeconfig, kubeconfig + "-internal"} {
+		if err := os.WriteFile(f, nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	other := path.Join(cfg.KubeconfigOpts.Output, "other")
+	if err := os.WriteFile(other, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := deleteCluster(context.Background(), cfg, "mvela-absent-cluster", true); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{kubeconfig, kubeconfig + "-internal"} {
+		if _, err := os.Stat(f); !os.IsNotExist(err) {
+			t.Errorf("expect %s removed, got %v", f, err)
+		}
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("expect kubeconfigs of other clusters kept, got %v", err)
+	}
+}
@@ -0,0 +1,136 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/kyokomi/emoji/v2"
+	"github.com/spf13/cobra"
+)
+
+// clusterDiff is how a cluster differs between config and the running environment
+type clusterDiff struct {
+	Name string
+	// Missing is set if it's in config but not running, Extra if it's running but not in config
+	Missing bool
+	Extra   bool
+	// Fields differ between config and the node containers or the vela-core release
+	Fields []fieldDiff
+	// ChangedSinceCreate are hashed settings changed in config since the cluster was created, nil if no hash is
+	// recorded
+	ChangedSinceCreate []string
+}
+
+func (d clusterDiff) differs() bool {
+	return d.Missing || d.Extra || len(d.Fields) > 0 || len(d.ChangedSinceCreate) > 0
+}
+
+func CmdDiff(cmdConfig *Config) *cobra.Command {
+	cmd := cobra.Command{
+		Use:   "diff",
+		Short: "Show differences between config and the running environment",
+		Long: "Compare config with the node containers of running clusters and the vela-core release, and report what " +
+			"differs by cluster and field. Settings changed in config since a cluster was created are found by the " +
+			"hashes labeled on its nodes. mvela exits with 1 if anything differs.",
+		Example: "mvela diff -c conf.yaml",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := checkDocker(cmd.Context()); err != nil {
+				return err
+			}
+			if err := resolveSecrets(cmdConfig); err != nil {
+				return configError(err)
+			}
+			diffs, err := DiffEnvironment(cmd.Context(), *cmdConfig)
+			if err != nil {
+				return err
+			}
+			if printDiffs(os.Stdout, diffs) {
+				return errors.New("running environment differs from config")
+			}
+			return nil
+		},
+	}
+	return &cmd
+}
+
+// DiffEnvironment compares clusters in cfg with the running ones in the order of config, followed by running
+// clusters not in config. vela-core is compared in the control plane.
+func DiffEnvironment(ctx context.Context, cfg Config) ([]clusterDiff, error) {
+	running, runConfigs, err := observeEnvironment(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	var diffs []clusterDiff
+	for ord, r := range runConfigs {
+		d := clusterDiff{Name: r.Cluster.Name}
+		got, ok := running[d.Name]
+		if !ok {
+			d.Missing = true
+			diffs = append(diffs, d)
+			continue
+		}
+		want := desiredClusterState(r, cfg.Clusters[ord].Labels)
+		d.Fields = diffClusterState(want, *got)
+		d.ChangedSinceCreate = changedFields(want.Hashes, got.Hashes)
+		if isControlPlane(ord) {
+			current, err := currentVelaCore(cfg)
+			if err != nil {
+				return nil, err
+			}
+			velaDiffs, err := velaCoreDiffs(cfg, current)
+			if err != nil {
+				return nil, err
+			}
+			d.Fields = append(d.Fields, velaDiffs...)
+		}
+		diffs = append(diffs, d)
+	}
+	var extra []string
+	for name := range running {
+		if clusterOrdinal(cfg, name) < 0 {
+			extra = append(extra, name)
+		}
+	}
+	sort.Strings(extra)
+	for _, name := range extra {
+		diffs = append(diffs, clusterDiff{Name: name, Extra: true})
+	}
+	return diffs, nil
+}
+
+// printDiffs prints diffs by cluster, fields are shown as running -> config. True is returned if anything differs.
+func printDiffs(w io.Writer, diffs []clusterDiff) bool {
+	differs, legend := false, false
+	for _, d := range diffs {
+		if len(d.Fields) > 0 && !legend {
+			fmt.Fprintln(w, "Fields are shown as running -> config")
+			legend = true
+		}
+		switch {
+		case d.Missing:
+			emoji.Fprintf(w, ":heavy_plus_sign: %s: in config but not running\n", d.Name)
+		case d.Extra:
+			emoji.Fprintf(w, ":heavy_minus_sign: %s: running but not in config\n", d.Name)
+		case d.differs():
+			emoji.Fprintf(w, ":pencil2: %s:\n", d.Name)
+		default:
+			emoji.Fprintf(w, ":white_check_mark: %s: matches config\n", d.Name)
+		}
+		differs = differs || d.differs()
+		for _, f := range d.Fields {
+			fmt.Fprintf(w, "  %s\n", f)
+		}
+		if len(d.ChangedSinceCreate) > 0 {
+			fmt.Fprintf(w, "  changed in config since created: %s\n", strings.Join(d.ChangedSinceCreate, ", "))
+		}
+		if !d.Missing && !d.Extra && d.ChangedSinceCreate == nil {
+			fmt.Fprintf(w, "  no settings hash recorded, it's created by an older mvela\n")
+		}
+	}
+	return differs
+}
@@ -0,0 +1,143 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// ExitCode is the exit code of mvela, it tells scripts what kind of error happened
+type ExitCode int
+
+// Exit codes of mvela, keep them in sync with README
+const (
+	ExitOK ExitCode = iota
+	// ExitFailure is for errors of no other kind
+	ExitFailure
+	// ExitUsage is for invalid commands, flags or arguments
+	ExitUsage
+	// ExitConfig is for config files can't be found, read or validated
+	ExitConfig
+	// ExitDocker is for Docker daemon can't be connected
+	ExitDocker
+	// ExitCluster is for clusters can't be created, accessed or deleted
+	ExitCluster
+	// ExitChart is for charts can't be downloaded, installed, upgraded or rolled back
+	ExitChart
+	// ExitTimeout is for clusters, vela-core or Applications not ready in time
+	ExitTimeout
+)
+
+// Error is an error with the exit code of its kind
+type Error struct {
+	Code ExitCode
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// withCode marks err with exit code, nil is returned if err is nil
+func withCode(code ExitCode, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Code: code, Err: err}
+}
+
+func configError(err error) error {
+	return withCode(ExitConfig, err)
+}
+
+func clusterError(err error) error {
+	return withCode(ExitCluster, err)
+}
+
+func chartError(err error) error {
+	return withCode(ExitChart, err)
+}
+
+func timeoutError(err error) error {
+	return withCode(ExitTimeout, err)
+}
+
+// exitCodeOf returns the exit code of the outermost Error in err. Timeouts of waiting are ExitTimeout if not marked.
+func exitCodeOf(err error) ExitCode {
+	if err == nil {
+		return ExitOK
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, wait.ErrWaitTimeout) {
+		return ExitTimeout
+	}
+	return ExitFailure
+}
+
+// checkDocker makes sure Docker daemon can be connected
+func checkDocker(ctx context.Context) error {
+	if dockerCliErr != nil {
+		return withCode(ExitDocker, fmt.Errorf("docker is unavailable: %w", dockerCliErr))
+	}
+	if _, err := dockerCli.Ping(ctx); err != nil {
+		return withCode(ExitDocker, fmt.Errorf("docker is unavailable: %w", err))
+	}
+	return nil
+}
+
+// usageArgs marks errors of validating arguments with ExitUsage
+func usageArgs(args cobra.PositionalArgs) cobra.PositionalArgs {
+	return func(cmd *cobra.Command, a []string) error {
+		return withCode(ExitUsage, args(cmd, a))
+	}
+}
+
+// errorChain splits err into the messages of itself and the errors it wraps, from the outermost
+func errorChain(err error) []string {
+	var chain []string
+	for err != nil {
+		msg := err.Error()
+		next := errors.Unwrap(err)
+		if next != nil {
+			msg = strings.TrimSuffix(strings.TrimSpace(strings.TrimSuffix(msg, next.Error())), ":")
+		}
+		if msg != "" {
+			chain = append(chain, msg)
+		}
+		err = next
+	}
+	return chain
+}
+
+// printError prints err in a line with the outermost message and the root cause, or every error in the chain if
+// debug
+func printError(w io.Writer, err error, debug bool) {
+	chain := errorChain(err)
+	if len(chain) == 0 {
+		chain = []string{err.Error()}
+	}
+	if debug {
+		fmt.Fprintf(w, "Error: %s\n", chain[0])
+		for _, msg := range chain[1:] {
+			fmt.Fprintf(w, "  caused by: %s\n", msg)
+		}
+		return
+	}
+	if len(chain) == 1 {
+		fmt.Fprintf(w, "Error: %s\n", chain[0])
+		return
+	}
+	fmt.Fprintf(w, "Error: %s: %s\n", chain[0], chain[len(chain)-1])
+}
@@ -0,0 +1,67 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+func TestExitCodeOf(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want ExitCode
+	}{
+		{name: "nil", err: nil, want: ExitOK},
+		{name: "plain", err: errors.New("oops"), want: ExitFailure},
+		{name: "marked", err: chartError(errors.New("oops")), want: ExitChart},
+		{name: "wrapped", err: fmt.Errorf("fail to apply: %w", configError(errors.New("oops"))), want: ExitConfig},
+		{name: "outermost wins", err: clusterError(fmt.Errorf("fail to create: %w", chartError(errors.New("oops")))), want: ExitCluster},
+		{name: "deadline", err: fmt.Errorf("wait: %w", context.DeadlineExceeded), want: ExitTimeout},
+		{name: "wait timeout", err: fmt.Errorf("wait: %w", wait.ErrWaitTimeout), want: ExitTimeout},
+		{name: "marked timeout", err: clusterError(context.DeadlineExceeded), want: ExitCluster},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := exitCodeOf(c.err); got != c.want {
+				t.Errorf("expect %d, got %d", c.want, got)
+			}
+		})
+	}
+	if withCode(ExitChart, nil) != nil {
+		t.Error("expect nil marked as nil")
+	}
+}
+
+func TestPrintError(t *testing.T) {
+	err := chartError(fmt.Errorf("fail to install vela-core: %w", fmt.Errorf("fail to download chart: %w", errors.New("connection refused"))))
+	cases := []struct {
+		name  string
+		err   error
+		debug bool
+		want  string
+	}{
+		{name: "single", err: errors.New("oops"), want: "Error: oops\n"},
+		{name: "outermost and root", err: err, want: "Error: fail to install vela-core: connection refused\n"},
+		{
+			name:  "debug",
+			err:   err,
+			debug: true,
+			want:  "Error: fail to install vela-core\n  caused by: fail to download chart\n  caused by: connection refused\n",
+		},
+		{name: "not wrapped", err: fmt.Errorf("fail to install: %v", errors.New("oops")), want: "Error: fail to install: oops\n"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			printError(&buf, c.err, c.debug)
+			if buf.String() != c.want {
+				t.Errorf("expect %q, got %q", c.want, buf.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,224 @@
+package pkg
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"helm.sh/helm/v3/pkg/cli"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Labels of node containers recording hashes of the settings a cluster is created with
+const (
+	configHashLabel      = "mvela.config-hash"
+	fieldHashLabelPrefix = "mvela.hash."
+)
+
+// hashedFields are the settings recorded by hash, storage and chart are for the control plane only
+var hashedFields = []string{"image", "args", "registries", "storage", "chart"}
+
+// chartHashAnnotation records the hash of vela-core chart on the vela-system namespace once vela-core is upgraded,
+// labels of node containers can't be changed. It takes over the one in labels, see observeChartHash.
+const chartHashAnnotation = fieldHashLabelPrefix + "chart"
+
+// secretHashedFields hold secrets, they are hashed with HMAC keyed by the local hash key, see ensureHashKey
+var secretHashedFields = []string{"storage"}
+
+// settingsHashLabels returns labels of hashes of the effective settings of cluster ord in cfg, one for each of
+// hashedFields and one for all of them. chart is the vela-core chart settings, see chartSettings, it's left out of
+// the control plane if nil. Fields with secrets are left out if key is empty.
+func settingsHashLabels(cfg Config, ord int, key []byte, chart interface{}) (map[string]string, error) {
+	settings := map[string]interface{}{
+		"image":      cfg.Clusters[ord].Image,
+		"args":       cfg.Clusters[ord].Args,
+		"registries": convertRegistry(cfg.Registries),
+	}
+	if isControlPlane(ord) {
+		settings["storage"] = struct {
+			Storage Storage
+			Token   string
+		}{cfg.Storage, cfg.Token}
+		if chart != nil {
+			settings["chart"] = chart
+		}
+	} else {
+		settings["storage"] = nil
+		settings["chart"] = nil
+	}
+
+	labels := map[string]string{}
+	hashes := map[string]string{}
+	for _, field := range hashedFields {
+		if _, ok := settings[field]; !ok {
+			continue
+		}
+		var fieldKey []byte
+		if contains(secretHashedFields, field) {
+			if len(key) == 0 {
+				continue
+			}
+			fieldKey = key
+		}
+		h, err := hashOf(settings[field], fieldKey)
+		if err != nil {
+			return nil, err
+		}
+		labels[fieldHashLabelPrefix+field] = h
+		hashes[field] = h
+	}
+	labels[configHashLabel] = configHash(hashes)
+	return labels, nil
+}
+
+// configHash is the hash of all fields from their hashes, fields not hashed are left out
+func configHash(hashes map[string]string) string {
+	var all []string
+	for _, field := range hashedFields {
+		if h, ok := hashes[field]; ok {
+			all = append(all, field+"="+h)
+		}
+	}
+	return hashString(strings.Join(all, ","))
+}
+
+// chartSettings are the settings of vela-core chart in cfg that are hashed: the version its spec resolves to and
+// the merged values
+func chartSettings(cfg Config) (interface{}, error) {
+	version, err := chartVersion(velaCoreRelease(cfg.HelmOpts), cfg.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	vals, err := chartValues(cfg.HelmOpts, chartGetters(cli.New(), chartHTTPClient(cfg.Proxy), downloadTimeout(cfg.HelmOpts)))
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		Version string
+		Values  map[string]interface{}
+	}{version, vals}, nil
+}
+
+// hashOf is the SHA-256 of the JSON form of v, maps are encoded with sorted keys. It's the HMAC-SHA-256 if key
+// is set.
+func hashOf(v interface{}, key []byte) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	if len(key) > 0 {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(data)
+		return hex.EncodeToString(mac.Sum(nil)), nil
+	}
+	return hashString(string(data)), nil
+}
+
+func hashString(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// recordedHashes returns hashes recorded in labels by field, the one of all fields is keyed by configHashLabel
+func recordedHashes(labels map[string]string) map[string]string {
+	hashes := map[string]string{}
+	for k, v := range labels {
+		if k == configHashLabel {
+			hashes[k] = v
+		} else if strings.HasPrefix(k, fieldHashLabelPrefix) {
+			hashes[strings.TrimPrefix(k, fieldHashLabelPrefix)] = v
+		}
+	}
+	return hashes
+}
+
+// changedFields are the hashed fields whose hashes differ, nil if nothing is recorded in got. Fields not hashed in
+// want are skipped.
+func changedFields(want, got map[string]string) []string {
+	if len(got) == 0 {
+		return nil
+	}
+	changed := []string{}
+	if want[configHashLabel] == got[configHashLabel] {
+		return changed
+	}
+	for _, field := range hashedFields {
+		if _, ok := want[field]; ok && want[field] != got[field] {
+			changed = append(changed, field)
+		}
+	}
+	return changed
+}
+
+// recordChartHash records the hash of vela-core chart in cfg in the control plane, after vela-core is upgraded
+func recordChartHash(ctx context.Context, cfg Config) error {
+	chart, err := chartSettings(cfg)
+	if err != nil {
+		return err
+	}
+	h, err := hashOf(chart, nil)
+	if err != nil {
+		return err
+	}
+	clientset, err := controlPlaneClientset(cfg)
+	if err != nil {
+		return err
+	}
+	return writeChartHash(ctx, clientset, h)
+}
+
+// observeChartHash replaces the chart hash of the running control plane s with the one recorded after vela-core is
+// upgraded, if any
+func observeChartHash(ctx context.Context, cfg Config, s *clusterState) error {
+	if len(s.Hashes) == 0 {
+		return nil
+	}
+	clientset, err := controlPlaneClientset(cfg)
+	if err != nil {
+		return err
+	}
+	h, err := readChartHash(ctx, clientset)
+	if err != nil || h == "" {
+		return err
+	}
+	s.Hashes["chart"] = h
+	s.Hashes[configHashLabel] = configHash(s.Hashes)
+	return nil
+}
+
+func controlPlaneClientset(cfg Config) (kubernetes.Interface, error) {
+	config, err := kubeClientGetter(kubeconfigPath(cfg, cfg.Clusters[0].Name), "", cfg.Proxy).ToRESTConfig()
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+func writeChartHash(ctx context.Context, clientset kubernetes.Interface, h string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": map[string]string{chartHashAnnotation: h}},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = clientset.CoreV1().Namespaces().Patch(ctx, VelaCoreReleaseNamespace, k8stypes.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return fmt.Errorf("fail to record chart hash on namespace %s: %w", VelaCoreReleaseNamespace, err)
+	}
+	return nil
+}
+
+// readChartHash returns the chart hash recorded on the vela-system namespace, empty if there is none
+func readChartHash(ctx context.Context, clientset kubernetes.Interface) (string, error) {
+	ns, err := clientset.CoreV1().Namespaces().Get(ctx, VelaCoreReleaseNamespace, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("fail to get namespace %s: %w", VelaCoreReleaseNamespace, err)
+	}
+	return ns.Annotations[chartHashAnnotation], nil
+}
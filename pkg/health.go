@@ -0,0 +1,147 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/releaseutil"
+	appsv1 "k8s.io/api/apps/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apiextensions "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const healthPollInterval = 2 * time.Second
+
+// manifestObject is the kind and name of an object in a release manifest
+type manifestObject struct {
+	Kind     string `yaml:"kind"`
+	Metadata struct {
+		Name      string `yaml:"name"`
+		Namespace string `yaml:"namespace"`
+	} `yaml:"metadata"`
+}
+
+// releaseObjects returns objects of kind in rel, namespace of namespaced objects is filled with the one of rel.
+// CRDs in crds directory of the chart are included.
+func releaseObjects(rel *release.Release, kind string) []manifestObject {
+	manifests := releaseutil.SplitManifests(rel.Manifest)
+	var keys []string
+	for k := range manifests {
+		keys = append(keys, k)
+	}
+	// in the order of the manifest
+	sort.Sort(releaseutil.BySplitManifestsOrder(keys))
+	var docs []string
+	for _, k := range keys {
+		docs = append(docs, manifests[k])
+	}
+	if rel.Chart != nil {
+		for _, crd := range rel.Chart.CRDObjects() {
+			docs = append(docs, string(crd.File.Data))
+		}
+	}
+	var objects []manifestObject
+	for _, doc := range docs {
+		dec := yaml.NewDecoder(bytes.NewBufferString(doc))
+		for {
+			var o manifestObject
+			if err := dec.Decode(&o); err != nil {
+				// io.EOF, or the rest is not valid YAML
+				break
+			}
+			if o.Kind != kind {
+				continue
+			}
+			if o.Metadata.Namespace == "" && kind != "CustomResourceDefinition" {
+				o.Metadata.Namespace = rel.Namespace
+			}
+			objects = append(objects, o)
+		}
+	}
+	return objects
+}
+
+// waitReleaseHealthy waits until Deployments of rel are rolled out and its CRDs are established
+func waitReleaseHealthy(ctx context.Context, config *rest.Config, rel *release.Release, timeout time.Duration) error {
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+	extClientset, err := apiextensions.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+	deployments := releaseObjects(rel, "Deployment")
+	crds := releaseObjects(rel, "CustomResourceDefinition")
+
+	var unhealthy error
+	check := func() (bool, error) {
+		unhealthy = nil
+		for _, d := range deployments {
+			got, err := clientset.AppsV1().Deployments(d.Metadata.Namespace).Get(ctx, d.Metadata.Name, metav1.GetOptions{})
+			if err != nil {
+				unhealthy = fmt.Errorf("deployment %s/%s: %w", d.Metadata.Namespace, d.Metadata.Name, err)
+				return false, nil
+			}
+			if !deploymentAvailable(got) {
+				unhealthy = fmt.Errorf("deployment %s/%s has %d/%d replicas available", d.Metadata.Namespace, d.Metadata.Name,
+					got.Status.AvailableReplicas, deploymentReplicas(got))
+				return false, nil
+			}
+		}
+		for _, c := range crds {
+			got, err := extClientset.ApiextensionsV1().CustomResourceDefinitions().Get(ctx, c.Metadata.Name, metav1.GetOptions{})
+			if err != nil {
+				unhealthy = fmt.Errorf("CRD %s: %w", c.Metadata.Name, err)
+				return false, nil
+			}
+			if !crdEstablished(got) {
+				unhealthy = fmt.Errorf("CRD %s is not established", c.Metadata.Name)
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err = wait.PollImmediateUntil(healthPollInterval, check, ctx.Done()); err != nil {
+		if unhealthy != nil {
+			return timeoutError(fmt.Errorf("not healthy in %s: %w", timeout, unhealthy))
+		}
+		return timeoutError(err)
+	}
+	return nil
+}
+
+// deploymentAvailable tells if the latest spec of d is rolled out and all its replicas are available
+func deploymentAvailable(d *appsv1.Deployment) bool {
+	replicas := deploymentReplicas(d)
+	return d.Status.ObservedGeneration >= d.Generation && d.Status.UpdatedReplicas >= replicas &&
+		d.Status.AvailableReplicas >= replicas
+}
+
+func deploymentReplicas(d *appsv1.Deployment) int32 {
+	if d.Spec.Replicas != nil {
+		return *d.Spec.Replicas
+	}
+	return 1
+}
+
+func crdEstablished(crd *apiextensionsv1.CustomResourceDefinition) bool {
+	for _, c := range crd.Status.Conditions {
+		if c.Type == apiextensionsv1.Established {
+			return c.Status == apiextensionsv1.ConditionTrue
+		}
+	}
+	return false
+}
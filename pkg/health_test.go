@@ -0,0 +1,74 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/release"
+	appsv1 "k8s.io/api/apps/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+)
+
+func TestReleaseObjects(t *testing.T) {
+	rel := &release.Release{
+		Namespace: "vela-system",
+		Manifest: "---\n# Source: vela-core/templates/a.yaml\nkind: Deployment\nmetadata:\n  name: a\n" +
+			"---\nkind: Deployment\nmetadata:\n  name: b\n  namespace: other\n---\nkind: Service\nmetadata:\n  name: a\n",
+		Chart: &chart.Chart{Files: []*chart.File{
+			{Name: "crds/app.yaml", Data: []byte("kind: CustomResourceDefinition\nmetadata:\n  name: applications.core.oam.dev\n")},
+		}},
+	}
+	names := func(objects []manifestObject) []string {
+		var got []string
+		for _, o := range objects {
+			got = append(got, o.Metadata.Namespace+"/"+o.Metadata.Name)
+		}
+		return got
+	}
+	if got := names(releaseObjects(rel, "Deployment")); !reflect.DeepEqual(got, []string{"vela-system/a", "other/b"}) {
+		t.Errorf("expect deployments in release namespace by default, got %v", got)
+	}
+	if got := names(releaseObjects(rel, "CustomResourceDefinition")); !reflect.DeepEqual(got, []string{"/applications.core.oam.dev"}) {
+		t.Errorf("expect CRDs of the chart, got %v", got)
+	}
+}
+
+func TestDeploymentAvailable(t *testing.T) {
+	two := int32(2)
+	cases := []struct {
+		name string
+		d    appsv1.Deployment
+		want bool
+	}{
+		{name: "one replica by default", d: appsv1.Deployment{Status: appsv1.DeploymentStatus{UpdatedReplicas: 1, AvailableReplicas: 1}}, want: true},
+		{name: "not all available", d: appsv1.Deployment{Spec: appsv1.DeploymentSpec{Replicas: &two}, Status: appsv1.DeploymentStatus{UpdatedReplicas: 2, AvailableReplicas: 1}}},
+		{name: "old replicas available", d: appsv1.Deployment{Status: appsv1.DeploymentStatus{AvailableReplicas: 1}}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := deploymentAvailable(&c.d); got != c.want {
+				t.Errorf("expect %v, got %v", c.want, got)
+			}
+		})
+	}
+	stale := appsv1.Deployment{Status: appsv1.DeploymentStatus{UpdatedReplicas: 1, AvailableReplicas: 1}}
+	stale.Generation = 2
+	if deploymentAvailable(&stale) {
+		t.Error("expect a deployment whose latest spec isn't observed not available")
+	}
+}
+
+func TestCRDEstablished(t *testing.T) {
+	crd := func(conditions ...apiextensionsv1.CustomResourceDefinitionCondition) *apiextensionsv1.CustomResourceDefinition {
+		return &apiextensionsv1.CustomResourceDefinition{Status: apiextensionsv1.CustomResourceDefinitionStatus{Conditions: conditions}}
+	}
+	established := apiextensionsv1.CustomResourceDefinitionCondition{Type: apiextensionsv1.Established, Status: apiextensionsv1.ConditionTrue}
+	named := apiextensionsv1.CustomResourceDefinitionCondition{Type: apiextensionsv1.NamesAccepted, Status: apiextensionsv1.ConditionTrue}
+	if !crdEstablished(crd(named, established)) {
+		t.Error("expect established")
+	}
+	if crdEstablished(crd(named)) {
+		t.Error("expect not established without the condition")
+	}
+}
@@ -3,28 +3,23 @@ package pkg
 import (
 	"errors"
 	"fmt"
-	"io"
-	"log"
-	"net/http"
 	"os"
 	"path"
 
 	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
 	"helm.sh/helm/v3/pkg/chart/loader"
 	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/cli/values"
+	"helm.sh/helm/v3/pkg/getter"
 	"helm.sh/helm/v3/pkg/storage/driver"
+	"helm.sh/helm/v3/pkg/strvals"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	"k8s.io/client-go/rest"
 	"k8s.io/klog/v2"
 )
 
-const (
-	VelaCoreChartURLTemp = "https://kubevelacharts.oss-cn-hangzhou.aliyuncs.com/core/vela-core-%s.tgz"
-	DefaultSemver        = "1.2.4"
-)
-
-var (
-	CachePath      = path.Join(VelaDir(), "cache")
-	CacheChartTemp = func() string { return path.Join(CachePath, "vela-core-%s.tgz") }()
-)
+var CachePath = path.Join(VelaDir(), "cache")
 
 func init() {
 	err := os.MkdirAll(CachePath, 0o755)
@@ -33,92 +28,167 @@ func init() {
 	}
 }
 
-func checkChartExist(semver string) bool {
-	filePath := fmt.Sprintf(CacheChartTemp, semver)
-	_, err := os.Stat(filePath)
-	if err != nil && errors.Is(err, os.ErrNotExist) {
-		return false
-	} else if err != nil {
-		klog.ErrorS(err, "fail to stat chart file")
-	}
-	return true
+// Release of vela-core chart
+const (
+	VelaCoreReleaseName      = "kubevela"
+	VelaCoreReleaseNamespace = "vela-system"
+)
+
+// InstallVelaCore installs or upgrades vela-core chart in the cluster of kubeconfig, chart is downloaded and
+// Kubernetes API is accessed with proxy. It's safe to install into several clusters in parallel.
+func InstallVelaCore(kubeconfig string, opts HelmOpts, proxy Proxy) error {
+	klog.Infof("Installing KubeVela Helm chart with kubeconfig %s, please hold...", kubeconfig)
+	return InstallRelease(kubeconfig, velaCoreRelease(opts), proxy)
 }
 
-// prepareChart will return cache chart to local and return its path
-func prepareChart(semver string) (string, error) {
-	if checkChartExist(semver) {
-		return chartCachePathForSemver(semver), nil
+// velaCoreRelease is the release of vela-core chart with opts
+func velaCoreRelease(opts HelmOpts) Release {
+	if opts.Version == "" {
+		opts.Version = DefaultSemver
+	}
+	return Release{
+		Name:      VelaCoreReleaseName,
+		Namespace: VelaCoreReleaseNamespace,
+		Chart:     velaCoreChartName,
+		HelmOpts:  opts,
 	}
+}
 
-	// download the chart
-	if semver == "" {
-		semver = DefaultSemver
+// InstallRelease installs release r, or upgrades it if exists, in the cluster of kubeconfig. r should be completed.
+func InstallRelease(kubeconfig string, r Release, proxy Proxy) error {
+	actionConfig, err := helmActionConfig(kubeconfig, r.Namespace, proxy)
+	if err != nil {
+		return err
 	}
-	chartURL := fmt.Sprintf(VelaCoreChartURLTemp, semver)
-	resp, err := http.Get(chartURL)
+	chart, vals, err := prepareChart(r, proxy)
 	if err != nil {
-		return "", err
+		return err
 	}
-	defer resp.Body.Close()
 
-	newFile, err := os.Create(chartCachePathForSemver(semver))
+	uCLI := action.NewUpgrade(actionConfig)
+	uCLI.Namespace = r.Namespace
+	uCLI.Install = false
+	_, err = uCLI.Run(r.Name, chart, vals)
+	if err != nil && errors.Is(err, driver.ErrNoDeployedReleases) {
+		klog.Infof("Helm release %s not found, perform installing now...", r.Name)
+		iCLI := action.NewInstall(actionConfig)
+		iCLI.Namespace = r.Namespace
+		iCLI.ReleaseName = r.Name
+		iCLI.CreateNamespace = true
+		if _, err = iCLI.Run(chart, vals); err != nil {
+			return chartError(fmt.Errorf("fail to install release %s: %w", r.Name, err))
+		}
+	} else if err != nil {
+		return chartError(fmt.Errorf("fail to upgrade release %s: %w", r.Name, err))
+	}
+	return nil
+}
+
+// helmActionConfig is the configuration of Helm actions on releases in namespace of the cluster of kubeconfig
+func helmActionConfig(kubeconfig, namespace string, proxy Proxy) (*action.Configuration, error) {
+	actionConfig := new(action.Configuration)
+	helmDriver := os.Getenv("HELM_DRIVER")
+	if err := actionConfig.Init(kubeClientGetter(kubeconfig, namespace, proxy), namespace, helmDriver, debug); err != nil {
+		return nil, clusterError(fmt.Errorf("fail to init Helm with kubeconfig %s: %w", kubeconfig, err))
+	}
+	return actionConfig, nil
+}
+
+// chartVersion is the version the chart spec of r resolves to, the one in Chart.yaml for local charts
+func chartVersion(r Release, proxy Proxy) (string, error) {
+	cache, err := newChartCache(r.HelmOpts, cli.New(), chartHTTPClient(proxy))
 	if err != nil {
-		klog.ErrorS(err, "fail to create chart cache file")
 		return "", err
 	}
-	defer newFile.Close()
-
-	_, err = io.Copy(newFile, resp.Body)
+	source, err := newChartSource(r.Chart, r.HelmOpts, cache)
 	if err != nil {
-		klog.ErrorS(err, "fail to copy chart file content")
 		return "", err
 	}
-	return chartCachePathForSemver(semver), nil
+	if _, ok := source.(localChart); ok {
+		versions, err := source.versions()
+		if err != nil || len(versions) == 0 {
+			return "", fmt.Errorf("fail to read version of local chart %s: %v", r.HelmOpts.ChartPath, err)
+		}
+		return versions[0], nil
+	}
+	return resolveChartVersion(r.Chart, r.HelmOpts.Version, source, cache)
 }
 
-func InstallVelaCore(opts HelmOpts) error {
-	klog.Info("Installing KubeVela Helm chart, please hold...")
-	CancelProxy()
-	chartPath, err := prepareChart(opts.Version)
+// prepareChart gets the chart of r in the version its spec resolves to, along with the values of r
+func prepareChart(r Release, proxy Proxy) (*chart.Chart, map[string]interface{}, error) {
+	opts := r.HelmOpts
+	cache, err := newChartCache(opts, cli.New(), chartHTTPClient(proxy))
+	if err != nil {
+		return nil, nil, chartError(err)
+	}
+	source, err := newChartSource(r.Chart, opts, cache)
+	if err != nil {
+		return nil, nil, chartError(err)
+	}
+	version := ""
+	if _, ok := source.(localChart); !ok {
+		if version, err = resolveChartVersion(r.Chart, opts.Version, source, cache); err != nil {
+			return nil, nil, chartError(err)
+		}
+		klog.Infof("Using %s chart version %s", r.Chart, version)
+	}
+	chartPath, err := source.locate(version)
 	if err != nil {
-		klog.ErrorS(err, "fail to prepare vela-core chart")
+		return nil, nil, chartError(fmt.Errorf("fail to prepare chart %s: %w", r.Chart, err))
 	}
 	klog.Infof("Successfully prepare chart file in %s", chartPath)
-	chart, err := loader.Load(chartPath)
+	ch, err := loader.Load(chartPath)
 	if err != nil {
-		panic(err)
+		return nil, nil, chartError(fmt.Errorf("fail to load chart %s: %w", chartPath, err))
+	}
+	vals, err := chartValues(opts, cache.getters)
+	if err != nil {
+		return nil, nil, configError(fmt.Errorf("invalid values of chart %s: %w", r.Chart, err))
 	}
+	return ch, vals, nil
+}
 
-	releaseName := "kubevela"
-	releaseNamespace := "vela-system"
+// kubeClientGetter is the Kubernetes client config of Helm read from kubeconfig file only, KUBECONFIG in environment
+// is ignored. Kubernetes API is accessed with proxy.
+func kubeClientGetter(kubeconfig, namespace string, proxy Proxy) genericclioptions.RESTClientGetter {
+	flags := genericclioptions.NewConfigFlags(true)
+	flags.KubeConfig = &kubeconfig
+	flags.Namespace = &namespace
+	flags.WrapConfigFn = func(c *rest.Config) *rest.Config {
+		return setAPIProxy(c, proxy)
+	}
+	return flags
+}
 
-	actionConfig := new(action.Configuration)
-	settings := cli.New()
-	settings.SetNamespace(releaseNamespace)
-	helmDriver := os.Getenv("HELM_DRIVER")
-	if err := actionConfig.Init(settings.RESTClientGetter(), settings.Namespace(), helmDriver, debug); err != nil {
-		log.Fatal(err)
+// chartValues merges values of vela-core chart in Helm's order: inline values, values files, then --set
+func chartValues(opts HelmOpts, getters getter.Providers) (map[string]interface{}, error) {
+	fileValues, err := (&values.Options{ValueFiles: opts.ValuesFiles}).MergeValues(getters)
+	if err != nil {
+		return nil, err
+	}
+	vals := mergeValues(mergeValues(map[string]interface{}{}, opts.Values), fileValues)
+	for _, s := range opts.Set {
+		if err = strvals.ParseInto(s, vals); err != nil {
+			return nil, fmt.Errorf("failed parsing --set data %q: %w", s, err)
+		}
 	}
+	return vals, nil
+}
 
-	uCLI := action.NewUpgrade(actionConfig)
-	uCLI.Namespace = releaseNamespace
-	uCLI.Install = false
-	_, err = uCLI.Run(releaseName, chart, nil)
-	if err != nil && errors.As(err, &driver.ErrReleaseNotFound) {
-		klog.Info("Helm release not found, perform installing now...")
-		iCLI := action.NewInstall(actionConfig)
-		iCLI.Namespace = releaseNamespace
-		iCLI.ReleaseName = releaseName
-		iCLI.CreateNamespace = true
-		_, err = iCLI.Run(chart, nil)
-		if err != nil {
-			klog.ErrorS(err, "Fail to run install install action")
+// mergeValues merges src into dst recursively like Helm does, maps in src are copied
+func mergeValues(dst, src map[string]interface{}) map[string]interface{} {
+	for k, v := range src {
+		if m, ok := v.(map[string]interface{}); ok {
+			if d, ok := dst[k].(map[string]interface{}); ok {
+				dst[k] = mergeValues(d, m)
+			} else {
+				dst[k] = mergeValues(map[string]interface{}{}, m)
+			}
+			continue
 		}
-	} else if err != nil {
-		klog.Info(err, "Fail to run Helm upgrade action")
-		return err
+		dst[k] = v
 	}
-	return nil
+	return dst
 }
 
 func debug(format string, v ...interface{}) {
@@ -127,17 +197,3 @@ func debug(format string, v ...interface{}) {
 		klog.Infof(format, v...)
 	}
 }
-
-func chartCachePathForSemver(semver string) string {
-	return path.Join(VelaDir(), fmt.Sprintf("vela-core-%s.tgz", semver))
-}
-
-func CancelProxy() {
-	klog.Info("Setting proxy to None to install Helm chart")
-	klog.Info("setting HTTP_PROXY/http_proxy to empty")
-	os.Setenv("HTTP_PROXY", "")
-	os.Setenv("http_proxy", "")
-	klog.Info("setting HTTPS_PROXY/https_proxy to empty")
-	os.Setenv("HTTPS_PROXY", "")
-	os.Setenv("https_proxy", "")
-}
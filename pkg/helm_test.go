@@ -0,0 +1,127 @@
+package pkg
+
+import (
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/getter"
+)
+
+func TestMergeValues(t *testing.T) {
+	cases := []struct {
+		name string
+		dst  map[string]interface{}
+		src  map[string]interface{}
+		want map[string]interface{}
+	}{
+		{
+			name: "nested maps merged",
+			dst:  map[string]interface{}{"image": map[string]interface{}{"repository": "a", "tag": "1"}, "replicaCount": 1},
+			src:  map[string]interface{}{"image": map[string]interface{}{"tag": "2"}},
+			want: map[string]interface{}{"image": map[string]interface{}{"repository": "a", "tag": "2"}, "replicaCount": 1},
+		},
+		{
+			name: "lists replaced",
+			dst:  map[string]interface{}{"args": []interface{}{"a", "b"}},
+			src:  map[string]interface{}{"args": []interface{}{"c"}},
+			want: map[string]interface{}{"args": []interface{}{"c"}},
+		},
+		{
+			name: "map replaces scalar",
+			dst:  map[string]interface{}{"resources": "none"},
+			src:  map[string]interface{}{"resources": map[string]interface{}{"cpu": "1"}},
+			want: map[string]interface{}{"resources": map[string]interface{}{"cpu": "1"}},
+		},
+		{
+			name: "scalar replaces map",
+			dst:  map[string]interface{}{"resources": map[string]interface{}{"cpu": "1"}},
+			src:  map[string]interface{}{"resources": nil},
+			want: map[string]interface{}{"resources": nil},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := mergeValues(c.dst, c.src); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("expect %v, got %v", c.want, got)
+			}
+		})
+	}
+}
+
+func TestMergeValuesCopiesSource(t *testing.T) {
+	src := map[string]interface{}{"image": map[string]interface{}{"tag": "1"}}
+	dst := mergeValues(map[string]interface{}{}, src)
+	dst["image"].(map[string]interface{})["tag"] = "2"
+	if src["image"].(map[string]interface{})["tag"] != "1" {
+		t.Error("expect maps in source not changed by merging into them later")
+	}
+}
+
+func TestChartValues(t *testing.T) {
+	file := path.Join(t.TempDir(), "values.yaml")
+	if err := os.WriteFile(file, []byte("replicaCount: 2\nimage:\n  tag: from-file\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	getters := getter.All(cli.New())
+	opts := HelmOpts{
+		Values:      map[string]interface{}{"replicaCount": 1, "image": map[string]interface{}{"repository": "vela", "tag": "inline"}},
+		ValuesFiles: []string{file},
+		Set:         []string{"image.tag=from-set"},
+	}
+	got, err := chartValues(opts, getters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"replicaCount": float64(2),
+		"image":        map[string]interface{}{"repository": "vela", "tag": "from-set"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expect values merged in order of values, valuesFiles and set, got %v", got)
+	}
+	if opts.Values["image"].(map[string]interface{})["tag"] != "inline" {
+		t.Error("expect inline values not changed")
+	}
+
+	for _, invalid := range []HelmOpts{{ValuesFiles: []string{path.Join(path.Dir(file), "none.yaml")}}, {Set: []string{"a[=1"}}} {
+		if _, err = chartValues(invalid, getters); err == nil {
+			t.Errorf("expect an error of %+v", invalid)
+		}
+	}
+}
+
+func TestKubeClientGetter(t *testing.T) {
+	dir := t.TempDir()
+	kubeconfig := func(name, server string) string {
+		file := path.Join(dir, name)
+		data := "apiVersion: v1\nkind: Config\nclusters:\n- name: c\n  cluster: {server: " + server + "}\n" +
+			"contexts:\n- name: c\n  context: {cluster: c, user: u}\ncurrent-context: c\nusers:\n- name: u\n  user: {token: t}\n"
+		if err := os.WriteFile(file, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	setEnv(t, "KUBECONFIG", kubeconfig("env", "https://env:6443"))
+	file := kubeconfig("cluster", "https://cluster:6443")
+
+	proxy := Proxy{API: ProxySettings{HTTPS: "http://proxy:3128"}}
+	getter := kubeClientGetter(file, "vela-system", proxy)
+	config, err := getter.ToRESTConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Host != "https://cluster:6443" {
+		t.Errorf("expect the cluster of kubeconfig, not of KUBECONFIG, got %s", config.Host)
+	}
+	if ns, _, err := getter.ToRawKubeConfigLoader().Namespace(); err != nil || ns != "vela-system" {
+		t.Errorf("expect namespace vela-system, got %s, %v", ns, err)
+	}
+	req := httptest.NewRequest("GET", config.Host, nil)
+	if u, err := config.Proxy(req); err != nil || u == nil || u.Host != "proxy:3128" {
+		t.Errorf("expect API accessed with proxy, got %v, %v", u, err)
+	}
+}
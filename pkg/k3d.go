@@ -17,12 +17,12 @@ type registry struct {
 	Config *k3s.Registry   `yaml:"config,omitempty" json:"config,omitempty"`
 }
 
-func getClusterCreateOpts(r Registry) k3d.ClusterCreateOpts {
+func getClusterCreateOpts(r Registry, labels map[string]string, env []string) k3d.ClusterCreateOpts {
 	InfoMirrors(r)
 	k3sRegistry := convertRegistry(r)
 	clusterCreateOpts := k3d.ClusterCreateOpts{
 		GlobalLabels: map[string]string{}, // empty init
-		GlobalEnv:    []string{},          // empty init
+		GlobalEnv:    append([]string{}, env...),
 		Registries: registry{
 			Config: &k3sRegistry,
 		},
@@ -32,12 +32,16 @@ func getClusterCreateOpts(r Registry) k3d.ClusterCreateOpts {
 	for k, v := range k3d.DefaultRuntimeLabels {
 		clusterCreateOpts.GlobalLabels[k] = v
 	}
+	for k, v := range labels {
+		clusterCreateOpts.GlobalLabels[k] = v
+	}
 
 	return clusterCreateOpts
 }
 
-// getClusterConfig will get different k3d.Cluster based on ordinal , storage for external storage, token is needed if storage is set
-func getClusterConfig(ordinal int, storage Storage, token string) (k3d.Cluster, error) {
+// getClusterConfig will get different k3d.Cluster based on ordinal and completed cluster settings,
+// storage for external storage, token is needed if storage is set
+func getClusterConfig(ordinal int, c Cluster, storage Storage, token string) (k3d.Cluster, error) {
 	if storage.Endpoint != "" && token == "" {
 		return k3d.Cluster{}, errors.New("token is needed if using external storage")
 	}
@@ -54,18 +58,12 @@ func getClusterConfig(ordinal int, storage Storage, token string) (k3d.Cluster,
 	kubeAPIExposureOpts.Port = k3d.DefaultAPIPort
 	kubeAPIExposureOpts.Binding = nat.PortBinding{
 		HostIP:   k3d.DefaultAPIHost,
-		HostPort: fmt.Sprint(6443 + ordinal),
+		HostPort: fmt.Sprint(c.APIPort),
 	}
 
 	// fill cluster config
-	var clusterName string
-	if ordinal == 0 {
-		clusterName = "mvela-cluster-control-plane"
-	} else {
-		clusterName = fmt.Sprintf("mvela-cluster-%d", ordinal)
-	}
 	clusterConfig := k3d.Cluster{
-		Name:    clusterName,
+		Name:    c.Name,
 		Network: universalK3dNetwork,
 		KubeAPI: &kubeAPIExposureOpts,
 	}
@@ -75,18 +73,33 @@ func getClusterConfig(ordinal int, storage Storage, token string) (k3d.Cluster,
 	// nodes
 	clusterConfig.Nodes = []*k3d.Node{}
 
-	serverNode := k3d.Node{
-		Name:       client.GenerateNodeName(clusterConfig.Name, k3d.ServerRole, 0),
-		Role:       k3d.ServerRole,
-		Image:      "rancher/k3s:latest",
-		ServerOpts: k3d.ServerOpts{},
-	}
-
 	// use external storage in control plane if set
-	if isControlPlane(ordinal) {
-		serverNode.Args = convertStorageToNodeArgs(storage, token)
+	useStorage := isControlPlane(ordinal) && storage.Endpoint != ""
+	for i := 0; i < c.Servers; i++ {
+		serverNode := k3d.Node{
+			Name:       client.GenerateNodeName(clusterConfig.Name, k3d.ServerRole, i),
+			Role:       k3d.ServerRole,
+			Image:      c.Image,
+			ServerOpts: k3d.ServerOpts{},
+		}
+		if isControlPlane(ordinal) {
+			serverNode.Args = convertStorageToNodeArgs(storage, token)
+		}
+		serverNode.Args = append(serverNode.Args, c.Args...)
+		// first server node initializes embedded etcd if there are more than one server and no external storage
+		if i == 0 && c.Servers > 1 && !useStorage {
+			serverNode.ServerOpts.IsInit = true
+			clusterConfig.InitNode = &serverNode
+		}
+		clusterConfig.Nodes = append(clusterConfig.Nodes, &serverNode)
+	}
+	for i := 0; i < c.Agents; i++ {
+		clusterConfig.Nodes = append(clusterConfig.Nodes, &k3d.Node{
+			Name:  client.GenerateNodeName(clusterConfig.Name, k3d.AgentRole, i),
+			Role:  k3d.AgentRole,
+			Image: c.Image,
+		})
 	}
-	clusterConfig.Nodes = append(clusterConfig.Nodes, &serverNode)
 
 	return clusterConfig, nil
 }
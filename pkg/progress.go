@@ -0,0 +1,250 @@
+package pkg
+
+import (
+	"bytes"
+	goflag "flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/docker/go-units"
+	"golang.org/x/term"
+	"k8s.io/klog/v2"
+)
+
+const (
+	progressBarWidth    = 30
+	progressBarInterval = 100 * time.Millisecond
+)
+
+// progressBar shows progress of a download on one line of terminal
+type progressBar struct {
+	name    string
+	current int64
+	// total is the size to download, unknown if negative
+	total int64
+	drawn time.Time
+}
+
+// newProgressBar returns nil if stdout is not a terminal, or other views are drawing on it
+func newProgressBar(name string, current, total int64) *progressBar {
+	if !term.IsTerminal(int(os.Stdout.Fd())) || atomic.LoadInt32(&liveViews) > 0 {
+		return nil
+	}
+	return &progressBar{name: name, current: current, total: total}
+}
+
+func (p *progressBar) Write(b []byte) (int, error) {
+	p.current += int64(len(b))
+	if time.Since(p.drawn) >= progressBarInterval {
+		p.draw()
+	}
+	return len(b), nil
+}
+
+func (p *progressBar) draw() {
+	p.drawn = time.Now()
+	size := units.HumanSize(float64(p.current))
+	// \033[K clears the rest of line
+	if p.total <= 0 {
+		fmt.Fprintf(os.Stdout, "\r%s %s\033[K", p.name, size)
+		return
+	}
+	done := int(progressBarWidth * p.current / p.total)
+	if done > progressBarWidth {
+		done = progressBarWidth
+	}
+	fmt.Fprintf(os.Stdout, "\r%s [%s%s] %3d%% %s/%s\033[K", p.name, strings.Repeat("=", done),
+		strings.Repeat(" ", progressBarWidth-done), 100*p.current/p.total, size, units.HumanSize(float64(p.total)))
+}
+
+// finish draws the final progress and ends the line
+func (p *progressBar) finish() {
+	p.draw()
+	fmt.Fprintln(os.Stdout)
+}
+
+// liveViews counts views redrawing lines of terminal, progress bars are hidden meanwhile
+var liveViews int32
+
+var spinnerFrames = []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
+
+// clusterProgress shows the current step of each cluster, as spinner lines on terminal or timestamped lines otherwise
+type clusterProgress struct {
+	mu     sync.Mutex
+	out    io.Writer
+	tty    bool
+	names  []string
+	states map[string]*clusterStep
+	frame  int
+	// lines drawn last time, they are redrawn in place
+	lines int
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+type clusterStep struct {
+	step string
+	// start is zero until the first step, end is zero until finished
+	start time.Time
+	end   time.Time
+	err   error
+}
+
+// newClusterProgress starts showing progress of clusters in order of names
+func newClusterProgress(names []string) *clusterProgress {
+	p := &clusterProgress{
+		out:    os.Stdout,
+		tty:    term.IsTerminal(int(os.Stdout.Fd())),
+		names:  names,
+		states: map[string]*clusterStep{},
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	for _, n := range names {
+		p.states[n] = &clusterStep{step: "waiting"}
+	}
+	if !p.tty {
+		close(p.done)
+		return p
+	}
+	atomic.AddInt32(&liveViews, 1)
+	go func() {
+		defer close(p.done)
+		ticker := time.NewTicker(progressBarInterval)
+		defer ticker.Stop()
+		for {
+			p.mu.Lock()
+			p.draw()
+			p.mu.Unlock()
+			select {
+			case <-ticker.C:
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// update sets the current step of cluster name
+func (p *clusterProgress) update(name, step string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.states[name]
+	if s.start.IsZero() {
+		s.start = time.Now()
+	}
+	s.step = step
+	if !p.tty {
+		fmt.Fprintf(p.out, "%s %s: %s\n", time.Now().Format("15:04:05"), name, step)
+	}
+}
+
+// finish marks cluster name done, or failed with err
+func (p *clusterProgress) finish(name string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.states[name]
+	s.end, s.err = time.Now(), err
+	if !p.tty {
+		fmt.Fprintf(p.out, "%s %s: %s\n", time.Now().Format("15:04:05"), name, s.result())
+	}
+}
+
+// close stops redrawing, the final state stays on terminal
+func (p *clusterProgress) close() {
+	if !p.tty {
+		return
+	}
+	close(p.stop)
+	<-p.done
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.draw()
+	atomic.AddInt32(&liveViews, -1)
+}
+
+func (p *clusterProgress) draw() {
+	if p.lines > 0 {
+		// back to the first line
+		fmt.Fprintf(p.out, "\033[%dA", p.lines)
+	}
+	p.frame = (p.frame + 1) % len(spinnerFrames)
+	for _, n := range p.names {
+		s := p.states[n]
+		mark, text := spinnerFrames[p.frame], s.step
+		switch {
+		case !s.end.IsZero() && s.err != nil:
+			mark, text = "✗", s.result()
+		case !s.end.IsZero():
+			mark, text = "✓", s.result()
+		}
+		if s.start.IsZero() {
+			fmt.Fprintf(p.out, "\r%s %s: %s\033[K\n", mark, n, text)
+			continue
+		}
+		fmt.Fprintf(p.out, "\r%s %s: %s (%s)\033[K\n", mark, n, text, s.elapsed().Round(time.Second))
+	}
+	p.lines = len(p.names)
+}
+
+func (s *clusterStep) elapsed() time.Duration {
+	if s.end.IsZero() {
+		return time.Since(s.start)
+	}
+	return s.end.Sub(s.start)
+}
+
+func (s *clusterStep) result() string {
+	if s.err != nil {
+		return "failed"
+	}
+	return "done"
+}
+
+// capturedLogs holds logs written while a view is drawing, so they don't mess it up
+type capturedLogs struct {
+	buf      bytes.Buffer
+	captured bool
+}
+
+// captureLogs buffers klog output until restore, logs are not captured in debug mode
+func captureLogs() *capturedLogs {
+	c := &capturedLogs{}
+	if debugMode {
+		return c
+	}
+	c.captured = true
+	// logs of all severities are written to INFO output too
+	klog.SetOutputBySeverity("INFO", &c.buf)
+	for _, s := range []string{"WARNING", "ERROR", "FATAL"} {
+		klog.SetOutputBySeverity(s, io.Discard)
+	}
+	klog.LogToStderr(false)
+	// errors are written to stderr as well by default
+	_ = klogFlags().Set("stderrthreshold", "FATAL")
+	return c
+}
+
+// restore writes logs to stderr again, the buffered ones first
+func (c *capturedLogs) restore() {
+	if !c.captured {
+		return
+	}
+	klog.Flush()
+	klog.LogToStderr(true)
+	_ = klogFlags().Set("stderrthreshold", "ERROR")
+	_, _ = os.Stderr.Write(c.buf.Bytes())
+}
+
+// klogFlags are flags of klog, some settings can only be changed with them
+func klogFlags() *goflag.FlagSet {
+	fs := goflag.NewFlagSet("klog", goflag.ContinueOnError)
+	klog.InitFlags(fs)
+	return fs
+}
@@ -0,0 +1,151 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/rancher/k3d/v5/pkg/runtimes"
+	k3d "github.com/rancher/k3d/v5/pkg/types"
+	"golang.org/x/net/http/httpproxy"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/getter"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
+)
+
+// proxySchemes are the schemes of proxy URLs understood by both mvela and k3s
+var proxySchemes = []string{"http", "https", "socks5"}
+
+// clusterNoProxy are accessed directly by nodes: loopback, pod and service networks and domains of k3s
+var clusterNoProxy = []string{"localhost", "127.0.0.1", "10.42.0.0/16", "10.43.0.0/16", ".svc", ".cluster.local"}
+
+func proxySet(s ProxySettings) bool {
+	return s.HTTP != "" || s.HTTPS != "" || len(s.NoProxy) > 0
+}
+
+// proxyFunc returns the Proxy function of http.Transport for s, fallback is used if s is not set
+func proxyFunc(s ProxySettings, fallback func(*http.Request) (*url.URL, error)) func(*http.Request) (*url.URL, error) {
+	if !proxySet(s) {
+		return fallback
+	}
+	proxy := (&httpproxy.Config{HTTPProxy: s.HTTP, HTTPSProxy: s.HTTPS, NoProxy: strings.Join(s.NoProxy, ",")}).ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return proxy(req.URL)
+	}
+}
+
+// directProxy accesses every host directly
+func directProxy(*http.Request) (*url.URL, error) {
+	return nil, nil
+}
+
+// chartHTTPClient downloads charts through proxy.chart, or the proxy in environment if not set
+func chartHTTPClient(p Proxy) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxyFunc(p.Chart, http.ProxyFromEnvironment)
+	return &http.Client{Transport: transport}
+}
+
+// chartGetters are Helm getters whose http(s) one downloads with client, others are Helm's. Each http(s) request
+// times out after timeout, defaultDownloadTimeout if not set.
+func chartGetters(settings *cli.EnvSettings, client *http.Client, timeout time.Duration) getter.Providers {
+	if timeout <= 0 {
+		timeout = defaultDownloadTimeout
+	}
+	httpProvider := getter.Provider{
+		Schemes: []string{"http", "https"},
+		New: func(...getter.Option) (getter.Getter, error) {
+			return httpGetter{client: client, timeout: timeout}, nil
+		},
+	}
+	// ByScheme picks the first provider of a scheme
+	return append(getter.Providers{httpProvider}, getter.All(settings)...)
+}
+
+// httpGetter is a Helm getter with given HTTP client, Helm's one always takes proxy from environment.
+// Getter options are ignored, mvela doesn't pass credentials or TLS settings to getters, and the timeout in them
+// can't be read outside Helm.
+type httpGetter struct {
+	client  *http.Client
+	timeout time.Duration
+}
+
+func (g httpGetter) Get(u string, _ ...getter.Option) (*bytes.Buffer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), g.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &httpStatusError{url: u, code: resp.StatusCode, status: resp.Status}
+	}
+	buf := &bytes.Buffer{}
+	_, err = io.Copy(buf, resp.Body)
+	return buf, err
+}
+
+// setAPIProxy makes c access Kubernetes API through proxy.api, directly if not set.
+// Clusters listen on 0.0.0.0 which is not excluded from the proxy in environment.
+func setAPIProxy(c *rest.Config, p Proxy) *rest.Config {
+	c.Proxy = proxyFunc(p.API, directProxy)
+	return c
+}
+
+// nodeProxyEnv returns environment variables of k3s nodes for proxy.nodes, nil if not set. NO_PROXY is
+// completed with clusterNoProxy and the subnet of k3d network, which is created if absent to know the subnet.
+func nodeProxyEnv(ctx context.Context, s ProxySettings) ([]string, error) {
+	if !proxySet(s) {
+		return nil, nil
+	}
+	subnets, err := k3dNetworkSubnets(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("fail to get subnet of k3d network for NO_PROXY: %w", err)
+	}
+	var env []string
+	if s.HTTP != "" {
+		env = append(env, "HTTP_PROXY="+s.HTTP, "http_proxy="+s.HTTP)
+	}
+	if s.HTTPS != "" {
+		env = append(env, "HTTPS_PROXY="+s.HTTPS, "https_proxy="+s.HTTPS)
+	}
+	var noProxy []string
+	for _, h := range append(append(append([]string{}, clusterNoProxy...), subnets...), s.NoProxy...) {
+		if !contains(noProxy, h) {
+			noProxy = append(noProxy, h)
+		}
+	}
+	klog.Infof("Using NO_PROXY=%s in nodes", strings.Join(noProxy, ","))
+	return append(env, "NO_PROXY="+strings.Join(noProxy, ","), "no_proxy="+strings.Join(noProxy, ",")), nil
+}
+
+// k3dNetworkSubnets creates the docker network shared by all clusters if absent, and returns its subnets
+func k3dNetworkSubnets(ctx context.Context) ([]string, error) {
+	network := k3d.ClusterNetwork{Name: fmt.Sprintf("%s-%s", k3dPrefix, configName)}
+	if _, _, err := runtimes.SelectedRuntime.CreateNetworkIfNotPresent(ctx, &network); err != nil {
+		return nil, err
+	}
+	inspect, err := dockerCli.NetworkInspect(ctx, network.Name, types.NetworkInspectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var subnets []string
+	for _, c := range inspect.IPAM.Config {
+		if c.Subnet != "" {
+			subnets = append(subnets, c.Subnet)
+		}
+	}
+	return subnets, nil
+}
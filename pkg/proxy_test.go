@@ -0,0 +1,69 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"helm.sh/helm/v3/pkg/cli"
+)
+
+func TestHTTPGetterTimeout(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(done)
+
+	g, err := chartGetters(cli.New(), http.DefaultClient, 100*time.Millisecond).ByScheme("http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_, err = g.Get(server.URL + "/values.yaml")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expect deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expect request stopped by timeout, took %s", elapsed)
+	}
+}
+
+func TestProxyFunc(t *testing.T) {
+	fallback := func(*http.Request) (*url.URL, error) { return url.Parse("http://fallback:3128") }
+	cases := []struct {
+		name     string
+		settings ProxySettings
+		target   string
+		want     string
+	}{
+		{name: "fallback if not set", target: "https://charts.io", want: "http://fallback:3128"},
+		{name: "https", settings: ProxySettings{HTTPS: "http://proxy:3128"}, target: "https://charts.io", want: "http://proxy:3128"},
+		{name: "http only", settings: ProxySettings{HTTP: "http://proxy:3128"}, target: "https://charts.io", want: ""},
+		{name: "no proxy", settings: ProxySettings{HTTPS: "http://proxy:3128", NoProxy: []string{".io"}}, target: "https://charts.io", want: ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, c.target, nil)
+			u, err := proxyFunc(c.settings, fallback)(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			if u != nil {
+				got = u.String()
+			}
+			if got != c.want {
+				t.Errorf("expect proxy %q, got %q", c.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apiextensions "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+const (
+	defaultReadyTimeout = 5 * time.Minute
+	// velaCRDGroup is the API group suffix of KubeVela CRDs, like core.oam.dev
+	velaCRDGroup = "oam.dev"
+)
+
+// clusterReadiness checks nodes of a cluster, and KubeVela CRDs and vela-core controllers if it's the control plane
+type clusterReadiness struct {
+	name         string
+	controlPlane bool
+	clientset    kubernetes.Interface
+	extClientset apiextensions.Interface
+}
+
+func newClusterReadiness(cfg Config, ord int) (*clusterReadiness, error) {
+	name := cfg.Clusters[ord].Name
+	config, err := kubeClientGetter(kubeconfigPath(cfg, name), "", cfg.Proxy).ToRESTConfig()
+	if err != nil {
+		return nil, err
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	extClientset, err := apiextensions.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &clusterReadiness{name: name, controlPlane: isControlPlane(ord), clientset: clientset, extClientset: extClientset}, nil
+}
+
+// notReady describes what is not ready in the cluster
+func (c *clusterReadiness) notReady(ctx context.Context) []string {
+	var problems []string
+	nodes, err := c.clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return []string{fmt.Sprintf("fail to list nodes: %v", err)}
+	}
+	if len(nodes.Items) == 0 {
+		problems = append(problems, "no node registered")
+	}
+	for i := range nodes.Items {
+		if ready, msg := nodeReady(&nodes.Items[i]); !ready {
+			problems = append(problems, fmt.Sprintf("node %s is not ready: %s", nodes.Items[i].Name, msg))
+		}
+	}
+	if !c.controlPlane {
+		return problems
+	}
+
+	crds, err := c.extClientset.ApiextensionsV1().CustomResourceDefinitions().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return append(problems, fmt.Sprintf("fail to list CRDs: %v", err))
+	}
+	found := false
+	for i := range crds.Items {
+		crd := &crds.Items[i]
+		if crd.Spec.Group != velaCRDGroup && !strings.HasSuffix(crd.Spec.Group, "."+velaCRDGroup) {
+			continue
+		}
+		found = true
+		if !crdEstablished(crd) {
+			problems = append(problems, fmt.Sprintf("CRD %s is not established", crd.Name))
+		}
+	}
+	if !found {
+		problems = append(problems, "no KubeVela CRD found")
+	}
+
+	deployments, err := c.clientset.AppsV1().Deployments(VelaCoreReleaseNamespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return append(problems, fmt.Sprintf("fail to list deployments: %v", err))
+	}
+	if len(deployments.Items) == 0 {
+		problems = append(problems, "no deployment in "+VelaCoreReleaseNamespace)
+	}
+	for i := range deployments.Items {
+		d := &deployments.Items[i]
+		if !deploymentAvailable(d) {
+			problems = append(problems, fmt.Sprintf("deployment %s/%s has %d/%d replicas available", d.Namespace, d.Name,
+				d.Status.AvailableReplicas, deploymentReplicas(d)))
+		}
+	}
+	return problems
+}
+
+// printPodEvents prints status and events of pods not ready in vela-system of the control plane
+func (c *clusterReadiness) printPodEvents(ctx context.Context, w io.Writer) {
+	if !c.controlPlane {
+		return
+	}
+	pods, err := c.clientset.CoreV1().Pods(VelaCoreReleaseNamespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		klog.ErrorS(err, "Fail to list pods", "cluster", c.name)
+		return
+	}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if podReady(pod) {
+			continue
+		}
+		fmt.Fprintf(w, "Pod %s/%s in %s: %s\n", pod.Namespace, pod.Name, c.name, podStatus(pod))
+		events, err := c.clientset.CoreV1().Events(pod.Namespace).List(ctx, metav1.ListOptions{
+			FieldSelector: fmt.Sprintf("involvedObject.kind=Pod,involvedObject.name=%s", pod.Name),
+		})
+		if err != nil {
+			klog.ErrorS(err, "Fail to list events", "pod", pod.Name)
+			continue
+		}
+		sort.Slice(events.Items, func(i, j int) bool {
+			return events.Items[i].LastTimestamp.Before(&events.Items[j].LastTimestamp)
+		})
+		for _, e := range events.Items {
+			fmt.Fprintf(w, "  %s\t%s\t%s\n", e.Type, e.Reason, strings.TrimSpace(e.Message))
+		}
+	}
+}
+
+// WaitClustersReady waits until nodes of all clusters are ready, KubeVela CRDs are established and deployments in
+// vela-system are available in the control plane. What is not ready and the events of pods not ready are printed to
+// w on timeout.
+func WaitClustersReady(ctx context.Context, cfg Config, timeout time.Duration, w io.Writer) error {
+	var checks []*clusterReadiness
+	for ord := range cfg.Clusters {
+		c, err := newClusterReadiness(cfg, ord)
+		if err != nil {
+			return clusterError(fmt.Errorf("fail to access cluster %s: %w", cfg.Clusters[ord].Name, err))
+		}
+		checks = append(checks, c)
+	}
+	klog.Infof("Waiting for clusters and vela-core to be ready in %s", timeout)
+
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	problems := map[string][]string{}
+	check := func() (bool, error) {
+		ready := true
+		for _, c := range checks {
+			// requests in a check don't outlive the timeout
+			problems[c.name] = c.notReady(waitCtx)
+			ready = ready && len(problems[c.name]) == 0
+		}
+		return ready, nil
+	}
+	if err := wait.PollImmediateUntil(healthPollInterval, check, waitCtx.Done()); err == nil {
+		return nil
+	}
+
+	count := 0
+	for _, c := range checks {
+		for _, p := range problems[c.name] {
+			fmt.Fprintf(w, "%s: %s\n", c.name, p)
+			count++
+		}
+	}
+	for _, c := range checks {
+		c.printPodEvents(ctx, w)
+	}
+	return timeoutError(fmt.Errorf("%d problem(s) remain after waiting %s", count, timeout))
+}
+
+func nodeReady(node *corev1.Node) (bool, string) {
+	for _, c := range node.Status.Conditions {
+		if c.Type == corev1.NodeReady {
+			return c.Status == corev1.ConditionTrue, c.Message
+		}
+	}
+	return false, "no Ready condition"
+}
+
+func podReady(pod *corev1.Pod) bool {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// podStatus is the phase of pod, along with why its containers are waiting or terminated
+func podStatus(pod *corev1.Pod) string {
+	status := string(pod.Status.Phase)
+	for _, cs := range pod.Status.ContainerStatuses {
+		switch {
+		case cs.State.Waiting != nil:
+			status += fmt.Sprintf(", %s %s", cs.Name, cs.State.Waiting.Reason)
+		case cs.State.Terminated != nil:
+			status += fmt.Sprintf(", %s %s", cs.Name, cs.State.Terminated.Reason)
+		}
+		if cs.RestartCount > 0 {
+			status += fmt.Sprintf(" (%d restarts)", cs.RestartCount)
+		}
+	}
+	return status
+}
@@ -0,0 +1,152 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	extfake "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset/fake"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestNodeReady(t *testing.T) {
+	node := func(conditions ...corev1.NodeCondition) *corev1.Node {
+		return &corev1.Node{Status: corev1.NodeStatus{Conditions: conditions}}
+	}
+	cases := []struct {
+		name  string
+		node  *corev1.Node
+		ready bool
+		msg   string
+	}{
+		{name: "ready", node: node(corev1.NodeCondition{Type: corev1.NodeReady, Status: corev1.ConditionTrue, Message: "kubelet is posting ready status"}), ready: true, msg: "kubelet is posting ready status"},
+		{name: "not ready", node: node(corev1.NodeCondition{Type: corev1.NodeReady, Status: corev1.ConditionFalse, Message: "network plugin is not ready"}), msg: "network plugin is not ready"},
+		{name: "no condition", node: node(corev1.NodeCondition{Type: corev1.NodeMemoryPressure, Status: corev1.ConditionFalse}), msg: "no Ready condition"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if ready, msg := nodeReady(c.node); ready != c.ready || msg != c.msg {
+				t.Errorf("expect %v, %q, got %v, %q", c.ready, c.msg, ready, msg)
+			}
+		})
+	}
+}
+
+func TestPodStatus(t *testing.T) {
+	cases := []struct {
+		name     string
+		statuses []corev1.ContainerStatus
+		want     string
+	}{
+		{name: "running", statuses: []corev1.ContainerStatus{{Name: "a", State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}}}, want: "Pending"},
+		{name: "waiting", statuses: []corev1.ContainerStatus{{Name: "a", State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff"}}}}, want: "Pending, a ImagePullBackOff"},
+		{
+			name: "restarted",
+			statuses: []corev1.ContainerStatus{
+				{Name: "a", State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Reason: "Error"}}, RestartCount: 3},
+				{Name: "b", State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}}, RestartCount: 1},
+			},
+			want: "Pending, a Error (3 restarts), b CrashLoopBackOff (1 restarts)",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pod := &corev1.Pod{Status: corev1.PodStatus{Phase: corev1.PodPending, ContainerStatuses: c.statuses}}
+			if got := podStatus(pod); got != c.want {
+				t.Errorf("expect %q, got %q", c.want, got)
+			}
+		})
+	}
+}
+
+func TestNotReady(t *testing.T) {
+	readyNode := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "server-0"},
+		Status:     corev1.NodeStatus{Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}}},
+	}
+	notReadyNode := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "agent-0"}}
+	crd := func(name, group string, established bool) *apiextensionsv1.CustomResourceDefinition {
+		c := &apiextensionsv1.CustomResourceDefinition{ObjectMeta: metav1.ObjectMeta{Name: name}, Spec: apiextensionsv1.CustomResourceDefinitionSpec{Group: group}}
+		if established {
+			c.Status.Conditions = []apiextensionsv1.CustomResourceDefinitionCondition{{Type: apiextensionsv1.Established, Status: apiextensionsv1.ConditionTrue}}
+		}
+		return c
+	}
+	deployment := func(available int32) *appsv1.Deployment {
+		return &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "kubevela-vela-core", Namespace: VelaCoreReleaseNamespace},
+			Status:     appsv1.DeploymentStatus{UpdatedReplicas: available, AvailableReplicas: available},
+		}
+	}
+	cases := []struct {
+		name         string
+		controlPlane bool
+		objects      []runtime.Object
+		crds         []runtime.Object
+		want         []string
+	}{
+		{name: "ready cluster", objects: []runtime.Object{readyNode}, want: nil},
+		{name: "no node", want: []string{"no node registered"}},
+		{name: "node not ready", objects: []runtime.Object{readyNode, notReadyNode}, want: []string{"node agent-0 is not ready: no Ready condition"}},
+		{
+			name:         "ready control plane",
+			controlPlane: true,
+			objects:      []runtime.Object{readyNode, deployment(1)},
+			crds:         []runtime.Object{crd("applications.core.oam.dev", "core.oam.dev", true), crd("other.io", "io", false)},
+			want:         nil,
+		},
+		{
+			name:         "vela-core not ready",
+			controlPlane: true,
+			objects:      []runtime.Object{readyNode, deployment(0)},
+			crds:         []runtime.Object{crd("applications.core.oam.dev", "core.oam.dev", false)},
+			want: []string{
+				"CRD applications.core.oam.dev is not established",
+				"deployment vela-system/kubevela-vela-core has 0/1 replicas available",
+			},
+		},
+		{
+			name:         "vela-core not installed",
+			controlPlane: true,
+			objects:      []runtime.Object{readyNode},
+			want:         []string{"no KubeVela CRD found", "no deployment in vela-system"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := &clusterReadiness{
+				name:         "hub",
+				controlPlane: c.controlPlane,
+				clientset:    fake.NewSimpleClientset(c.objects...),
+				extClientset: extfake.NewSimpleClientset(c.crds...),
+			}
+			if got := r.notReady(context.Background()); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("expect %q, got %q", c.want, got)
+			}
+		})
+	}
+}
+
+func TestPrintPodEvents(t *testing.T) {
+	pending := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "vela-core-0", Namespace: VelaCoreReleaseNamespace},
+		Status:     corev1.PodStatus{Phase: corev1.PodPending},
+	}
+	ready := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "vela-core-1", Namespace: VelaCoreReleaseNamespace},
+		Status:     corev1.PodStatus{Phase: corev1.PodRunning, Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}},
+	}
+	r := &clusterReadiness{name: "hub", controlPlane: true, clientset: fake.NewSimpleClientset(pending, ready)}
+	buf := bytes.Buffer{}
+	r.printPodEvents(context.Background(), &buf)
+	if got := buf.String(); !strings.Contains(got, "Pod vela-system/vela-core-0 in hub: Pending") || strings.Contains(got, "vela-core-1") {
+		t.Errorf("expect only the pod not ready printed, got %q", got)
+	}
+}
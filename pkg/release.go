@@ -0,0 +1,89 @@
+package pkg
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/kyokomi/emoji/v2"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+)
+
+const defaultReleaseNamespace = "default"
+
+// completeRelease fills the release settings left empty with defaults
+func completeRelease(r Release) Release {
+	if r.Namespace == "" {
+		r.Namespace = defaultReleaseNamespace
+	}
+	if r.Chart == "" {
+		r.Chart = r.Name
+	}
+	if r.HelmOpts.Version == "" {
+		r.HelmOpts.Version = VersionStable
+	}
+	return r
+}
+
+// releaseTargets returns the clusters r is installed into, the control plane if no cluster is specified
+func releaseTargets(r Release, clusters []Cluster) ([]Cluster, error) {
+	if len(r.Clusters) == 0 && r.ClusterSelector == "" {
+		return clusters[:1], nil
+	}
+	selector := labels.Nothing()
+	if r.ClusterSelector != "" {
+		var err error
+		if selector, err = labels.Parse(r.ClusterSelector); err != nil {
+			return nil, fmt.Errorf("invalid clusterSelector of release %s: %w", r.Name, err)
+		}
+	}
+	var targets []Cluster
+	for _, c := range clusters {
+		if contains(r.Clusters, c.Name) || selector.Matches(labels.Set(c.Labels)) {
+			targets = append(targets, c)
+		}
+	}
+	return targets, nil
+}
+
+// InstallReleases installs or upgrades releases in cfg into their target clusters, it goes on if one fails.
+// Errors of the failed ones are returned in order.
+func InstallReleases(cfg Config) []error {
+	var errs []error
+	for _, r := range cfg.Releases {
+		targets, err := releaseTargets(r, cfg.Clusters)
+		if err != nil {
+			errs = append(errs, chartError(fmt.Errorf("release %s/%s: %w", r.Namespace, r.Name, err)))
+			continue
+		}
+		if len(targets) == 0 {
+			klog.Warningf("No cluster matches release %s", r.Name)
+		}
+		for _, c := range targets {
+			klog.Infof("Installing release %s/%s into cluster %s", r.Namespace, r.Name, c.Name)
+			if err = InstallRelease(kubeconfigPath(cfg, c.Name), r, cfg.Proxy); err != nil {
+				errs = append(errs, chartError(fmt.Errorf("release %s/%s in cluster %s: %w", r.Namespace, r.Name, c.Name, err)))
+				continue
+			}
+			klog.Infof("Successfully installed release %s into cluster %s", r.Name, c.Name)
+		}
+	}
+	return errs
+}
+
+// printReleaseErrors lists errs of releases failed to install
+func printReleaseErrors(w io.Writer, errs []error) {
+	emoji.Fprintf(w, ":x: %d release(s) failed to install\n", len(errs))
+	for _, err := range errs {
+		fmt.Fprintf(w, "  %v\n", err)
+	}
+}
+
+// releaseErrors is the error of releases failed to install by command, with the exit code of the first one
+func releaseErrors(errs []error, command string) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return withCode(exitCodeOf(errs[0]), fmt.Errorf("%d release(s) failed to install, run `mvela %s` again to retry, first: %w", len(errs), command, errs[0]))
+}
@@ -0,0 +1,89 @@
+package pkg
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompleteRelease(t *testing.T) {
+	got := completeRelease(Release{Name: "a"})
+	if got.Namespace != defaultReleaseNamespace || got.Chart != "a" || got.HelmOpts.Version != VersionStable {
+		t.Errorf("expect defaults filled, got %+v", got)
+	}
+	r := Release{Name: "a", Namespace: "n", Chart: "c", HelmOpts: HelmOpts{Version: "~1.0"}}
+	if got = completeRelease(r); !reflect.DeepEqual(got, r) {
+		t.Errorf("expect settings kept, got %+v", got)
+	}
+}
+
+func TestReleaseTargets(t *testing.T) {
+	clusters := []Cluster{{Name: "hub"}, {Name: "edge-1", Labels: map[string]string{"region": "eu"}}, {Name: "edge-2"}}
+	cases := []struct {
+		name    string
+		release Release
+		want    []string
+		fail    bool
+	}{
+		{name: "control plane by default", release: Release{Name: "a"}, want: []string{"hub"}},
+		{name: "by name", release: Release{Name: "a", Clusters: []string{"edge-2"}}, want: []string{"edge-2"}},
+		{name: "by selector", release: Release{Name: "a", ClusterSelector: "region=eu"}, want: []string{"edge-1"}},
+		{name: "name or selector", release: Release{Name: "a", Clusters: []string{"hub"}, ClusterSelector: "region"}, want: []string{"hub", "edge-1"}},
+		{name: "invalid selector", release: Release{Name: "a", ClusterSelector: "region in eu"}, fail: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			targets, err := releaseTargets(c.release, clusters)
+			if c.fail {
+				if err == nil {
+					t.Fatal("expect an error")
+				}
+				return
+			}
+			got := []string{}
+			for _, cluster := range targets {
+				got = append(got, cluster.Name)
+			}
+			if err != nil || !equalStrings(got, c.want) {
+				t.Errorf("expect %v, got %v, %v", c.want, got, err)
+			}
+		})
+	}
+}
+
+func TestInstallReleasesErrors(t *testing.T) {
+	cfg := Config{
+		Clusters: []Cluster{{Name: "hub"}},
+		Releases: []Release{
+			{Name: "a", Namespace: "default", ClusterSelector: "region in eu"},
+			{Name: "b", Namespace: "default", ClusterSelector: "region=us"},
+		},
+	}
+	errs := InstallReleases(cfg)
+	if len(errs) != 1 || exitCodeOf(errs[0]) != ExitChart || !strings.HasPrefix(errs[0].Error(), "release default/a: invalid clusterSelector") {
+		t.Fatalf("expect the error of release a, got %v", errs)
+	}
+
+	var buf bytes.Buffer
+	printReleaseErrors(&buf, errs)
+	if !strings.Contains(buf.String(), "1 release(s) failed to install\n  release default/a: ") {
+		t.Errorf("expect failed releases listed, got %q", buf.String())
+	}
+}
+
+func TestReleaseErrors(t *testing.T) {
+	if err := releaseErrors(nil, "apply"); err != nil {
+		t.Errorf("expect no error, got %v", err)
+	}
+	cause := errors.New("connection refused")
+	errs := []error{chartError(cause), errors.New("oops")}
+	err := releaseErrors(errs, "apply")
+	if want := "2 release(s) failed to install, run `mvela apply` again to retry, first: connection refused"; err == nil || err.Error() != want {
+		t.Fatalf("expect %q, got %v", want, err)
+	}
+	if !errors.Is(err, cause) || exitCodeOf(err) != ExitChart {
+		t.Errorf("expect the first error wrapped with its exit code, got %v", err)
+	}
+}
@@ -0,0 +1,113 @@
+// Schema of mvela configuration file. CUE config files are unified with the
+// definition matching their apiVersion. Defaults are not set here, they are
+// filled by mvela like for YAML files.
+
+#V1alpha1: {
+	apiVersion:      "mvela.oam.dev/v1alpha1"
+	kind?:           "Simple"
+	managedCluster?: int & >=0
+	kubeconfigOpts?: #KubeconfigOpts
+	helmOpts?:       #HelmOpts
+	registries?:     #Registries
+	storage?:        #Storage
+	token?:          string | #SecretRef
+}
+
+#V1alpha2: {
+	apiVersion: "mvela.oam.dev/v1alpha2"
+	kind?:      "Simple"
+	clusters?: [...#Cluster]
+	kubeconfigOpts?: #KubeconfigOpts
+	helmOpts?:       #HelmOptsV1alpha2
+	registries?:     #Registries
+	storage?:        #Storage
+	token?:          string | #SecretRef
+	proxy?:          #Proxy
+	releases?: [...#Release]
+}
+
+#Cluster: {
+	name?:    =~"^[a-z0-9]([-a-z0-9]{0,30}[a-z0-9])?$"
+	image?:   string
+	servers?: int & >=0
+	agents?:  int & >=0
+	args?: [...string]
+	labels?: [string]: string
+	apiPort?: int & >=0 & <=65535
+}
+
+#KubeconfigOpts: {
+	output?: string
+}
+
+#HelmOpts: {
+	type?:      "local" | "url" | "repo" | "oci"
+	chartPath?: string
+	version?:   string
+}
+
+#HelmOptsV1alpha2: {
+	#HelmOpts
+	values?: {...}
+	valuesFiles?: [...string]
+	set?: [...string]
+	verify?:  bool
+	keyring?: string
+	mirrors?: [...=~"^https?://"]
+	downloadTimeout?:  string
+	downloadAttempts?: int & >=0
+}
+
+#Storage: {
+	endpoint?:  =~"^(mysql|postgres|postgresql|http|https)://" | #SecretRef
+	ca_file?:   string
+	cert_file?: string
+	key_file?:  string
+}
+
+#Registries: {
+	mirrors?: [string]: {
+		endpoint: [...=~"^https?://"]
+	}
+	configs?: [string]: {
+		auth?: #Auth
+		tls?: {
+			ca_file?:              string
+			cert_file?:            string
+			key_file?:             string
+			insecure_skip_verify?: bool
+		}
+	}
+	auths?: [string]: #Auth
+}
+
+#Release: {
+	name:             string
+	namespace?:       string
+	chart?:           string
+	helmOpts?:        #HelmOptsV1alpha2
+	clusters?:        [...string]
+	clusterSelector?: string
+}
+
+#Proxy: {
+	chart?: #ProxySettings
+	nodes?: #ProxySettings
+	api?:   #ProxySettings
+}
+
+#ProxySettings: {
+	http?:  =~"^(http|https|socks5)://"
+	https?: =~"^(http|https|socks5)://"
+	noProxy?: [...string]
+}
+
+#Auth: {
+	username?:       string
+	password?:       string | #SecretRef
+	auth?:           string
+	identity_token?: string
+}
+
+// #SecretRef keeps a secret out of the config file
+#SecretRef: {fromFile: string} | {fromEnv: string} | {fromCommand: string}
@@ -0,0 +1,263 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	"k8s.io/klog/v2"
+)
+
+const secretCommandTimeout = 30 * time.Second
+
+// secretFields are fields accepting secret references, map keys are written as [*]
+var secretFields = []string{
+	"token",
+	"storage.endpoint",
+	"registries.configs[*].auth.password",
+	"registries.auths[*].password",
+}
+
+var (
+	mapKeyRegexp    = regexp.MustCompile(`\[[^\]]*\]`)
+	typeOfSecretRef = reflect.TypeOf(secretRef{})
+)
+
+// secretRef refers to a secret kept out of config file, only one of the fields can be set
+type secretRef struct {
+	FromFile    string `yaml:"fromFile"`
+	FromEnv     string `yaml:"fromEnv"`
+	FromCommand string `yaml:"fromCommand"`
+	// line of the reference in config file
+	line int
+}
+
+// secretRefs are secret references in config by field path, they are resolved by resolveSecrets
+type secretRefs map[string]secretRef
+
+// String is the reference as written in config file, it's the value of the field until resolved
+func (r secretRef) String() string {
+	switch {
+	case r.FromFile != "":
+		return fmt.Sprintf("{fromFile: %s}", r.FromFile)
+	case r.FromEnv != "":
+		return fmt.Sprintf("{fromEnv: %s}", r.FromEnv)
+	default:
+		return fmt.Sprintf("{fromCommand: %s}", r.FromCommand)
+	}
+}
+
+func acceptSecretRef(field string) bool {
+	return contains(secretFields, mapKeyRegexp.ReplaceAllString(field, "[*]"))
+}
+
+// resolve returns the secret, the error never contains it
+func (r secretRef) resolve() (string, error) {
+	switch {
+	case r.FromFile != "":
+		file, err := expandHome(r.FromFile)
+		if err != nil {
+			return "", err
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("fail to read secret file: %w", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case r.FromEnv != "":
+		value, ok := os.LookupEnv(r.FromEnv)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", r.FromEnv)
+		}
+		return value, nil
+	default:
+		ctx, cancel := context.WithTimeout(context.Background(), secretCommandTimeout)
+		defer cancel()
+		stderr := bytes.Buffer{}
+		cmd := exec.CommandContext(ctx, "sh", "-c", r.FromCommand)
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("fail to run secret command: %w: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		return strings.TrimRight(string(out), "\r\n"), nil
+	}
+}
+
+// takeSecretRef checks the secret reference in node and takes it into refs, node is replaced with the reference
+// as a string. The secret isn't resolved here, so reading config never runs commands.
+func takeSecretRef(node *yaml.Node, field string, lines fieldLines, refs secretRefs, errs *FieldErrors) {
+	var refErrs FieldErrors
+	checkNode(node, typeOfSecretRef, field, fieldLines{}, nil, &refErrs)
+	if len(refErrs) != 0 {
+		*errs = append(*errs, lines.errorf(field, "invalid secret reference: %s", refErrs[0].Detail))
+		return
+	}
+	ref := secretRef{}
+	if err := node.Decode(&ref); err != nil {
+		*errs = append(*errs, lines.errorf(field, "invalid secret reference: %v", err))
+		return
+	}
+	set := 0
+	for _, s := range []string{ref.FromFile, ref.FromEnv, ref.FromCommand} {
+		if s != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		*errs = append(*errs, lines.errorf(field, "secret reference needs exactly one of fromFile, fromEnv and fromCommand"))
+		return
+	}
+	ref.line = node.Line
+	refs[field] = ref
+	*node = yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: ref.String(), Line: node.Line, Column: node.Column}
+}
+
+// registryPasswordRegexp matches the fields of registry passwords, the registry is captured
+var registryPasswordRegexp = regexp.MustCompile(`^registries\.(configs|auths)\[(.*)\](\.auth)?\.password$`)
+
+// resolveSecrets resolves the secret references in c and sets the secrets to their fields. It's called by commands
+// which need the secrets only, as the references may run commands.
+func resolveSecrets(c *Config) error {
+	var errs FieldErrors
+	for field, ref := range c.SecretRefs {
+		lines := fieldLines{field: ref.line}
+		secret, err := ref.resolve()
+		if err != nil {
+			errs = append(errs, lines.errorf(field, "%v", err))
+			continue
+		}
+		if err = setSecret(c, field, secret); err != nil {
+			errs = append(errs, lines.errorf(field, "%v", err))
+			continue
+		}
+		if field == "storage.endpoint" {
+			errs = append(errs, validateStorage(c.Storage, false, lines)...)
+		}
+	}
+	if len(errs) != 0 {
+		sortFieldErrors(errs)
+		return fmt.Errorf("fail to resolve secrets of config file %s: %w", c.File, errs)
+	}
+	c.SecretRefs = nil
+	return nil
+}
+
+// setSecret sets secret to field of c, field is one of secretFields
+func setSecret(c *Config, field, secret string) error {
+	switch field {
+	case "token":
+		c.Token = secret
+		return nil
+	case "storage.endpoint":
+		c.Storage.Endpoint = secret
+		return nil
+	}
+	m := registryPasswordRegexp.FindStringSubmatch(field)
+	if m == nil {
+		return fmt.Errorf("secret reference isn't supported")
+	}
+	if m[1] == "configs" {
+		if rc, ok := c.Registries.Configs[m[2]]; ok && rc.Auth != nil {
+			auth := *rc.Auth
+			auth.Password = secret
+			rc.Auth = &auth
+			c.Registries.Configs[m[2]] = rc
+			return nil
+		}
+	} else if auth, ok := c.Registries.Auths[m[2]]; ok {
+		auth.Password = secret
+		c.Registries.Auths[m[2]] = auth
+		return nil
+	}
+	return fmt.Errorf("registry %s isn't configured", m[2])
+}
+
+// tokenFile keeps the token generated for external storage
+func tokenFile() string {
+	return path.Join(VelaDir(), "token")
+}
+
+// tokenPending is shown in place of the token for external storage before create or apply generates it
+const tokenPending = "(generated on create)"
+
+// readToken returns the token generated before, empty if there is none
+func readToken() (string, error) {
+	data, err := os.ReadFile(tokenFile())
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("fail to read token file: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// ensureToken generates the token for external storage if cfg needs one but has none, it's kept for later runs
+func ensureToken(cfg *Config) error {
+	if cfg.Storage.Endpoint == "" || cfg.Token != "" {
+		return nil
+	}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Errorf("fail to generate token: %w", err)
+	}
+	token := hex.EncodeToString(buf)
+	if err := os.MkdirAll(VelaDir(), 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(tokenFile(), []byte(token+"\n"), 0o600); err != nil {
+		return fmt.Errorf("fail to save token: %w", err)
+	}
+	klog.Infof("No token for external storage, generated one and saved to %s", tokenFile())
+	cfg.Token = token
+	return nil
+}
+
+// hashKeyFile keeps the key of hashing secrets into labels, so they can't be guessed from the labels
+func hashKeyFile() string {
+	return path.Join(VelaDir(), "hash-key")
+}
+
+// readHashKey returns the key of hashing secrets, nil if there is none
+func readHashKey() ([]byte, error) {
+	data, err := os.ReadFile(hashKeyFile())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("fail to read hash key file: %w", err)
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid hash key file %s: %w", hashKeyFile(), err)
+	}
+	return key, nil
+}
+
+// ensureHashKey generates the key of hashing secrets if there is none, it's kept for later runs
+func ensureHashKey() error {
+	if _, err := os.Stat(hashKeyFile()); err == nil {
+		return nil
+	}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Errorf("fail to generate hash key: %w", err)
+	}
+	if err := os.MkdirAll(VelaDir(), 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(hashKeyFile(), []byte(hex.EncodeToString(buf)+"\n"), 0o600); err != nil {
+		return fmt.Errorf("fail to save hash key: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package pkg
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestAcceptSecretRef(t *testing.T) {
+	for field, want := range map[string]bool{
+		"token":                                  true,
+		"storage.endpoint":                       true,
+		"registries.configs[r.io].auth.password": true,
+		"registries.auths[r.io].password":        true,
+		"registries.configs[r.io].auth.username": false,
+		"storage.ca_file":                        false,
+		"helmOpts.version":                       false,
+	} {
+		if got := acceptSecretRef(field); got != want {
+			t.Errorf("%s: expect %v, got %v", field, want, got)
+		}
+	}
+}
+
+func TestResolveSecretRef(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := path.Join(dir, "token")
+	if err := os.WriteFile(secretFile, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	setEnv(t, "MVELA_TEST_SECRET", "from-env")
+
+	cases := []struct {
+		name  string
+		token string
+		want  string
+		// err is part of the expected error of decoding, empty if none
+		err string
+		// resolveErr is part of the expected error of resolving, empty if none
+		resolveErr string
+	}{
+		{name: "plain", token: "plain", want: "plain"},
+		{name: "file", token: "{fromFile: " + secretFile + "}", want: "from-file"},
+		{name: "env", token: "{fromEnv: MVELA_TEST_SECRET}", want: "from-env"},
+		{name: "command", token: "{fromCommand: echo from-command}", want: "from-command"},
+		{name: "missing file", token: "{fromFile: " + path.Join(dir, "none") + "}", resolveErr: "line 1: token: fail to read secret file"},
+		{name: "missing env", token: "{fromEnv: MVELA_TEST_NO_SECRET}", resolveErr: "environment variable MVELA_TEST_NO_SECRET is not set"},
+		{name: "failed command", token: "{fromCommand: 'echo oops >&2; exit 1'}", resolveErr: "fail to run secret command: exit status 1: oops"},
+		{name: "two sources", token: "{fromEnv: A, fromFile: b}", err: "needs exactly one of fromFile, fromEnv and fromCommand"},
+		{name: "unknown source", token: "{fromVault: a}", err: "invalid secret reference: unknown field"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := Config{}
+			_, err := decodeConfig([]byte("token: "+c.token+"\n"), &cfg)
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("expect error %q, got %v", c.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			err = resolveSecrets(&cfg)
+			if c.resolveErr != "" {
+				if err == nil || !strings.Contains(err.Error(), c.resolveErr) {
+					t.Fatalf("expect error %q, got %v", c.resolveErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if cfg.Token != c.want {
+				t.Errorf("expect token %q, got %q", c.want, cfg.Token)
+			}
+		})
+	}
+}
+
+func TestSecretRefNotResolvedOnDecode(t *testing.T) {
+	marker := path.Join(t.TempDir(), "run")
+	cfg := Config{Kind: KindSimple}
+	data := "storage:\n  endpoint: {fromCommand: touch " + marker + "; echo redis://db}\n"
+	if _, err := decodeConfig([]byte(data), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(marker); !os.IsNotExist(err) {
+		t.Fatalf("expect the command not run, got %v", err)
+	}
+	if want := "{fromCommand: touch " + marker + "; echo redis://db}"; cfg.Storage.Endpoint != want {
+		t.Errorf("expect the reference as endpoint, got %q", cfg.Storage.Endpoint)
+	}
+	if errs := validateConfig(CompleteConfig(cfg), fieldLines{}); len(errs) != 0 {
+		t.Errorf("expect the endpoint checked after resolved, got %v", errs)
+	}
+	err := resolveSecrets(&cfg)
+	if err == nil || !strings.Contains(err.Error(), "line 2: storage.endpoint: unsupported datastore endpoint") {
+		t.Errorf("expect the resolved endpoint checked, got %v", err)
+	}
+	if _, err = os.Stat(marker); err != nil {
+		t.Errorf("expect the command run, got %v", err)
+	}
+}
+
+func TestResolveRegistrySecrets(t *testing.T) {
+	setEnv(t, "MVELA_TEST_SECRET", "pass")
+	data := `registries:
+  configs:
+    r.io:
+      auth: {username: u, password: {fromEnv: MVELA_TEST_SECRET}}
+  auths:
+    s.io: {username: u, password: {fromEnv: MVELA_TEST_SECRET}}
+`
+	cfg := Config{}
+	if _, err := decodeConfig([]byte(data), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := resolveSecrets(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.Registries.Configs["r.io"].Auth.Password; got != "pass" {
+		t.Errorf("expect password of r.io resolved, got %q", got)
+	}
+	if got := cfg.Registries.Auths["s.io"].Password; got != "pass" {
+		t.Errorf("expect password of s.io resolved, got %q", got)
+	}
+	if len(cfg.SecretRefs) != 0 {
+		t.Errorf("expect no reference left, got %v", cfg.SecretRefs)
+	}
+}
+
+func TestSecretRefOverriddenByEnv(t *testing.T) {
+	setEnv(t, "MVELA_TOKEN", "from-env")
+	cfg := Config{}
+	if _, err := decodeConfig([]byte("token: {fromCommand: exit 1}\n"), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if _, errs := applyEnv(&cfg); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	if err := resolveSecrets(&cfg); err != nil || cfg.Token != "from-env" {
+		t.Errorf("expect token from env, got %q, %v", cfg.Token, err)
+	}
+}
+
+func TestSecretRefNotAccepted(t *testing.T) {
+	_, err := decodeConfig([]byte("helmOpts:\n  version: {fromEnv: VERSION}\n"), &Config{})
+	if err == nil || !strings.Contains(err.Error(), "helmOpts.version: expect a value of type string") {
+		t.Errorf("expect type error of helmOpts.version, got %v", err)
+	}
+}
+
+func TestEnsureToken(t *testing.T) {
+	old := velaDir
+	velaDir = t.TempDir()
+	defer func() { velaDir = old }()
+
+	token, err := readToken()
+	if err != nil || token != "" {
+		t.Fatalf("expect no token, got %q, %v", token, err)
+	}
+	cfg := Config{}
+	if err = ensureToken(&cfg); err != nil || cfg.Token != "" {
+		t.Fatalf("expect no token without storage, got %q, %v", cfg.Token, err)
+	}
+	if _, err = os.Stat(tokenFile()); !os.IsNotExist(err) {
+		t.Fatalf("expect no token file without storage, got %v", err)
+	}
+
+	cfg.Storage.Endpoint = "mysql://db"
+	if err = ensureToken(&cfg); err != nil || len(cfg.Token) != 64 {
+		t.Fatalf("expect a generated token, got %q, %v", cfg.Token, err)
+	}
+	if token, err = readToken(); err != nil || token != cfg.Token {
+		t.Errorf("expect token %q kept, got %q, %v", cfg.Token, token, err)
+	}
+
+	cfg.Token = "set"
+	if err = ensureToken(&cfg); err != nil || cfg.Token != "set" {
+		t.Errorf("expect token in config kept, got %q, %v", cfg.Token, err)
+	}
+}
+
+func TestEnsureHashKey(t *testing.T) {
+	old := velaDir
+	velaDir = t.TempDir()
+	defer func() { velaDir = old }()
+
+	key, err := readHashKey()
+	if err != nil || key != nil {
+		t.Fatalf("expect no hash key, got %x, %v", key, err)
+	}
+	if err = ensureHashKey(); err != nil {
+		t.Fatal(err)
+	}
+	if key, err = readHashKey(); err != nil || len(key) != 32 {
+		t.Fatalf("expect a generated hash key, got %x, %v", key, err)
+	}
+	if info, err := os.Stat(hashKeyFile()); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("expect hash key file only readable by the owner, got %v", info)
+	}
+	if err = ensureHashKey(); err != nil {
+		t.Fatal(err)
+	}
+	if again, err := readHashKey(); err != nil || string(again) != string(key) {
+		t.Errorf("expect hash key kept, got %x, %v", again, err)
+	}
+
+	if err = os.WriteFile(hashKeyFile(), []byte("not hex\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = readHashKey(); err == nil || !strings.Contains(err.Error(), "invalid hash key file") {
+		t.Errorf("expect invalid hash key error, got %v", err)
+	}
+}
@@ -0,0 +1,385 @@
+package pkg
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	config "github.com/rancher/k3d/v5/pkg/config/v1alpha4"
+	k3d "github.com/rancher/k3d/v5/pkg/types"
+	"github.com/rancher/k3d/v5/pkg/types/k3s"
+	"gopkg.in/yaml.v3"
+	"k8s.io/klog/v2"
+)
+
+// Labels of node containers marking the clusters created by mvela, along with the config file they're created from
+const (
+	managedLabel    = "mvela.managed"
+	configFileLabel = "mvela.config-file"
+)
+
+// proxyEnvNames are environment variables of nodes set by proxy.nodes
+var proxyEnvNames = []string{"HTTP_PROXY", "http_proxy", "HTTPS_PROXY", "https_proxy", "NO_PROXY", "no_proxy"}
+
+// secretArgPrefixes are k3s arguments carrying secrets, their values are masked when printed
+var secretArgPrefixes = []string{"--token=", "--datastore-endpoint="}
+
+// clusterState is the settings of a cluster that can't be changed without recreating it. It's either derived from
+// config or observed from the node containers of a running cluster.
+type clusterState struct {
+	Name    string
+	Image   string
+	Servers int
+	Agents  int
+	APIPort int
+	// Args are k3s arguments of the first server node, storage arguments included
+	Args []string
+	// Labels are the labels in config, labels of running clusters have the ones of k3d and images too
+	Labels map[string]string
+	// Env are proxy environment variables of nodes
+	Env        []string
+	Registries k3s.Registry
+	// Hashes are hashes of settings by field, recorded in labels of running clusters, see settingsHashLabels
+	Hashes map[string]string
+}
+
+// fieldDiff is a setting differs between config and the running environment
+type fieldDiff struct {
+	Field string
+	// Want is the value in config, Got is the running one
+	Want string
+	Got  string
+}
+
+func (d fieldDiff) String() string {
+	return fmt.Sprintf("%s: %s -> %s", d.Field, d.Got, d.Want)
+}
+
+// desiredClusterState is the state of the cluster run with r, labels are the ones in config
+func desiredClusterState(r config.ClusterConfig, labels map[string]string) clusterState {
+	s := clusterState{
+		Name:   r.Cluster.Name,
+		Labels: labels,
+		Env:    proxyEnv(r.ClusterCreateOpts.GlobalEnv),
+		Hashes: recordedHashes(r.ClusterCreateOpts.GlobalLabels),
+	}
+	if r.Cluster.KubeAPI != nil {
+		s.APIPort, _ = strconv.Atoi(r.Cluster.KubeAPI.Binding.HostPort)
+	}
+	for _, n := range r.Cluster.Nodes {
+		switch n.Role {
+		case k3d.ServerRole:
+			if s.Servers == 0 {
+				s.Image = n.Image
+				s.Args = append([]string{}, n.Args...)
+			}
+			s.Servers++
+		case k3d.AgentRole:
+			s.Agents++
+		}
+	}
+	if r.ClusterCreateOpts.Registries.Config != nil {
+		s.Registries = *r.ClusterCreateOpts.Registries.Config
+	}
+	return s
+}
+
+// observeEnvironment returns states of running clusters created by mvela, and run configs of the clusters in cfg
+// to compare with. Nothing is changed.
+func observeEnvironment(ctx context.Context, cfg Config) (map[string]*clusterState, []config.ClusterConfig, error) {
+	running, err := observeClusters(ctx, cfg)
+	if err != nil {
+		return nil, nil, clusterError(err)
+	}
+	if s, ok := running[cfg.Clusters[0].Name]; ok {
+		if err = observeChartHash(ctx, cfg, s); err != nil {
+			klog.Warningf("Fail to get chart hash recorded in %s: %v", s.Name, err)
+		}
+	}
+	var nodeEnv []string
+	// the docker network exists along with clusters, it's not created here
+	if len(running) > 0 {
+		if nodeEnv, err = nodeProxyEnv(ctx, cfg.Proxy.Nodes); err != nil {
+			return nil, nil, err
+		}
+	}
+	if cfg.Storage.Endpoint != "" && cfg.Token == "" {
+		// the token is not generated yet, a running control plane has another one
+		cfg.Token = tokenPending
+	}
+	runConfigs, err := GetClusterRunConfig(cfg, nodeEnv)
+	if err != nil {
+		return nil, nil, configError(err)
+	}
+	return running, runConfigs, nil
+}
+
+// ownerLabels are the labels of nodes of clusters created with cfg
+func ownerLabels(cfg Config) map[string]string {
+	return map[string]string{managedLabel: "true", configFileLabel: configFileID(cfg)}
+}
+
+// configFileID is the absolute path of the config file of cfg, empty if it's not read from a file
+func configFileID(cfg Config) string {
+	if cfg.File == "" {
+		return ""
+	}
+	if abs, err := filepath.Abs(cfg.File); err == nil {
+		return abs
+	}
+	return cfg.File
+}
+
+// ownsCluster tells if the running cluster of name, whose nodes have labels, belongs to the environment of cfg: it's
+// created by mvela, and either declared in cfg or created from the same config file. Clusters created before nodes
+// are labeled have no owner labels, they're matched by name like before: declared in cfg or named like mvela-cluster.
+func ownsCluster(cfg Config, name string, labels map[string]string) bool {
+	switch {
+	case labels[upgradeTestLabel] == "true":
+		return false
+	case labels[managedLabel] == "true":
+		return clusterOrdinal(cfg, name) >= 0 || labels[configFileLabel] == configFileID(cfg)
+	case labels[managedLabel] == "":
+		return clusterOrdinal(cfg, name) >= 0 || strings.Contains(name, "mvela-cluster")
+	}
+	return false
+}
+
+// observeClusters returns states of running clusters of the environment of cfg by name, see ownsCluster
+func observeClusters(ctx context.Context, cfg Config) (map[string]*clusterState, error) {
+	containers, err := dockerCli.ContainerList(ctx, types.ContainerListOptions{
+		All: true,
+		// clusters without owner labels are matched by name, see ownsCluster
+		Filters: filters.NewArgs(filters.Arg("label", k3d.LabelClusterName)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fail to list node containers: %w", err)
+	}
+	sort.Slice(containers, func(i, j int) bool { return containerName(containers[i]) < containerName(containers[j]) })
+
+	states := map[string]*clusterState{}
+	for _, c := range containers {
+		name := c.Labels[k3d.LabelClusterName]
+		if !ownsCluster(cfg, name, c.Labels) {
+			continue
+		}
+		s, ok := states[name]
+		if !ok {
+			s = &clusterState{Name: name}
+			states[name] = s
+		}
+		switch k3d.Role(c.Labels[k3d.LabelRole]) {
+		case k3d.ServerRole:
+			if s.Servers == 0 {
+				if err = observeServer(ctx, c.ID, s); err != nil {
+					return nil, fmt.Errorf("fail to inspect cluster %s: %w", name, err)
+				}
+			}
+			s.Servers++
+		case k3d.AgentRole:
+			s.Agents++
+		}
+	}
+	return states, nil
+}
+
+func containerName(c types.Container) string {
+	if len(c.Names) == 0 {
+		return c.ID
+	}
+	return strings.TrimPrefix(c.Names[0], "/")
+}
+
+// observeServer fills s with the settings of the server node container id
+func observeServer(ctx context.Context, id string, s *clusterState) error {
+	inspect, err := dockerCli.ContainerInspect(ctx, id)
+	if err != nil {
+		return err
+	}
+	s.Image = inspect.Config.Image
+	s.Args = k3sArgs(inspect.Args)
+	s.Labels = inspect.Config.Labels
+	s.Hashes = recordedHashes(inspect.Config.Labels)
+	s.Env = proxyEnv(inspect.Config.Env)
+	s.APIPort, _ = strconv.Atoi(inspect.Config.Labels[k3d.LabelServerAPIPort])
+	s.Registries, err = readRegistries(ctx, id)
+	return err
+}
+
+// k3sArgs are the arguments of k3s server in container args, the ones added by k3d are dropped
+func k3sArgs(args []string) []string {
+	for i, a := range args {
+		if a == string(k3d.ServerRole) {
+			args = args[i+1:]
+			break
+		}
+	}
+	res := []string{}
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--tls-san", "--node-label":
+			i++
+		case "--cluster-init":
+		default:
+			res = append(res, args[i])
+		}
+	}
+	return res
+}
+
+// proxyEnv are the proxy variables in env
+func proxyEnv(env []string) []string {
+	res := []string{}
+	for _, e := range env {
+		if contains(proxyEnvNames, strings.SplitN(e, "=", 2)[0]) {
+			res = append(res, e)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// readRegistries reads registries.yaml k3d writes into the node container id, it's empty if not found
+func readRegistries(ctx context.Context, id string) (k3s.Registry, error) {
+	r := k3s.Registry{}
+	reader, _, err := dockerCli.CopyFromContainer(ctx, id, k3d.DefaultRegistriesFilePath)
+	if client.IsErrNotFound(err) {
+		return r, nil
+	} else if err != nil {
+		return r, err
+	}
+	defer reader.Close()
+	tr := tar.NewReader(reader)
+	if _, err = tr.Next(); err != nil {
+		return r, err
+	}
+	data, err := io.ReadAll(tr)
+	if err != nil {
+		return r, err
+	}
+	return r, yaml.Unmarshal(data, &r)
+}
+
+// diffClusterState compares the state in config with the running one, secrets are masked in the result
+func diffClusterState(want, got clusterState) []fieldDiff {
+	var diffs []fieldDiff
+	add := func(field string, w, g interface{}) {
+		if ws, gs := fmt.Sprint(w), fmt.Sprint(g); ws != gs {
+			diffs = append(diffs, fieldDiff{Field: field, Want: ws, Got: gs})
+		}
+	}
+	add("image", want.Image, got.Image)
+	add("servers", want.Servers, got.Servers)
+	add("agents", want.Agents, got.Agents)
+	add("apiPort", want.APIPort, got.APIPort)
+	if w, g := strings.Join(want.Args, " "), strings.Join(got.Args, " "); w != g {
+		d := fieldDiff{Field: "args", Want: strings.Join(maskArgs(want.Args), " "), Got: strings.Join(maskArgs(got.Args), " ")}
+		if d.Want == d.Got {
+			d.Want += " (secrets changed)"
+		}
+		diffs = append(diffs, d)
+	}
+	var keys []string
+	for k := range want.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if v, ok := got.Labels[k]; !ok || v != want.Labels[k] {
+			if !ok {
+				v = "(unset)"
+			}
+			diffs = append(diffs, fieldDiff{Field: "labels." + k, Want: want.Labels[k], Got: v})
+		}
+	}
+	if !reflect.DeepEqual(want.Env, got.Env) {
+		diffs = append(diffs, fieldDiff{Field: "proxy.nodes", Want: envNames(want.Env), Got: envNames(got.Env)})
+	}
+	if !reflect.DeepEqual(normalizeRegistry(want.Registries), normalizeRegistry(got.Registries)) {
+		w, g := registryHosts(want.Registries), registryHosts(got.Registries)
+		if w == g {
+			w += ", settings changed"
+		}
+		diffs = append(diffs, fieldDiff{Field: "registries", Want: w, Got: g})
+	}
+	return diffs
+}
+
+func maskArgs(args []string) []string {
+	res := make([]string, len(args))
+	for i, a := range args {
+		res[i] = a
+		for _, p := range secretArgPrefixes {
+			if strings.HasPrefix(a, p) && a != p {
+				res[i] = p + maskedValue
+			}
+		}
+	}
+	return res
+}
+
+// envNames describes env without values, they may have credentials of proxies
+func envNames(env []string) string {
+	if len(env) == 0 {
+		return "(none)"
+	}
+	var names []string
+	for _, e := range env {
+		names = append(names, strings.SplitN(e, "=", 2)[0]+"="+maskedValue)
+	}
+	return strings.Join(names, " ")
+}
+
+// registryHosts describes r with the registries it configures, settings may have credentials
+func registryHosts(r k3s.Registry) string {
+	var hosts []string
+	for h := range r.Mirrors {
+		hosts = append(hosts, "mirror "+h)
+	}
+	for h := range r.Configs {
+		hosts = append(hosts, "config "+h)
+	}
+	for h := range r.Auths {
+		hosts = append(hosts, "auth "+h)
+	}
+	if len(hosts) == 0 {
+		return "(none)"
+	}
+	sort.Strings(hosts)
+	return strings.Join(hosts, ", ")
+}
+
+// normalizeRegistry makes empty maps of r nil, they are the same in registries.yaml
+func normalizeRegistry(r k3s.Registry) k3s.Registry {
+	if len(r.Mirrors) == 0 {
+		r.Mirrors = nil
+	}
+	if len(r.Configs) == 0 {
+		r.Configs = nil
+	}
+	if len(r.Auths) == 0 {
+		r.Auths = nil
+	}
+	return r
+}
+
+// normalizeValues converts chart values to their JSON form, so values from YAML and the ones stored in Helm
+// releases are comparable
+func normalizeValues(vals map[string]interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(vals)
+	if err != nil {
+		return nil, err
+	}
+	res := map[string]interface{}{}
+	return res, json.Unmarshal(data, &res)
+}
@@ -0,0 +1,175 @@
+package pkg
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rancher/k3d/v5/pkg/types/k3s"
+)
+
+func TestK3sArgs(t *testing.T) {
+	cases := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{name: "none", args: []string{"server"}, want: []string{}},
+		{
+			name: "k3d args dropped",
+			args: []string{"server", "--tls-san", "0.0.0.0", "--cluster-init", "--node-label", "a=b", "--disable=traefik"},
+			want: []string{"--disable=traefik"},
+		},
+		{
+			name: "entrypoint before server",
+			args: []string{"/bin/k3s", "server", "--token=t", "--datastore-endpoint=mysql://db"},
+			want: []string{"--token=t", "--datastore-endpoint=mysql://db"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := k3sArgs(c.args); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("expect %q, got %q", c.want, got)
+			}
+		})
+	}
+}
+
+func TestMaskArgs(t *testing.T) {
+	args := []string{"--token=secret", "--datastore-endpoint=mysql://u:p@db", "--token=", "--disable=traefik"}
+	want := []string{"--token=******", "--datastore-endpoint=******", "--token=", "--disable=traefik"}
+	if got := maskArgs(args); !reflect.DeepEqual(got, want) {
+		t.Errorf("expect %q, got %q", want, got)
+	}
+	if args[0] != "--token=secret" {
+		t.Errorf("expect args unchanged, got %q", args)
+	}
+}
+
+func TestDiffClusterState(t *testing.T) {
+	base := func() clusterState {
+		return clusterState{
+			Name:    "hub",
+			Image:   DefaultK3sImage,
+			Servers: 1,
+			Agents:  1,
+			APIPort: 6443,
+			Args:    []string{"--token=a"},
+			Labels:  map[string]string{"region": "eu"},
+			Env:     []string{"HTTP_PROXY=http://p:3128"},
+			Registries: k3s.Registry{
+				Mirrors: map[string]k3s.Mirror{"docker.io": {Endpoints: []string{"https://m.io"}}},
+			},
+		}
+	}
+	cases := []struct {
+		name string
+		// modify changes the running state
+		modify func(s *clusterState)
+		want   []string
+	}{
+		{name: "same", modify: func(s *clusterState) {}, want: []string{}},
+		{
+			name: "extra labels and empty registry maps are ignored",
+			modify: func(s *clusterState) {
+				s.Labels = map[string]string{"region": "eu", "k3d.cluster": "hub"}
+				s.Registries.Configs = map[string]k3s.RegistryConfig{}
+			},
+			want: []string{},
+		},
+		{
+			name: "nodes",
+			modify: func(s *clusterState) {
+				s.Image = "rancher/k3s:v1.21.0"
+				s.Servers = 3
+				s.Agents = 0
+				s.APIPort = 7443
+			},
+			want: []string{
+				"image: rancher/k3s:v1.21.0 -> " + DefaultK3sImage,
+				"servers: 3 -> 1",
+				"agents: 0 -> 1",
+				"apiPort: 7443 -> 6443",
+			},
+		},
+		{
+			name:   "secrets changed",
+			modify: func(s *clusterState) { s.Args = []string{"--token=b"} },
+			want:   []string{"args: --token=****** -> --token=****** (secrets changed)"},
+		},
+		{
+			name:   "args",
+			modify: func(s *clusterState) { s.Args = []string{"--token=a", "--disable=traefik"} },
+			want:   []string{"args: --token=****** --disable=traefik -> --token=******"},
+		},
+		{
+			name:   "labels",
+			modify: func(s *clusterState) { s.Labels = map[string]string{} },
+			want:   []string{"labels.region: (unset) -> eu"},
+		},
+		{
+			name:   "proxy",
+			modify: func(s *clusterState) { s.Env = nil },
+			want:   []string{"proxy.nodes: (none) -> HTTP_PROXY=******"},
+		},
+		{
+			name: "registry settings",
+			modify: func(s *clusterState) {
+				s.Registries.Mirrors = map[string]k3s.Mirror{"docker.io": {Endpoints: []string{"https://other.io"}}}
+			},
+			want: []string{"registries: mirror docker.io -> mirror docker.io, settings changed"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := base()
+			c.modify(&got)
+			diffs := []string{}
+			for _, d := range diffClusterState(base(), got) {
+				diffs = append(diffs, d.String())
+			}
+			if !reflect.DeepEqual(diffs, c.want) {
+				t.Errorf("expect\n%s\ngot\n%s", strings.Join(c.want, "\n"), strings.Join(diffs, "\n"))
+			}
+		})
+	}
+}
+
+func TestOwnsCluster(t *testing.T) {
+	cfg := Config{File: "/etc/mvela/conf.yaml", Clusters: []Cluster{{Name: "hub"}}}
+	owned := ownerLabels(cfg)
+	other := ownerLabels(Config{File: "/etc/mvela/other.yaml"})
+	cases := []struct {
+		name    string
+		cluster string
+		labels  map[string]string
+		want    bool
+	}{
+		{name: "declared", cluster: "hub", labels: owned, want: true},
+		{name: "removed from config", cluster: "edge", labels: owned, want: true},
+		{name: "declared, from another config file", cluster: "hub", labels: other, want: true},
+		{name: "from another config file", cluster: "edge", labels: other, want: false},
+		{name: "default name from another config file", cluster: "mvela-cluster-1", labels: other, want: false},
+		{name: "declared, without owner labels", cluster: "hub", labels: map[string]string{"k3d.cluster": "hub"}, want: true},
+		{name: "default name without owner labels", cluster: "mvela-cluster-1", labels: map[string]string{}, want: true},
+		{name: "other name without owner labels", cluster: "dev", labels: map[string]string{}, want: false},
+		{name: "upgrade test", cluster: upgradeTestClusterName, labels: map[string]string{upgradeTestLabel: "true"}, want: false},
+		{name: "not managed", cluster: "hub", labels: map[string]string{managedLabel: "false"}, want: false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := ownsCluster(cfg, c.cluster, c.labels); got != c.want {
+				t.Errorf("expect %v, got %v", c.want, got)
+			}
+		})
+	}
+}
+
+func TestConfigFileID(t *testing.T) {
+	if id := configFileID(Config{}); id != "" {
+		t.Errorf("expect empty without config file, got %s", id)
+	}
+	if id := configFileID(Config{File: "conf.yaml"}); !strings.HasPrefix(id, "/") || !strings.HasSuffix(id, "/conf.yaml") {
+		t.Errorf("expect absolute path, got %s", id)
+	}
+}
@@ -0,0 +1,155 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/kyokomi/emoji/v2"
+	k3dClient "github.com/rancher/k3d/v5/pkg/client"
+	"github.com/rancher/k3d/v5/pkg/runtimes"
+	k3dTypes "github.com/rancher/k3d/v5/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+// createStep is a step of create that changed something, undo reverts the change
+type createStep struct {
+	name string
+	undo func(ctx context.Context) error
+}
+
+// createTransaction records steps of create building the network, clusters and kubeconfigs, they are undone in
+// reverse order if a cluster fails. Steps are recorded before they start, so the ones failed halfway are undone too.
+// It's safe for concurrent use.
+type createTransaction struct {
+	mu    sync.Mutex
+	steps []createStep
+}
+
+func (t *createTransaction) record(name string, undo func(ctx context.Context) error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.steps = append(t.steps, createStep{name: name, undo: undo})
+}
+
+// rollback undoes the recorded steps in reverse order, names of steps undone and errors of the ones failed to
+// undo are returned
+func (t *createTransaction) rollback(ctx context.Context) ([]string, []error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var undone []string
+	var errs []error
+	for i := len(t.steps) - 1; i >= 0; i-- {
+		s := t.steps[i]
+		klog.Infof("Undoing %s", s.name)
+		if err := s.undo(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", s.name, err))
+			continue
+		}
+		undone = append(undone, s.name)
+	}
+	t.steps = nil
+	return undone, errs
+}
+
+// names of the recorded steps in order
+func (t *createTransaction) names() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var names []string
+	for _, s := range t.steps {
+		names = append(names, s.name)
+	}
+	return names
+}
+
+// ensureK3dNetwork creates the docker network shared by all clusters if absent, the creation is recorded in tx
+func ensureK3dNetwork(ctx context.Context, tx *createTransaction) error {
+	network := k3dTypes.ClusterNetwork{Name: fmt.Sprintf("%s-%s", k3dPrefix, configName)}
+	if _, err := dockerCli.NetworkInspect(ctx, network.Name, types.NetworkInspectOptions{}); err == nil {
+		return nil
+	} else if !client.IsErrNotFound(err) {
+		return err
+	}
+	tx.record("network "+network.Name, func(ctx context.Context) error {
+		// k3d removes it along with the last cluster in it
+		if _, err := dockerCli.NetworkInspect(ctx, network.Name, types.NetworkInspectOptions{}); client.IsErrNotFound(err) {
+			return nil
+		}
+		return runtimes.SelectedRuntime.DeleteNetwork(ctx, network.Name)
+	})
+	_, _, err := runtimes.SelectedRuntime.CreateNetworkIfNotPresent(ctx, &network)
+	return err
+}
+
+// recordCluster records the creation of cluster in tx if it doesn't exist
+func recordCluster(ctx context.Context, tx *createTransaction, cluster *k3dTypes.Cluster) {
+	if _, err := k3dClient.ClusterGet(ctx, runtimes.SelectedRuntime, cluster); err == nil {
+		return
+	}
+	tx.record("cluster "+cluster.Name, func(ctx context.Context) error {
+		existing, err := k3dClient.ClusterGet(ctx, runtimes.SelectedRuntime, cluster)
+		if err != nil {
+			// failed before any node is created
+			return nil
+		}
+		return k3dClient.ClusterDelete(ctx, runtimes.SelectedRuntime, existing, k3dTypes.ClusterDeleteOpts{})
+	})
+}
+
+// recordFile records writing file in tx, it's removed on undo if it doesn't exist, or its content is restored
+func recordFile(tx *createTransaction, name, file string) error {
+	info, err := os.Stat(file)
+	if errors.Is(err, os.ErrNotExist) {
+		tx.record(name+" "+file, func(context.Context) error {
+			if err := os.Remove(file); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			return nil
+		})
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	tx.record(name+" "+file+", back to the previous content", func(context.Context) error {
+		return os.WriteFile(file, data, info.Mode().Perm())
+	})
+	return nil
+}
+
+// printRollback reports steps undone and the ones failed to undo
+func printRollback(w io.Writer, undone []string, errs []error) {
+	if len(undone) > 0 {
+		emoji.Fprintf(w, ":broom: Cleaned up %d step(s)\n", len(undone))
+		for _, s := range undone {
+			fmt.Fprintf(w, "  %s\n", s)
+		}
+	}
+	if len(errs) > 0 {
+		emoji.Fprintf(w, ":warning: Fail to clean up %d step(s), run `mvela delete` to clean up\n", len(errs))
+		for _, err := range errs {
+			fmt.Fprintf(w, "  %v\n", err)
+		}
+	}
+}
+
+// printKept reports steps kept because of --keep-on-failure
+func printKept(w io.Writer, steps []string) {
+	if len(steps) == 0 {
+		return
+	}
+	emoji.Fprintf(w, ":pushpin: Kept %d step(s) for debugging, run `mvela delete` to clean up\n", len(steps))
+	for _, s := range steps {
+		fmt.Fprintf(w, "  %s\n", s)
+	}
+}
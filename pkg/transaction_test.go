@@ -0,0 +1,79 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestCreateTransactionRollback(t *testing.T) {
+	tx := &createTransaction{}
+	var undone []string
+	for _, name := range []string{"a", "b", "c"} {
+		name := name
+		tx.record(name, func(context.Context) error {
+			if name == "b" {
+				return errors.New("oops")
+			}
+			undone = append(undone, name)
+			return nil
+		})
+	}
+	if got := tx.names(); !equalStrings(got, []string{"a", "b", "c"}) {
+		t.Fatalf("expect steps in order, got %v", got)
+	}
+	names, errs := tx.rollback(context.Background())
+	if !equalStrings(undone, []string{"c", "a"}) || !equalStrings(names, []string{"c", "a"}) {
+		t.Errorf("expect steps undone in reverse order, got %v and %v", undone, names)
+	}
+	if len(errs) != 1 || errs[0].Error() != "b: oops" {
+		t.Errorf("expect error of b, got %v", errs)
+	}
+	if len(tx.names()) != 0 {
+		t.Errorf("expect no step left, got %v", tx.names())
+	}
+}
+
+func TestRecordFile(t *testing.T) {
+	dir := t.TempDir()
+	existing := path.Join(dir, "existing")
+	if err := os.WriteFile(existing, []byte("old"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	created := path.Join(dir, "created")
+	tx := &createTransaction{}
+	for _, file := range []string{existing, created} {
+		if err := recordFile(tx, "kubeconfig", file); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte("new"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, errs := tx.rollback(context.Background()); len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if data, err := os.ReadFile(existing); err != nil || string(data) != "old" {
+		t.Errorf("expect existing file restored, got %q, %v", data, err)
+	}
+	if info, err := os.Stat(existing); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("expect mode of existing file kept, got %v", info)
+	}
+	if _, err := os.Stat(created); !os.IsNotExist(err) {
+		t.Errorf("expect created file removed, got %v", err)
+	}
+
+	// a file not written is removed without an error
+	if err := recordFile(tx, "kubeconfig", path.Join(dir, "none")); err != nil {
+		t.Fatal(err)
+	}
+	if _, errs := tx.rollback(context.Background()); len(errs) != 0 {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+	if err := recordFile(tx, "kubeconfig", path.Join(existing, "x")); err == nil || !strings.Contains(err.Error(), "not a directory") {
+		t.Errorf("expect error of stat, got %v", err)
+	}
+}
@@ -0,0 +1,221 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kyokomi/emoji/v2"
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/spf13/cobra"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/release"
+	"k8s.io/klog/v2"
+)
+
+const defaultUpgradeTimeout = 5 * time.Minute
+
+func CmdUpgrade(cmdConfig *Config) *cobra.Command {
+	var to string
+	var timeout time.Duration
+	var dryRun bool
+	cmd := cobra.Command{
+		Use:   "upgrade",
+		Short: "Upgrade vela-core in the control plane",
+		Long: "Upgrade vela-core in the control plane to another chart version with the chart source and values in config. " +
+			"Changes of manifests are shown first. vela-core is rolled back to the previous revision if the upgrade fails, " +
+			"or its deployments and CRDs are not healthy in time.",
+		Example: "mvela upgrade --to 1.3.0",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			kubeconfig := kubeconfigPath(*cmdConfig, cmdConfig.Clusters[0].Name)
+			opts := cmdConfig.HelmOpts
+			opts.Version = to
+			upgraded, err := UpgradeVelaCore(cmd.Context(), kubeconfig, opts, cmdConfig.Proxy, timeout, dryRun)
+			if err != nil {
+				return fmt.Errorf("fail to upgrade vela-core: %w", err)
+			}
+			if dryRun {
+				return nil
+			}
+			emoji.Fprintf(os.Stdout, ":white_check_mark: vela-core is upgraded to %s, revision %d\n",
+				upgraded.Chart.Metadata.Version, upgraded.Version)
+			if cmdConfig.HelmOpts.Version != to {
+				emoji.Fprintf(os.Stdout, ":pushpin: Set helmOpts.version to %s in config, or `mvela create` installs the version in config again\n", to)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&to, "to", "", "chart version or constraint to upgrade to, like 1.3.0, ~1.3 or stable")
+	cmd.Flags().DurationVar(&timeout, "timeout", defaultUpgradeTimeout, "time to wait for the upgrade and health checks")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "only show the changes")
+	_ = cmd.MarkFlagRequired("to")
+	return &cmd
+}
+
+func CmdRollback(cmdConfig *Config) *cobra.Command {
+	var list bool
+	var timeout time.Duration
+	cmd := cobra.Command{
+		Use:   "rollback [REVISION]",
+		Short: "Roll vela-core back to an earlier revision",
+		Long:  "List revisions of vela-core release in the control plane, and roll back to REVISION or the previous one",
+		Example: "mvela rollback --list\n" +
+			"mvela rollback 2",
+		Args: usageArgs(cobra.MaximumNArgs(1)),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			revision := 0
+			if len(args) == 1 {
+				var err error
+				if revision, err = strconv.Atoi(args[0]); err != nil || revision < 1 {
+					return withCode(ExitUsage, fmt.Errorf("invalid revision %q, expect a positive number", args[0]))
+				}
+			}
+			kubeconfig := kubeconfigPath(*cmdConfig, cmdConfig.Clusters[0].Name)
+			actionConfig, err := helmActionConfig(kubeconfig, VelaCoreReleaseNamespace, cmdConfig.Proxy)
+			if err != nil {
+				return err
+			}
+			history, err := action.NewHistory(actionConfig).Run(VelaCoreReleaseName)
+			if err != nil {
+				return chartError(fmt.Errorf("fail to get history of vela-core release: %w", err))
+			}
+			printHistory(os.Stdout, history)
+			if list {
+				return nil
+			}
+			restored, err := rollbackRelease(cmd.Context(), kubeconfig, actionConfig, VelaCoreReleaseName, revision, cmdConfig.Proxy, timeout)
+			if err != nil {
+				return fmt.Errorf("fail to roll back vela-core: %w", err)
+			}
+			emoji.Fprintf(os.Stdout, ":white_check_mark: vela-core is rolled back to %s, revision %d\n",
+				restored.Chart.Metadata.Version, restored.Version)
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&list, "list", false, "only list revisions")
+	cmd.Flags().DurationVar(&timeout, "timeout", defaultUpgradeTimeout, "time to wait for the rollback and health checks")
+	return &cmd
+}
+
+// UpgradeVelaCore upgrades vela-core in the cluster of kubeconfig to the chart in opts, changes are printed before
+// upgrading. It's rolled back to the current revision if the upgrade fails or vela-core is not healthy in timeout.
+// Nothing is changed if dryRun.
+func UpgradeVelaCore(ctx context.Context, kubeconfig string, opts HelmOpts, proxy Proxy, timeout time.Duration, dryRun bool) (*release.Release, error) {
+	r := velaCoreRelease(opts)
+	actionConfig, err := helmActionConfig(kubeconfig, r.Namespace, proxy)
+	if err != nil {
+		return nil, err
+	}
+	current, err := action.NewGet(actionConfig).Run(r.Name)
+	if err != nil {
+		return nil, chartError(fmt.Errorf("fail to get vela-core release, run `mvela create` to install it: %w", err))
+	}
+	ch, vals, err := prepareChart(r, proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := action.NewUpgrade(actionConfig)
+	plan.Namespace = r.Namespace
+	plan.DryRun = true
+	planned, err := plan.Run(r.Name, ch, vals)
+	if err != nil {
+		return nil, chartError(fmt.Errorf("fail to render the upgrade: %w", err))
+	}
+	if err = printReleaseDiff(os.Stdout, current, planned); err != nil {
+		return nil, err
+	}
+	if dryRun {
+		return planned, nil
+	}
+	return upgradeRelease(ctx, kubeconfig, actionConfig, current, ch, vals, proxy, timeout)
+}
+
+// upgradeRelease upgrades current to ch with vals, it's rolled back to current if the upgrade fails or the release is
+// not healthy in timeout
+func upgradeRelease(ctx context.Context, kubeconfig string, actionConfig *action.Configuration, current *release.Release,
+	ch *chart.Chart, vals map[string]interface{}, proxy Proxy, timeout time.Duration) (*release.Release, error) {
+	klog.Infof("Upgrading %s from revision %d, please hold...", current.Name, current.Version)
+	up := action.NewUpgrade(actionConfig)
+	up.Namespace = current.Namespace
+	up.Wait = true
+	up.Atomic = true
+	up.Timeout = timeout
+	upgraded, err := up.Run(current.Name, ch, vals)
+	if err != nil {
+		// Atomic rolls back on failure
+		return nil, chartError(fmt.Errorf("fail to upgrade, rolled back to revision %d: %w", current.Version, err))
+	}
+	if err = checkReleaseHealth(ctx, kubeconfig, upgraded, proxy, timeout); err != nil {
+		klog.ErrorS(err, "Release is not healthy after upgrading, rolling back", "release", current.Name, "revision", current.Version)
+		if _, rbErr := rollbackRelease(ctx, kubeconfig, actionConfig, current.Name, current.Version, proxy, timeout); rbErr != nil {
+			return nil, fmt.Errorf("%v, fail to roll back to revision %d: %w", err, current.Version, rbErr)
+		}
+		return nil, fmt.Errorf("rolled back to revision %d: %w", current.Version, err)
+	}
+	return upgraded, nil
+}
+
+// rollbackRelease rolls release back to revision, the previous one if revision is 0, and checks its health
+func rollbackRelease(ctx context.Context, kubeconfig string, actionConfig *action.Configuration, name string, revision int,
+	proxy Proxy, timeout time.Duration) (*release.Release, error) {
+	rb := action.NewRollback(actionConfig)
+	rb.Version = revision
+	rb.Wait = true
+	rb.Timeout = timeout
+	if err := rb.Run(name); err != nil {
+		return nil, chartError(err)
+	}
+	restored, err := action.NewGet(actionConfig).Run(name)
+	if err != nil {
+		return nil, chartError(err)
+	}
+	return restored, checkReleaseHealth(ctx, kubeconfig, restored, proxy, timeout)
+}
+
+// checkReleaseHealth waits until rel is healthy in the cluster of kubeconfig
+func checkReleaseHealth(ctx context.Context, kubeconfig string, rel *release.Release, proxy Proxy, timeout time.Duration) error {
+	config, err := kubeClientGetter(kubeconfig, rel.Namespace, proxy).ToRESTConfig()
+	if err != nil {
+		return err
+	}
+	klog.Infof("Checking health of release %s revision %d", rel.Name, rel.Version)
+	return waitReleaseHealthy(ctx, config, rel, timeout)
+}
+
+// printReleaseDiff prints the chart versions and the diff of manifests from one release to another
+func printReleaseDiff(w io.Writer, from, to *release.Release) error {
+	fmt.Fprintf(w, "Chart: %s-%s -> %s-%s\n", from.Chart.Name(), from.Chart.Metadata.Version,
+		to.Chart.Name(), to.Chart.Metadata.Version)
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(from.Manifest),
+		B:        difflib.SplitLines(to.Manifest),
+		FromFile: fmt.Sprintf("revision %d", from.Version),
+		ToFile:   "upgrade",
+		Context:  3,
+	})
+	if err != nil {
+		return err
+	}
+	if diff == "" {
+		fmt.Fprintln(w, "No change in manifests")
+		return nil
+	}
+	_, err = fmt.Fprint(w, diff)
+	return err
+}
+
+func printHistory(w io.Writer, history []*release.Release) {
+	tw := tabwriter.NewWriter(w, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(tw, "REVISION\tUPDATED\tSTATUS\tCHART\tAPP VERSION\tDESCRIPTION")
+	for _, r := range history {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s-%s\t%s\t%s\n", r.Version, r.Info.LastDeployed.Format(time.RFC1123), r.Info.Status,
+			r.Chart.Name(), r.Chart.Metadata.Version, r.Chart.Metadata.AppVersion, r.Info.Description)
+	}
+	tw.Flush()
+}
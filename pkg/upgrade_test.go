@@ -0,0 +1,133 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	kubefake "helm.sh/helm/v3/pkg/kube/fake"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/storage"
+	"helm.sh/helm/v3/pkg/storage/driver"
+	appsv1 "k8s.io/api/apps/v1"
+)
+
+// fakeDeploymentServer serves deployments of vela-system, the ones named healthy are available
+func fakeDeploymentServer(t *testing.T) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/apis/apps/v1/namespaces/vela-system/deployments/")
+		if name == r.URL.Path {
+			http.NotFound(w, r)
+			return
+		}
+		d := appsv1.Deployment{}
+		d.APIVersion, d.Kind, d.Name, d.Namespace = "apps/v1", "Deployment", name, "vela-system"
+		if name == "healthy" {
+			d.Status = appsv1.DeploymentStatus{UpdatedReplicas: 1, AvailableReplicas: 1}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(d)
+	}))
+	t.Cleanup(server.Close)
+	file := path.Join(t.TempDir(), "kubeconfig")
+	data := "apiVersion: v1\nkind: Config\nclusters:\n- name: c\n  cluster: {server: " + server.URL + "}\n" +
+		"contexts:\n- name: c\n  context: {cluster: c, user: u}\ncurrent-context: c\nusers:\n- name: u\n  user: {token: t}\n"
+	if err := os.WriteFile(file, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// deploymentChart is a vela-core chart of version with a deployment named by values
+func deploymentChart(version string) *chart.Chart {
+	return &chart.Chart{
+		Metadata: &chart.Metadata{APIVersion: chart.APIVersionV2, Name: velaCoreChartName, Version: version},
+		Templates: []*chart.File{{
+			Name: "templates/deployment.yaml",
+			Data: []byte("apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: {{ .Values.deployment }}\n"),
+		}},
+	}
+}
+
+func TestUpgradeRelease(t *testing.T) {
+	kubeconfig := fakeDeploymentServer(t)
+	cases := []struct {
+		name       string
+		deployment string
+		// version is the chart version deployed at last
+		version string
+		err     string
+	}{
+		{name: "healthy", deployment: "healthy", version: "1.1.0"},
+		{name: "rolled back if not healthy", deployment: "unhealthy", version: "1.0.0", err: "rolled back to revision 1: not healthy in 1s: deployment vela-system/unhealthy"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			actionConfig := &action.Configuration{
+				RESTClientGetter: kubeClientGetter(kubeconfig, VelaCoreReleaseNamespace, Proxy{}),
+				Releases:         storage.Init(driver.NewMemory()),
+				KubeClient:       &kubefake.PrintingKubeClient{Out: io.Discard},
+				Capabilities:     chartutil.DefaultCapabilities,
+				Log:              func(string, ...interface{}) {},
+			}
+			current := &release.Release{
+				Name:      VelaCoreReleaseName,
+				Namespace: VelaCoreReleaseNamespace,
+				Version:   1,
+				Info:      &release.Info{Status: release.StatusDeployed},
+				Chart:     deploymentChart("1.0.0"),
+				Config:    map[string]interface{}{"deployment": "healthy"},
+				Manifest:  "---\napiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: healthy\n",
+			}
+			if err := actionConfig.Releases.Create(current); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := upgradeRelease(context.Background(), kubeconfig, actionConfig, current, deploymentChart("1.1.0"),
+				map[string]interface{}{"deployment": c.deployment}, Proxy{}, time.Second)
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("expect error %q, got %v", c.err, err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			deployed, err := actionConfig.Releases.Deployed(VelaCoreReleaseName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if deployed.Chart.Metadata.Version != c.version {
+				t.Errorf("expect %s deployed, got %s of revision %d", c.version, deployed.Chart.Metadata.Version, deployed.Version)
+			}
+		})
+	}
+}
+
+func TestPrintReleaseDiff(t *testing.T) {
+	from := &release.Release{Version: 1, Chart: deploymentChart("1.0.0"), Manifest: "a: 1\nb: 1\n"}
+	to := &release.Release{Chart: deploymentChart("1.1.0"), Manifest: "a: 1\nb: 2\n"}
+	buf := bytes.Buffer{}
+	if err := printReleaseDiff(&buf, from, to); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Chart: vela-core-1.0.0 -> vela-core-1.1.0", "--- revision 1", "-b: 1", "+b: 2"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("expect %q in diff, got\n%s", want, buf.String())
+		}
+	}
+	buf.Reset()
+	if err := printReleaseDiff(&buf, from, from); err != nil || !strings.Contains(buf.String(), "No change in manifests") {
+		t.Errorf("expect no change, got %q, %v", buf.String(), err)
+	}
+}
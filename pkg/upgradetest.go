@@ -0,0 +1,572 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kyokomi/emoji/v2"
+	k3dClient "github.com/rancher/k3d/v5/pkg/client"
+	config "github.com/rancher/k3d/v5/pkg/config/v1alpha4"
+	"github.com/rancher/k3d/v5/pkg/runtimes"
+	k3d "github.com/rancher/k3d/v5/pkg/types"
+	"github.com/spf13/cobra"
+	"helm.sh/helm/v3/pkg/action"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	k8syaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// upgradeTestClusterName is the cluster created for upgrade tests, it's recreated in every run
+	upgradeTestClusterName = "mvela-upgrade-test"
+	// upgradeTestLabel marks nodes of the test cluster
+	upgradeTestLabel             = "mvela.upgrade-test"
+	defaultUpgradeTestReport     = "upgrade-test-report.json"
+	defaultUpgradeTestAppTimeout = 10 * time.Minute
+	// appPhaseRunning is the phase of a KubeVela Application whose workflow has finished
+	appPhaseRunning = "running"
+)
+
+var applicationGVR = schema.GroupVersionResource{Group: "core.oam.dev", Version: "v1beta1", Resource: "applications"}
+
+// upgradeTestOptions are the flags of upgrade-test
+type upgradeTestOptions struct {
+	From     string
+	To       string
+	Fixtures string
+	Timeout  time.Duration
+	Keep     bool
+}
+
+// upgradeTestReport is the machine-readable result of an upgrade test
+type upgradeTestReport struct {
+	// From and To are the resolved chart versions
+	From      string          `json:"from"`
+	To        string          `json:"to"`
+	Passed    bool            `json:"passed"`
+	Error     string          `json:"error,omitempty"`
+	StartTime time.Time       `json:"startTime"`
+	Duration  string          `json:"duration"`
+	Fixtures  []fixtureResult `json:"fixtures"`
+}
+
+type fixtureResult struct {
+	File      string `json:"file"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	// Before and After are states of the Application before and after upgrading
+	Before   *appState `json:"before,omitempty"`
+	After    *appState `json:"after,omitempty"`
+	Passed   bool      `json:"passed"`
+	Problems []string  `json:"problems,omitempty"`
+}
+
+// appState is the observed state of an Application and the resources it generates
+type appState struct {
+	Phase     string        `json:"phase"`
+	Healthy   bool          `json:"healthy"`
+	Resources []resourceRef `json:"resources,omitempty"`
+}
+
+type resourceRef struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Namespace  string `json:"namespace,omitempty"`
+	Name       string `json:"name"`
+	UID        string `json:"uid,omitempty"`
+}
+
+func (r resourceRef) String() string {
+	if r.Namespace == "" {
+		return fmt.Sprintf("%s %s", r.Kind, r.Name)
+	}
+	return fmt.Sprintf("%s %s/%s", r.Kind, r.Namespace, r.Name)
+}
+
+// fixture is an Application to apply in upgrade tests
+type fixture struct {
+	File string
+	App  *unstructured.Unstructured
+}
+
+func CmdUpgradeTest(cmdConfig *Config) *cobra.Command {
+	var opts upgradeTestOptions
+	var report string
+	cmd := cobra.Command{
+		Use:   "upgrade-test",
+		Short: "Test upgrading vela-core with fixture Applications",
+		Long: "Create a fresh cluster with vela-core of --from version, apply the Applications in --fixtures and wait until " +
+			"they are healthy, then upgrade vela-core to --to version in place and check every Application stays " +
+			"healthy and keeps its generated resources. Chart source, values and cluster settings are taken from config.",
+		Example: "mvela upgrade-test --from 1.2.4 --to 1.3.0 --fixtures ./apps --report report.json",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := checkDocker(cmd.Context()); err != nil {
+				return err
+			}
+			if err := resolveSecrets(cmdConfig); err != nil {
+				return configError(err)
+			}
+			result, err := RunUpgradeTest(cmd.Context(), *cmdConfig, opts)
+			writeErr := writeUpgradeTestReport(report, result)
+			if err = upgradeTestError(result, report, err, writeErr); err != nil {
+				return err
+			}
+			emoji.Fprintf(os.Stdout, ":white_check_mark: Upgrade test from %s to %s passed with %d fixture(s), see %s\n",
+				result.From, result.To, len(result.Fixtures), report)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&opts.From, "from", "", "chart version or constraint of vela-core to start with")
+	cmd.Flags().StringVar(&opts.To, "to", "", "chart version or constraint of vela-core to upgrade to")
+	cmd.Flags().StringVar(&opts.Fixtures, "fixtures", "", "a YAML file or directory of YAML files of Applications")
+	cmd.Flags().StringVar(&report, "report", defaultUpgradeTestReport, "file to write the JSON report")
+	cmd.Flags().DurationVar(&opts.Timeout, "timeout", defaultUpgradeTestAppTimeout, "time to wait for vela-core and Applications in each step")
+	cmd.Flags().BoolVar(&opts.Keep, "keep", false, "keep the test cluster "+upgradeTestClusterName+" and its kubeconfig after testing")
+	for _, f := range []string{"from", "to", "fixtures"} {
+		_ = cmd.MarkFlagRequired(f)
+	}
+	return &cmd
+}
+
+// upgradeTestError is the error of an upgrade test whose report is written to report, the error aborted the test
+// is kept if writing the report fails too
+func upgradeTestError(result *upgradeTestReport, report string, err, writeErr error) error {
+	if writeErr != nil {
+		writeErr = fmt.Errorf("fail to write upgrade test report: %w", writeErr)
+		switch {
+		case err != nil:
+			return fmt.Errorf("upgrade test aborted: %w, and %v", err, writeErr)
+		case !result.Passed:
+			return fmt.Errorf("upgrade test from %s to %s failed, and %w", result.From, result.To, writeErr)
+		}
+		return writeErr
+	}
+	if err != nil {
+		return fmt.Errorf("upgrade test aborted, see %s: %w", report, err)
+	}
+	if !result.Passed {
+		return fmt.Errorf("upgrade test from %s to %s failed, see %s", result.From, result.To, report)
+	}
+	return nil
+}
+
+// RunUpgradeTest runs an upgrade test with the chart source, values and control plane settings in cfg. The error
+// aborted the test is returned, and recorded in the report along with the failed fixtures.
+func RunUpgradeTest(ctx context.Context, cfg Config, opts upgradeTestOptions) (*upgradeTestReport, error) {
+	report := &upgradeTestReport{From: opts.From, To: opts.To, StartTime: time.Now()}
+	err := runUpgradeTest(ctx, cfg, opts, report)
+	if err != nil {
+		report.Error = err.Error()
+	}
+	report.Passed = err == nil
+	for _, f := range report.Fixtures {
+		report.Passed = report.Passed && f.Passed
+	}
+	report.Duration = time.Since(report.StartTime).Round(time.Second).String()
+	return report, err
+}
+
+func runUpgradeTest(ctx context.Context, cfg Config, opts upgradeTestOptions, report *upgradeTestReport) error {
+	fixtures, err := loadFixtures(opts.Fixtures)
+	if err != nil {
+		return configError(err)
+	}
+	for _, f := range fixtures {
+		report.Fixtures = append(report.Fixtures, fixtureResult{File: f.File, Namespace: f.App.GetNamespace(), Name: f.App.GetName()})
+	}
+
+	kubeconfig, err := createUpgradeTestCluster(ctx, cfg)
+	if !opts.Keep {
+		defer deleteUpgradeTestCluster(context.Background(), cfg)
+	}
+	if err != nil {
+		return clusterError(err)
+	}
+
+	klog.Infof("Installing vela-core %s into %s", opts.From, upgradeTestClusterName)
+	fromOpts := cfg.HelmOpts
+	fromOpts.Version = opts.From
+	if err = InstallVelaCore(kubeconfig, fromOpts, cfg.Proxy); err != nil {
+		return err
+	}
+	actionConfig, err := helmActionConfig(kubeconfig, VelaCoreReleaseNamespace, cfg.Proxy)
+	if err != nil {
+		return err
+	}
+	installed, err := action.NewGet(actionConfig).Run(VelaCoreReleaseName)
+	if err != nil {
+		return chartError(err)
+	}
+	report.From = installed.Chart.Metadata.Version
+	if err = checkReleaseHealth(ctx, kubeconfig, installed, cfg.Proxy, opts.Timeout); err != nil {
+		return fmt.Errorf("vela-core %s: %w", report.From, err)
+	}
+
+	restConfig, err := kubeClientGetter(kubeconfig, "", cfg.Proxy).ToRESTConfig()
+	if err != nil {
+		return err
+	}
+	client, err := newFixtureClient(restConfig)
+	if err != nil {
+		return err
+	}
+	if err = client.apply(ctx, fixtures); err != nil {
+		return err
+	}
+	klog.Infof("Waiting for %d fixture(s) to be healthy with vela-core %s", len(fixtures), report.From)
+	before := client.waitHealthy(ctx, fixtures, opts.Timeout)
+	for i := range report.Fixtures {
+		report.Fixtures[i].Before = before[i]
+		if !before[i].Healthy {
+			report.Fixtures[i].Problems = append(report.Fixtures[i].Problems,
+				fmt.Sprintf("not healthy with vela-core %s, phase %q", report.From, before[i].Phase))
+		}
+	}
+
+	toOpts := cfg.HelmOpts
+	toOpts.Version = opts.To
+	upgraded, err := UpgradeVelaCore(ctx, kubeconfig, toOpts, cfg.Proxy, opts.Timeout, false)
+	if err != nil {
+		return err
+	}
+	report.To = upgraded.Chart.Metadata.Version
+
+	klog.Infof("Waiting for %d fixture(s) to be healthy with vela-core %s", len(fixtures), report.To)
+	after := client.waitHealthy(ctx, fixtures, opts.Timeout)
+	for i := range report.Fixtures {
+		r := &report.Fixtures[i]
+		r.After = after[i]
+		if !after[i].Healthy {
+			r.Problems = append(r.Problems, fmt.Sprintf("not healthy with vela-core %s, phase %q", report.To, after[i].Phase))
+		}
+		r.Problems = append(r.Problems, compareResources(before[i].Resources, after[i].Resources)...)
+		r.Passed = len(r.Problems) == 0
+	}
+	return nil
+}
+
+// createUpgradeTestCluster creates the test cluster like the control plane in cfg, without external storage. The
+// cluster is deleted first if it exists. Its nodes have the owner labels of cfg, so `mvela delete` removes it if the
+// test is interrupted. The path of its kubeconfig is returned.
+func createUpgradeTestCluster(ctx context.Context, cfg Config) (string, error) {
+	if err := deleteUpgradeTestCluster(ctx, cfg); err != nil {
+		return "", err
+	}
+	port, err := freePort()
+	if err != nil {
+		return "", err
+	}
+	nodeEnv, err := nodeProxyEnv(ctx, cfg.Proxy.Nodes)
+	if err != nil {
+		return "", err
+	}
+	runConfig, err := upgradeTestRunConfig(cfg, port, nodeEnv)
+	if err != nil {
+		return "", err
+	}
+	klog.Infof("Creating cluster %s", upgradeTestClusterName)
+	if err = k3dClient.ClusterRun(ctx, runtimes.SelectedRuntime, &runConfig); err != nil {
+		return "", fmt.Errorf("fail to create cluster %s: %w", upgradeTestClusterName, err)
+	}
+	if err = os.MkdirAll(cfg.KubeconfigOpts.Output, 0o755); err != nil {
+		return "", err
+	}
+	kubeconfig := kubeconfigPath(cfg, upgradeTestClusterName)
+	return kubeconfig, WriteKubeConfig(ctx, kubeconfig, runConfig.Cluster, true)
+}
+
+// upgradeTestRunConfig is the k3d config of the test cluster, a control plane like the one of cfg without storage.
+// It's not part of the environment of cfg: nodes are labeled as a test cluster instead of with owner labels, so
+// that apply, diff and delete leave it to deleteUpgradeTestCluster.
+func upgradeTestRunConfig(cfg Config, port int, nodeEnv []string) (config.ClusterConfig, error) {
+	cluster := cfg.Clusters[0]
+	cluster.Name = upgradeTestClusterName
+	cluster.APIPort = port
+	testCfg := cfg
+	testCfg.ManagedCluster = 1
+	testCfg.Clusters = []Cluster{cluster}
+	testCfg.Storage = Storage{}
+	testCfg.Releases = nil
+
+	runConfigs, err := GetClusterRunConfig(testCfg, nodeEnv)
+	if err != nil {
+		return config.ClusterConfig{}, err
+	}
+	labels := runConfigs[0].ClusterCreateOpts.GlobalLabels
+	for k := range ownerLabels(testCfg) {
+		delete(labels, k)
+	}
+	labels[upgradeTestLabel] = "true"
+	return runConfigs[0], nil
+}
+
+// deleteUpgradeTestCluster deletes the test cluster and its kubeconfig if they exist
+func deleteUpgradeTestCluster(ctx context.Context, cfg Config) error {
+	kubeconfig := kubeconfigPath(cfg, upgradeTestClusterName)
+	if err := os.Remove(kubeconfig); err != nil && !errors.Is(err, os.ErrNotExist) {
+		klog.Warningf("Fail to remove kubeconfig %s: %v", kubeconfig, err)
+	}
+	cluster, err := k3dClient.ClusterGet(ctx, runtimes.SelectedRuntime, &k3d.Cluster{Name: upgradeTestClusterName})
+	if err != nil {
+		// not found
+		return nil
+	}
+	klog.Infof("Deleting cluster %s", upgradeTestClusterName)
+	if err = k3dClient.ClusterDelete(ctx, runtimes.SelectedRuntime, cluster, k3d.ClusterDeleteOpts{}); err != nil {
+		klog.ErrorS(err, "Fail to delete cluster", "cluster", upgradeTestClusterName)
+		return err
+	}
+	return nil
+}
+
+// freePort returns a free port on host for Kubernetes API of the test cluster
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// loadFixtures reads Applications from file p, or YAML and JSON files in directory p recursively. Namespace of
+// Applications defaults to default.
+func loadFixtures(p string) ([]fixture, error) {
+	var files []string
+	err := filepath.Walk(p, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		ext := strings.ToLower(filepath.Ext(file))
+		if !info.IsDir() && (file == p || ext == ".yaml" || ext == ".yml" || ext == ".json") {
+			files = append(files, file)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fail to read fixtures: %w", err)
+	}
+	sort.Strings(files)
+
+	var fixtures []fixture
+	seen := map[string]string{}
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		dec := k8syaml.NewYAMLOrJSONDecoder(f, 4096)
+		for {
+			obj := map[string]interface{}{}
+			if err = dec.Decode(&obj); err != nil {
+				break
+			}
+			if len(obj) == 0 {
+				continue
+			}
+			app := &unstructured.Unstructured{Object: obj}
+			gvk := app.GroupVersionKind()
+			if gvk.Group != applicationGVR.Group || gvk.Kind != "Application" {
+				err = fmt.Errorf("%s: %s %s is not an Application", file, gvk.Kind, app.GetName())
+				break
+			}
+			if app.GetName() == "" {
+				err = fmt.Errorf("%s: Application without name", file)
+				break
+			}
+			if app.GetNamespace() == "" {
+				app.SetNamespace(corev1.NamespaceDefault)
+			}
+			key := app.GetNamespace() + "/" + app.GetName()
+			if prev, ok := seen[key]; ok {
+				err = fmt.Errorf("%s: Application %s is already in %s", file, key, prev)
+				break
+			}
+			seen[key] = file
+			fixtures = append(fixtures, fixture{File: file, App: app})
+		}
+		f.Close()
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("fail to read fixtures: %w", err)
+		}
+	}
+	if len(fixtures) == 0 {
+		return nil, fmt.Errorf("no Application found in %s", p)
+	}
+	return fixtures, nil
+}
+
+// fixtureClient applies fixtures and observes them in the test cluster
+type fixtureClient struct {
+	clientset kubernetes.Interface
+	dynamic   dynamic.Interface
+	mapper    meta.RESTMapper
+}
+
+func newFixtureClient(config *rest.Config) (*fixtureClient, error) {
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	dyn, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	dc, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &fixtureClient{
+		clientset: clientset,
+		dynamic:   dyn,
+		mapper:    restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(dc)),
+	}, nil
+}
+
+// apply creates fixtures and their namespaces
+func (c *fixtureClient) apply(ctx context.Context, fixtures []fixture) error {
+	for _, f := range fixtures {
+		ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: f.App.GetNamespace()}}
+		if _, err := c.clientset.CoreV1().Namespaces().Create(ctx, ns, metav1.CreateOptions{}); err != nil && !apierrors.IsAlreadyExists(err) {
+			return fmt.Errorf("fail to create namespace %s: %w", ns.Name, err)
+		}
+		if _, err := c.dynamic.Resource(applicationGVR).Namespace(f.App.GetNamespace()).Create(ctx, f.App, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("fail to apply Application %s/%s in %s: %w", f.App.GetNamespace(), f.App.GetName(), f.File, err)
+		}
+	}
+	return nil
+}
+
+// waitHealthy waits until all fixtures are healthy or timeout, their last states are returned in order
+func (c *fixtureClient) waitHealthy(ctx context.Context, fixtures []fixture, timeout time.Duration) []*appState {
+	states := make([]*appState, len(fixtures))
+	check := func() (bool, error) {
+		done := true
+		for i, f := range fixtures {
+			if states[i] != nil && states[i].Healthy {
+				continue
+			}
+			state, err := c.observe(ctx, f.App.GetNamespace(), f.App.GetName())
+			if err != nil {
+				klog.V(2).InfoS("Fail to observe Application", "app", f.App.GetName(), "err", err)
+				state = &appState{}
+			}
+			states[i] = state
+			done = done && state.Healthy
+		}
+		return done, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	_ = wait.PollImmediateUntil(healthPollInterval, check, ctx.Done())
+	return states
+}
+
+// observe gets the phase and health of an Application, along with the resources it applied in the local cluster
+func (c *fixtureClient) observe(ctx context.Context, namespace, name string) (*appState, error) {
+	app, err := c.dynamic.Resource(applicationGVR).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	state := &appState{}
+	state.Phase, _, _ = unstructured.NestedString(app.Object, "status", "status")
+	state.Healthy = state.Phase == appPhaseRunning
+	services, _, _ := unstructured.NestedSlice(app.Object, "status", "services")
+	for _, s := range services {
+		if healthy, _, _ := unstructured.NestedBool(asMap(s), "healthy"); !healthy {
+			state.Healthy = false
+		}
+	}
+	applied, _, _ := unstructured.NestedSlice(app.Object, "status", "appliedResources")
+	for _, a := range applied {
+		m := asMap(a)
+		// resources dispatched to other clusters can't be checked
+		if cluster, _, _ := unstructured.NestedString(m, "cluster"); cluster != "" && cluster != "local" {
+			continue
+		}
+		var r resourceRef
+		r.APIVersion, _, _ = unstructured.NestedString(m, "apiVersion")
+		r.Kind, _, _ = unstructured.NestedString(m, "kind")
+		r.Namespace, _, _ = unstructured.NestedString(m, "namespace")
+		r.Name, _, _ = unstructured.NestedString(m, "name")
+		if r.UID, err = c.resourceUID(ctx, r); err != nil {
+			klog.V(2).InfoS("Fail to get resource", "resource", r.String(), "err", err)
+		}
+		state.Resources = append(state.Resources, r)
+	}
+	return state, nil
+}
+
+// resourceUID gets UID of the resource, it's empty if the resource doesn't exist
+func (c *fixtureClient) resourceUID(ctx context.Context, r resourceRef) (string, error) {
+	gvk := schema.FromAPIVersionAndKind(r.APIVersion, r.Kind)
+	mapping, err := c.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return "", err
+	}
+	var ri dynamic.ResourceInterface = c.dynamic.Resource(mapping.Resource)
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+		ri = c.dynamic.Resource(mapping.Resource).Namespace(r.Namespace)
+	}
+	obj, err := ri.Get(ctx, r.Name, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	return string(obj.GetUID()), nil
+}
+
+// compareResources reports resources generated before upgrading but gone or recreated after it
+func compareResources(before, after []resourceRef) []string {
+	afterUIDs := map[string]string{}
+	for _, r := range after {
+		afterUIDs[r.Kind+"/"+r.Namespace+"/"+r.Name] = r.UID
+	}
+	var problems []string
+	for _, r := range before {
+		if r.UID == "" {
+			continue
+		}
+		uid, ok := afterUIDs[r.Kind+"/"+r.Namespace+"/"+r.Name]
+		switch {
+		case !ok || uid == "":
+			problems = append(problems, fmt.Sprintf("%s is gone", r))
+		case uid != r.UID:
+			problems = append(problems, fmt.Sprintf("%s is recreated", r))
+		}
+	}
+	return problems
+}
+
+func asMap(v interface{}) map[string]interface{} {
+	m, _ := v.(map[string]interface{})
+	return m
+}
+
+func writeUpgradeTestReport(file string, report *upgradeTestReport) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, append(data, '\n'), 0o644)
+}
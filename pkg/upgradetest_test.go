@@ -0,0 +1,141 @@
+package pkg
+
+import (
+	"errors"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompareResources(t *testing.T) {
+	before := []resourceRef{
+		{Kind: "Deployment", Namespace: "default", Name: "web", UID: "1"},
+		{Kind: "Service", Namespace: "default", Name: "web", UID: "2"},
+		{Kind: "ConfigMap", Namespace: "default", Name: "conf", UID: "3"},
+		{Kind: "Secret", Namespace: "default", Name: "unknown"},
+	}
+	after := []resourceRef{
+		{Kind: "Deployment", Namespace: "default", Name: "web", UID: "1"},
+		{Kind: "Service", Namespace: "default", Name: "web", UID: "4"},
+	}
+	want := []string{"Service default/web is recreated", "ConfigMap default/conf is gone"}
+	if got := compareResources(before, after); !reflect.DeepEqual(got, want) {
+		t.Errorf("expect %q, got %q", want, got)
+	}
+}
+
+func TestLoadFixtures(t *testing.T) {
+	app := func(name string) string {
+		return "apiVersion: core.oam.dev/v1beta1\nkind: Application\nmetadata:\n  name: " + name + "\n"
+	}
+	cases := []struct {
+		name  string
+		files map[string]string
+		// apps are namespace/name of Applications loaded, in order
+		apps []string
+		err  string
+	}{
+		{
+			name:  "documents in files",
+			files: map[string]string{"b.yaml": app("b"), "a.yaml": app("a") + "---\n" + app("c") + "  namespace: test\n", "notes.txt": "x"},
+			apps:  []string{"default/a", "test/c", "default/b"},
+		},
+		{name: "not an Application", files: map[string]string{"a.yaml": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: a\n"}, err: "ConfigMap a is not an Application"},
+		{name: "duplicated", files: map[string]string{"a.yaml": app("a"), "b.yml": app("a")}, err: "Application default/a is already in"},
+		{name: "empty", files: map[string]string{"a.yaml": "---\n"}, err: "no Application found"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, content := range c.files {
+				if err := os.WriteFile(path.Join(dir, name), []byte(content), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			fixtures, err := loadFixtures(dir)
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("expect error %q, got %v", c.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var apps []string
+			for _, f := range fixtures {
+				apps = append(apps, f.App.GetNamespace()+"/"+f.App.GetName())
+			}
+			if !reflect.DeepEqual(apps, c.apps) {
+				t.Errorf("expect %q, got %q", c.apps, apps)
+			}
+		})
+	}
+}
+
+func TestUpgradeTestRunConfig(t *testing.T) {
+	old := velaDir
+	velaDir = t.TempDir()
+	defer func() { velaDir = old }()
+	cfg := Config{
+		File:           "mvela.yaml",
+		ManagedCluster: 2,
+		Clusters:       []Cluster{{Name: "hub", Image: DefaultK3sImage, Servers: 1, APIPort: DefaultAPIPort}, {Name: "edge", Image: DefaultK3sImage, Servers: 1, APIPort: DefaultAPIPort + 1}},
+		Storage:        Storage{Endpoint: "mysql://db"},
+	}
+	runConfig, err := upgradeTestRunConfig(cfg, 16443, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runConfig.Cluster.Name != upgradeTestClusterName || runConfig.Cluster.KubeAPI.Binding.HostPort != "16443" {
+		t.Errorf("expect the test cluster on port 16443, got %s on %s", runConfig.Cluster.Name, runConfig.Cluster.KubeAPI.Binding.HostPort)
+	}
+	labels := runConfig.ClusterCreateOpts.GlobalLabels
+	if labels[upgradeTestLabel] != "true" {
+		t.Errorf("expect the test cluster labeled, got %v", labels)
+	}
+	for k := range ownerLabels(cfg) {
+		if _, ok := labels[k]; ok {
+			t.Errorf("expect no owner label %s, got %v", k, labels)
+		}
+	}
+	if ownsCluster(cfg, upgradeTestClusterName, labels) {
+		t.Error("expect the test cluster not in the environment of config")
+	}
+}
+
+func TestUpgradeTestError(t *testing.T) {
+	aborted := clusterError(errors.New("no docker"))
+	cases := []struct {
+		name     string
+		passed   bool
+		err      error
+		writeErr error
+		want     string
+		code     ExitCode
+	}{
+		{name: "passed", passed: true},
+		{name: "failed", want: "upgrade test from 1.2.4 to 1.3.0 failed, see r.json", code: ExitFailure},
+		{name: "aborted", err: aborted, want: "upgrade test aborted, see r.json: no docker", code: ExitCluster},
+		{name: "report not written", passed: true, writeErr: errors.New("denied"), want: "fail to write upgrade test report: denied", code: ExitFailure},
+		{name: "failed, report not written", writeErr: errors.New("denied"), want: "upgrade test from 1.2.4 to 1.3.0 failed, and fail to write upgrade test report: denied", code: ExitFailure},
+		{name: "aborted, report not written", err: aborted, writeErr: errors.New("denied"), want: "upgrade test aborted: no docker, and fail to write upgrade test report: denied", code: ExitCluster},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			result := &upgradeTestReport{From: "1.2.4", To: "1.3.0", Passed: c.passed}
+			err := upgradeTestError(result, "r.json", c.err, c.writeErr)
+			if c.want == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != c.want || exitCodeOf(err) != c.code {
+				t.Errorf("expect %q with exit code %d, got %v with %d", c.want, c.code, err, exitCodeOf(err))
+			}
+		})
+	}
+}
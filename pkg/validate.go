@@ -0,0 +1,523 @@
+package pkg
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/strvals"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const KindSimple = "Simple"
+
+// clusterNameRegexp matches names k3d accepts, k3d adds prefix and suffix to build container names
+var clusterNameRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,30}[a-z0-9])?$`)
+
+// supportedDatastoreSchemes are the datastore endpoint schemes k3s knows about
+var supportedDatastoreSchemes = []string{"mysql", "postgres", "postgresql", "http", "https"}
+
+// FieldError is a problem with one field of the configuration file
+type FieldError struct {
+	// Field is the YAML path of the field, like storage.endpoint or registries.mirrors[docker.io]
+	Field string
+	// Line is the line in config file, 0 if the value doesn't come from the file
+	Line   int
+	Detail string
+}
+
+func (e FieldError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("line %d: %s: %s", e.Line, e.Field, e.Detail)
+	}
+	return fmt.Sprintf("%s: %s", e.Field, e.Detail)
+}
+
+// FieldErrors collects all problems found in one configuration file
+type FieldErrors []FieldError
+
+func (e FieldErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, fe := range e {
+		msgs = append(msgs, "  "+fe.Error())
+	}
+	return fmt.Sprintf("%d problem(s) found in config:\n%s", len(e), strings.Join(msgs, "\n"))
+}
+
+// fieldLines maps YAML path of every field in config file to its line
+type fieldLines map[string]int
+
+func (l fieldLines) errorf(field string, format string, args ...interface{}) FieldError {
+	return FieldError{Field: field, Line: l.lineOf(field), Detail: fmt.Sprintf(format, args...)}
+}
+
+// lineOf returns the line of field, or of its closest parent if the field is absent in file
+func (l fieldLines) lineOf(field string) int {
+	for field != "" {
+		if line, ok := l[field]; ok {
+			return line
+		}
+		i := strings.LastIndexAny(field, ".[")
+		if i < 0 {
+			break
+		}
+		field = field[:i]
+	}
+	return 0
+}
+
+// checkNode walks the YAML node along with type t, records the line of every field and
+// reports fields unknown to t. Values are decoded one by one so type errors come with a path.
+// Secret references are taken into refs, they aren't accepted if refs is nil.
+func checkNode(node *yaml.Node, t reflect.Type, path string, lines fieldLines, refs secretRefs, errs *FieldErrors) {
+	if path != "" {
+		lines[path] = node.Line
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!null" {
+		return
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			*errs = append(*errs, lines.errorf(path, "expect a mapping"))
+			return
+		}
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			fieldPath := joinPath(path, key.Value)
+			f, ok := fields[key.Value]
+			if !ok {
+				lines[fieldPath] = key.Line
+				*errs = append(*errs, lines.errorf(fieldPath, "unknown field%s", suggestField(key.Value, fields)))
+				continue
+			}
+			checkNode(value, f.Type, fieldPath, lines, refs, errs)
+		}
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			*errs = append(*errs, lines.errorf(path, "expect a mapping"))
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			checkNode(node.Content[i+1], t.Elem(), fmt.Sprintf("%s[%s]", path, node.Content[i].Value), lines, refs, errs)
+		}
+	case reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			*errs = append(*errs, lines.errorf(path, "expect a list"))
+			return
+		}
+		for i, item := range node.Content {
+			checkNode(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i), lines, refs, errs)
+		}
+	case reflect.Interface:
+		// free-form values like chart values, anything goes and only lines are recorded
+		switch node.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				checkNode(node.Content[i+1], t, fmt.Sprintf("%s[%s]", path, node.Content[i].Value), lines, refs, errs)
+			}
+		case yaml.SequenceNode:
+			for i, item := range node.Content {
+				checkNode(item, t, fmt.Sprintf("%s[%d]", path, i), lines, refs, errs)
+			}
+		}
+	default:
+		if node.Kind == yaml.MappingNode && t.Kind() == reflect.String && refs != nil && acceptSecretRef(path) {
+			takeSecretRef(node, path, lines, refs, errs)
+			return
+		}
+		if node.Kind != yaml.ScalarNode {
+			*errs = append(*errs, lines.errorf(path, "expect a value of type %s", t.Kind()))
+			return
+		}
+		if err := node.Decode(reflect.New(t).Interface()); err != nil {
+			*errs = append(*errs, lines.errorf(path, "expect a value of type %s, got %q", t.Kind(), node.Value))
+		}
+	}
+}
+
+// yamlFields returns the fields of struct type t indexed by their YAML name
+func yamlFields(t reflect.Type) map[string]reflect.StructField {
+	fields := map[string]reflect.StructField{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = f
+	}
+	return fields
+}
+
+// suggestField hints the right spelling for keys differing only in case or underscores
+func suggestField(key string, fields map[string]reflect.StructField) string {
+	normalize := func(s string) string { return strings.ToLower(strings.ReplaceAll(s, "_", "")) }
+	for name := range fields {
+		if normalize(name) == normalize(key) {
+			return fmt.Sprintf(", did you mean %q?", name)
+		}
+	}
+	return ""
+}
+
+func joinPath(parent, field string) string {
+	if parent == "" {
+		return field
+	}
+	return parent + "." + field
+}
+
+// validateConfig checks the semantics of a decoded config, lines is used to locate the problems
+func validateConfig(c Config, lines fieldLines) FieldErrors {
+	var errs FieldErrors
+	if c.Kind != KindSimple {
+		errs = append(errs, lines.errorf("kind", "unsupported kind %q, expect %s", c.Kind, KindSimple))
+	}
+	if c.ManagedCluster < 0 {
+		errs = append(errs, lines.errorf("managedCluster", "must not be negative, got %d", c.ManagedCluster))
+	}
+	errs = append(errs, validateClusters(c.Clusters, lines)...)
+	errs = append(errs, validateAPIPorts(c, lines)...)
+	errs = append(errs, validateHelmOpts(c.HelmOpts, "helmOpts", lines)...)
+	_, endpointRef := c.SecretRefs["storage.endpoint"]
+	errs = append(errs, validateStorage(c.Storage, endpointRef, lines)...)
+	errs = append(errs, validateRegistries(c.Registries, lines)...)
+	errs = append(errs, validateProxy(c.Proxy, lines)...)
+	errs = append(errs, validateReleases(c, lines)...)
+
+	sortFieldErrors(errs)
+	return errs
+}
+
+func sortFieldErrors(errs FieldErrors) {
+	sort.SliceStable(errs, func(i, j int) bool {
+		if errs[i].Line != errs[j].Line {
+			return errs[i].Line < errs[j].Line
+		}
+		return errs[i].Field < errs[j].Field
+	})
+}
+
+func validateClusters(clusters []Cluster, lines fieldLines) FieldErrors {
+	var errs FieldErrors
+	names := map[string]bool{}
+	for i, c := range clusters {
+		field := fmt.Sprintf("clusters[%d]", i)
+		if c.Name != "" {
+			if !clusterNameRegexp.MatchString(c.Name) {
+				errs = append(errs, lines.errorf(field+".name", "invalid cluster name %q, expect lower case alphanumeric characters or '-'", c.Name))
+			}
+			if names[c.Name] {
+				errs = append(errs, lines.errorf(field+".name", "duplicated cluster name %q", c.Name))
+			}
+			names[c.Name] = true
+		}
+		if strings.ContainsAny(c.Image, " \t") {
+			errs = append(errs, lines.errorf(field+".image", "invalid image %q", c.Image))
+		}
+		if c.Servers < 0 {
+			errs = append(errs, lines.errorf(field+".servers", "must not be negative, got %d", c.Servers))
+		}
+		if c.Agents < 0 {
+			errs = append(errs, lines.errorf(field+".agents", "must not be negative, got %d", c.Agents))
+		}
+		for key := range c.Labels {
+			if key == "" || strings.ContainsAny(key, " \t=") {
+				errs = append(errs, lines.errorf(fmt.Sprintf("%s.labels[%s]", field, key), "invalid label key"))
+			}
+		}
+	}
+	return errs
+}
+
+// validateAPIPorts checks API ports of all clusters after CompleteConfig, the ones not declared or without apiPort
+// use DefaultAPIPort plus their ordinal
+func validateAPIPorts(c Config, lines fieldLines) FieldErrors {
+	type portUser struct {
+		name  string
+		field string
+		// explicit is set if the port is from apiPort in config
+		explicit bool
+	}
+	var errs FieldErrors
+	users := map[int]portUser{}
+	for i := 0; i < len(c.Clusters) || i < c.ManagedCluster || i == 0; i++ {
+		u := portUser{name: defaultClusterName(i), field: fmt.Sprintf("clusters[%d].apiPort", i)}
+		port := DefaultAPIPort + i
+		if i < len(c.Clusters) {
+			if c.Clusters[i].Name != "" {
+				u.name = c.Clusters[i].Name
+			}
+			if c.Clusters[i].APIPort != 0 {
+				port, u.explicit = c.Clusters[i].APIPort, true
+			}
+		}
+		if port < 0 || port > 65535 {
+			errs = append(errs, lines.errorf(u.field, "invalid port %d", port))
+			continue
+		}
+		other, ok := users[port]
+		switch {
+		case !ok:
+			users[port] = u
+		case u.explicit:
+			errs = append(errs, lines.errorf(u.field, "port %d is used by cluster %s", port, other.name))
+		default:
+			// only explicit ports collide with default ones
+			errs = append(errs, lines.errorf(other.field, "port %d is the default API port of cluster %s", port, u.name))
+		}
+	}
+	return errs
+}
+
+// validateHelmOpts checks chart options at field, helmOpts of vela-core or of a release
+func validateHelmOpts(h HelmOpts, field string, lines fieldLines) FieldErrors {
+	var errs FieldErrors
+	switch h.Type {
+	case "", ChartSourceURL, ChartSourceRepo:
+		if h.ChartPath != "" && !strings.HasPrefix(h.ChartPath, "http://") && !strings.HasPrefix(h.ChartPath, "https://") {
+			errs = append(errs, lines.errorf(field+".chartPath", "expect an http(s) URL for chart source type %s", h.Type))
+		}
+	case ChartSourceLocal:
+		if h.ChartPath == "" {
+			errs = append(errs, lines.errorf(field+".chartPath", "path of chart archive or directory is needed for chart source type local"))
+		} else if file, err := expandHome(h.ChartPath); err != nil {
+			errs = append(errs, lines.errorf(field+".chartPath", "%v", err))
+		} else if _, err = os.Stat(file); err != nil {
+			errs = append(errs, lines.errorf(field+".chartPath", "local chart %s not found", h.ChartPath))
+		}
+	case ChartSourceOCI:
+		if !strings.HasPrefix(h.ChartPath, "oci://") {
+			errs = append(errs, lines.errorf(field+".chartPath", "expect an oci:// reference for chart source type oci"))
+		}
+	default:
+		errs = append(errs, lines.errorf(field+".type", "unknown chart source type %q, expect one of %s", h.Type, strings.Join(chartSourceTypes, "|")))
+	}
+	if h.Version != "" {
+		if _, err := versionMatcher(h.Version); err != nil {
+			errs = append(errs, lines.errorf(field+".version", "%v", err))
+		}
+	}
+	switch {
+	case h.Verify && h.Type == ChartSourceLocal:
+		errs = append(errs, lines.errorf(field+".verify", "takes no effect for chart source type local"))
+	case h.Verify && h.Type == ChartSourceOCI:
+		errs = append(errs, lines.errorf(field+".verify", "provenance files are not supported for chart source type oci"))
+	}
+	if h.Keyring != "" && !h.Verify {
+		errs = append(errs, lines.errorf(field+".keyring", "takes no effect without %s.verify", field))
+	} else if h.Keyring != "" {
+		if file, err := expandHome(h.Keyring); err != nil {
+			errs = append(errs, lines.errorf(field+".keyring", "%v", err))
+		} else if _, err = os.Stat(file); err != nil {
+			errs = append(errs, lines.errorf(field+".keyring", "keyring %s not found", h.Keyring))
+		}
+	}
+	for i, m := range h.Mirrors {
+		f := fmt.Sprintf("%s.mirrors[%d]", field, i)
+		if h.Type != "" && h.Type != ChartSourceURL {
+			errs = append(errs, lines.errorf(f, "takes no effect for chart source type %s", h.Type))
+			break
+		}
+		if !strings.HasPrefix(m, "http://") && !strings.HasPrefix(m, "https://") {
+			errs = append(errs, lines.errorf(f, "expect an http(s) URL"))
+		}
+	}
+	if h.DownloadTimeout != "" {
+		if d, err := time.ParseDuration(h.DownloadTimeout); err != nil || d <= 0 {
+			errs = append(errs, lines.errorf(field+".downloadTimeout", "invalid duration %q, expect one like 30s or 2m", h.DownloadTimeout))
+		}
+	}
+	if h.DownloadAttempts < 0 {
+		errs = append(errs, lines.errorf(field+".downloadAttempts", "must not be negative"))
+	}
+	for i, file := range h.ValuesFiles {
+		if strings.Contains(file, "://") {
+			// fetched by Helm getters
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			errs = append(errs, lines.errorf(fmt.Sprintf("%s.valuesFiles[%d]", field, i), "values file %s not found", file))
+		}
+	}
+	for i, s := range h.Set {
+		if err := strvals.ParseInto(s, map[string]interface{}{}); err != nil {
+			errs = append(errs, lines.errorf(fmt.Sprintf("%s.set[%d]", field, i), "invalid value %q: %v", s, err))
+		}
+	}
+	return errs
+}
+
+func validateReleases(c Config, lines fieldLines) FieldErrors {
+	var errs FieldErrors
+	// names of clusters after CompleteConfig
+	clusters := map[string]bool{}
+	for i := 0; i < len(c.Clusters) || i < c.ManagedCluster || i == 0; i++ {
+		if i < len(c.Clusters) && c.Clusters[i].Name != "" {
+			clusters[c.Clusters[i].Name] = true
+		} else {
+			clusters[defaultClusterName(i)] = true
+		}
+	}
+	releases := map[string]bool{VelaCoreReleaseNamespace + "/" + VelaCoreReleaseName: true}
+	for i, r := range c.Releases {
+		field := fmt.Sprintf("releases[%d]", i)
+		if err := chartutil.ValidateReleaseName(r.Name); err != nil {
+			errs = append(errs, lines.errorf(field+".name", "invalid release name %q", r.Name))
+		}
+		namespace := r.Namespace
+		if namespace == "" {
+			namespace = defaultReleaseNamespace
+		}
+		if msgs := validation.IsDNS1123Label(namespace); len(msgs) != 0 {
+			errs = append(errs, lines.errorf(field+".namespace", "invalid namespace %q: %s", namespace, strings.Join(msgs, ", ")))
+		}
+		if releases[namespace+"/"+r.Name] {
+			errs = append(errs, lines.errorf(field+".name", "duplicated release %s in namespace %s", r.Name, namespace))
+		}
+		releases[namespace+"/"+r.Name] = true
+		if r.HelmOpts.ChartPath == "" && r.HelmOpts.Type != ChartSourceLocal && r.HelmOpts.Type != ChartSourceOCI {
+			// checked by validateHelmOpts for other types
+			errs = append(errs, lines.errorf(field+".helmOpts.chartPath", "chart URL or repo URL is needed"))
+		}
+		errs = append(errs, validateHelmOpts(r.HelmOpts, field+".helmOpts", lines)...)
+		for j, name := range r.Clusters {
+			if !clusters[name] {
+				errs = append(errs, lines.errorf(fmt.Sprintf("%s.clusters[%d]", field, j), "no cluster named %q", name))
+			}
+		}
+		if _, err := labels.Parse(r.ClusterSelector); err != nil {
+			errs = append(errs, lines.errorf(field+".clusterSelector", "invalid label selector: %v", err))
+		}
+	}
+	return errs
+}
+
+// validateStorage checks storage settings, the endpoint is checked after resolved if endpointRef
+func validateStorage(s Storage, endpointRef bool, lines fieldLines) FieldErrors {
+	var errs FieldErrors
+	if s.Endpoint == "" {
+		for _, f := range []struct{ field, value string }{
+			{"storage.ca_file", s.CAFile},
+			{"storage.cert_file", s.CertFile},
+			{"storage.key_file", s.KeyFile},
+		} {
+			if f.value != "" {
+				errs = append(errs, lines.errorf(f.field, "takes no effect without storage.endpoint"))
+			}
+		}
+		return errs
+	}
+	scheme := strings.SplitN(s.Endpoint, "://", 2)[0]
+	if endpointRef {
+		// it's checked once resolved
+	} else if !strings.Contains(s.Endpoint, "://") || !contains(supportedDatastoreSchemes, scheme) {
+		// don't echo the endpoint, it usually contains the password
+		errs = append(errs, lines.errorf("storage.endpoint", "unsupported datastore endpoint, expect one of %s://...", strings.Join(supportedDatastoreSchemes, "|")))
+	}
+	if (s.CertFile == "") != (s.KeyFile == "") {
+		errs = append(errs, lines.errorf("storage.cert_file", "storage.cert_file and storage.key_file must be set together"))
+	}
+	return errs
+}
+
+func validateRegistries(r Registry, lines fieldLines) FieldErrors {
+	var errs FieldErrors
+	for name, m := range r.Mirrors {
+		field := fmt.Sprintf("registries.mirrors[%s]", name)
+		if len(m.Endpoint) == 0 {
+			errs = append(errs, lines.errorf(field, "mirror has no endpoint"))
+		}
+		for i, e := range m.Endpoint {
+			u, err := url.Parse(e)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				errs = append(errs, lines.errorf(fmt.Sprintf("%s.endpoint[%d]", field, i), "invalid mirror endpoint %q, expect http(s)://host[:port]", e))
+			}
+		}
+	}
+	for host, c := range r.Configs {
+		field := fmt.Sprintf("registries.configs[%s]", host)
+		if strings.Contains(host, "://") || strings.Contains(host, "/") {
+			errs = append(errs, lines.errorf(field, "registry key must be a host, not an URL"))
+		}
+		if c.Auth != nil {
+			errs = append(errs, validateAuth(*c.Auth, field+".auth", lines)...)
+		}
+		if c.TLS != nil {
+			if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+				errs = append(errs, lines.errorf(field+".tls", "cert_file and key_file must be set together"))
+			}
+			if c.TLS.InsecureSkipVerify && c.TLS.CAFile != "" {
+				errs = append(errs, lines.errorf(field+".tls.ca_file", "ca_file takes no effect with insecure_skip_verify"))
+			}
+		}
+	}
+	for host, a := range r.Auths {
+		errs = append(errs, validateAuth(a, fmt.Sprintf("registries.auths[%s]", host), lines)...)
+	}
+	return errs
+}
+
+func validateProxy(p Proxy, lines fieldLines) FieldErrors {
+	var errs FieldErrors
+	for _, s := range []struct {
+		field    string
+		settings ProxySettings
+	}{{"proxy.chart", p.Chart}, {"proxy.nodes", p.Nodes}, {"proxy.api", p.API}} {
+		for _, f := range []struct{ field, value string }{{s.field + ".http", s.settings.HTTP}, {s.field + ".https", s.settings.HTTPS}} {
+			if f.value == "" {
+				continue
+			}
+			u, err := url.Parse(f.value)
+			if err != nil || !contains(proxySchemes, u.Scheme) || u.Host == "" {
+				// don't echo the URL, it may contain the password
+				errs = append(errs, lines.errorf(f.field, "invalid proxy URL, expect %s://host:port", strings.Join(proxySchemes, "|")))
+			}
+		}
+		for i, h := range s.settings.NoProxy {
+			if strings.TrimSpace(h) == "" || strings.Contains(h, ",") {
+				errs = append(errs, lines.errorf(fmt.Sprintf("%s.noProxy[%d]", s.field, i), "expect a host, domain or CIDR, one per item"))
+			}
+		}
+	}
+	return errs
+}
+
+func validateAuth(a AuthConfig, field string, lines fieldLines) FieldErrors {
+	var errs FieldErrors
+	if (a.Username == "") != (a.Password == "") {
+		errs = append(errs, lines.errorf(field, "username and password must be set together"))
+	}
+	if a.Auth != "" && a.Username != "" {
+		errs = append(errs, lines.errorf(field, "auth conflicts with username/password, use one of them"))
+	}
+	return errs
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,249 @@
+package pkg
+
+import (
+	"testing"
+)
+
+// fieldsOf returns the fields of errs in order
+func fieldsOf(errs FieldErrors) []string {
+	fields := []string{}
+	for _, e := range errs {
+		fields = append(fields, e.Field)
+	}
+	return fields
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestValidateConfig(t *testing.T) {
+	valid := func() Config {
+		return Config{Kind: KindSimple, ManagedCluster: 1}
+	}
+	cases := []struct {
+		name   string
+		modify func(c *Config)
+		// fields are the fields of expected errors, in order
+		fields []string
+	}{
+		{
+			name:   "valid",
+			modify: func(c *Config) {},
+			fields: []string{},
+		},
+		{
+			name: "kind and managedCluster",
+			modify: func(c *Config) {
+				c.Kind = "Complex"
+				c.ManagedCluster = -1
+			},
+			fields: []string{"kind", "managedCluster"},
+		},
+		{
+			name: "storage without endpoint",
+			modify: func(c *Config) {
+				c.Storage.CAFile = "ca.pem"
+			},
+			fields: []string{"storage.ca_file"},
+		},
+		{
+			name: "storage endpoint scheme",
+			modify: func(c *Config) {
+				c.Storage.Endpoint = "redis://db"
+			},
+			fields: []string{"storage.endpoint"},
+		},
+		{
+			name: "storage cert without key",
+			modify: func(c *Config) {
+				c.Storage.Endpoint = "mysql://db"
+				c.Storage.CertFile = "cert.pem"
+			},
+			fields: []string{"storage.cert_file"},
+		},
+		{
+			name: "registries",
+			modify: func(c *Config) {
+				c.Registries.Mirrors = map[string]Mirror{"docker.io": {Endpoint: []string{"ftp://mirror"}}}
+				c.Registries.Configs = map[string]RegistryConfig{"https://r.io": {Auth: &AuthConfig{Username: "u"}}}
+			},
+			fields: []string{"registries.configs[https://r.io]", "registries.configs[https://r.io].auth", "registries.mirrors[docker.io].endpoint[0]"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := valid()
+			c.modify(&cfg)
+			if got := fieldsOf(validateConfig(cfg, fieldLines{})); !equalStrings(got, c.fields) {
+				t.Errorf("expect errors of %v, got %v", c.fields, got)
+			}
+		})
+	}
+}
+
+func TestFieldLinesLineOf(t *testing.T) {
+	lines := fieldLines{"storage": 3, "registries.mirrors[docker.io]": 7}
+	cases := map[string]int{
+		"storage":                                3,
+		"storage.endpoint":                       3,
+		"registries.mirrors[docker.io].endpoint": 7,
+		"registries":                             0,
+		"token":                                  0,
+	}
+	for field, want := range cases {
+		if got := lines.lineOf(field); got != want {
+			t.Errorf("line of %s: expect %d, got %d", field, want, got)
+		}
+	}
+}
+
+func TestValidateClusters(t *testing.T) {
+	cases := []struct {
+		name     string
+		clusters []Cluster
+		fields   []string
+	}{
+		{
+			name:     "valid",
+			clusters: []Cluster{{Name: "hub", Servers: 3}, {Name: "edge-1", Labels: map[string]string{"region": "eu"}}},
+			fields:   []string{},
+		},
+		{
+			name:     "invalid name",
+			clusters: []Cluster{{Name: "Hub_1"}},
+			fields:   []string{"clusters[0].name"},
+		},
+		{
+			name:     "duplicated name",
+			clusters: []Cluster{{Name: "hub"}, {Name: "hub"}},
+			fields:   []string{"clusters[1].name"},
+		},
+		{
+			name:     "negative nodes and bad image",
+			clusters: []Cluster{{Image: "rancher/k3s latest", Servers: -1, Agents: -1}},
+			fields:   []string{"clusters[0].image", "clusters[0].servers", "clusters[0].agents"},
+		},
+		{
+			name:     "invalid label key",
+			clusters: []Cluster{{Labels: map[string]string{"a=b": "c"}}},
+			fields:   []string{"clusters[0].labels[a=b]"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := fieldsOf(validateClusters(c.clusters, fieldLines{})); !equalStrings(got, c.fields) {
+				t.Errorf("expect errors of %v, got %v", c.fields, got)
+			}
+		})
+	}
+}
+
+func TestValidateAPIPorts(t *testing.T) {
+	cases := []struct {
+		name   string
+		config Config
+		errs   []string
+	}{
+		{
+			name:   "defaults",
+			config: Config{ManagedCluster: 3},
+			errs:   []string{},
+		},
+		{
+			name:   "explicit ports",
+			config: Config{ManagedCluster: 2, Clusters: []Cluster{{APIPort: 7443}, {APIPort: 7444}}},
+			errs:   []string{},
+		},
+		{
+			name:   "explicit ports collide",
+			config: Config{ManagedCluster: 2, Clusters: []Cluster{{Name: "hub", APIPort: 7443}, {APIPort: 7443}}},
+			errs:   []string{"clusters[1].apiPort: port 7443 is used by cluster hub"},
+		},
+		{
+			name:   "explicit port collides with default of declared cluster",
+			config: Config{ManagedCluster: 2, Clusters: []Cluster{{}, {APIPort: 6443}}},
+			errs:   []string{"clusters[1].apiPort: port 6443 is used by cluster mvela-cluster-control-plane"},
+		},
+		{
+			name:   "explicit port collides with default of implicit cluster",
+			config: Config{ManagedCluster: 3, Clusters: []Cluster{{APIPort: 6445}}},
+			errs:   []string{"clusters[0].apiPort: port 6445 is the default API port of cluster mvela-cluster-2"},
+		},
+		{
+			name:   "invalid port",
+			config: Config{ManagedCluster: 1, Clusters: []Cluster{{APIPort: 70000}}},
+			errs:   []string{"clusters[0].apiPort: invalid port 70000"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := []string{}
+			for _, e := range validateAPIPorts(c.config, fieldLines{}) {
+				got = append(got, e.Error())
+			}
+			if !equalStrings(got, c.errs) {
+				t.Errorf("expect %v, got %v", c.errs, got)
+			}
+		})
+	}
+}
+
+func TestValidateHelmOpts(t *testing.T) {
+	cases := []struct {
+		name   string
+		opts   HelmOpts
+		fields []string
+	}{
+		{name: "default", opts: HelmOpts{}, fields: []string{}},
+		{name: "verify url", opts: HelmOpts{Type: ChartSourceURL, Verify: true}, fields: []string{}},
+		{name: "verify oci", opts: HelmOpts{Type: ChartSourceOCI, ChartPath: "oci://r.io/vela-core", Verify: true}, fields: []string{"helmOpts.verify"}},
+		{name: "oci reference", opts: HelmOpts{Type: ChartSourceOCI, ChartPath: "https://r.io/vela-core"}, fields: []string{"helmOpts.chartPath"}},
+		{name: "keyring without verify", opts: HelmOpts{Keyring: "pubring.gpg"}, fields: []string{"helmOpts.keyring"}},
+		{name: "unknown type", opts: HelmOpts{Type: "git"}, fields: []string{"helmOpts.type"}},
+		{name: "mirrors of repo", opts: HelmOpts{Type: ChartSourceRepo, Mirrors: []string{"https://m"}}, fields: []string{"helmOpts.mirrors[0]"}},
+		{name: "download settings", opts: HelmOpts{DownloadTimeout: "2", DownloadAttempts: -1}, fields: []string{"helmOpts.downloadTimeout", "helmOpts.downloadAttempts"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := fieldsOf(validateHelmOpts(c.opts, "helmOpts", fieldLines{})); !equalStrings(got, c.fields) {
+				t.Errorf("expect errors of %v, got %v", c.fields, got)
+			}
+		})
+	}
+}
+
+func TestValidateReleases(t *testing.T) {
+	chart := HelmOpts{ChartPath: "https://charts.io/a-{version}.tgz"}
+	cases := []struct {
+		name     string
+		releases []Release
+		fields   []string
+	}{
+		{name: "valid", releases: []Release{{Name: "a", HelmOpts: chart, Clusters: []string{"mvela-cluster-control-plane"}, ClusterSelector: "region=eu"}}, fields: []string{}},
+		{name: "invalid name", releases: []Release{{Name: "A_b", HelmOpts: chart}}, fields: []string{"releases[0].name"}},
+		{name: "invalid namespace", releases: []Release{{Name: "a", Namespace: "Vela", HelmOpts: chart}}, fields: []string{"releases[0].namespace"}},
+		{name: "vela-core taken", releases: []Release{{Name: VelaCoreReleaseName, Namespace: VelaCoreReleaseNamespace, HelmOpts: chart}}, fields: []string{"releases[0].name"}},
+		{name: "duplicated", releases: []Release{{Name: "a", HelmOpts: chart}, {Name: "a", Namespace: defaultReleaseNamespace, HelmOpts: chart}}, fields: []string{"releases[1].name"}},
+		{name: "no chart", releases: []Release{{Name: "a"}}, fields: []string{"releases[0].helmOpts.chartPath"}},
+		{name: "oci chart", releases: []Release{{Name: "a", HelmOpts: HelmOpts{Type: ChartSourceOCI, ChartPath: "oci://r.io/a"}}}, fields: []string{}},
+		{name: "unknown cluster", releases: []Release{{Name: "a", HelmOpts: chart, Clusters: []string{"edge"}}}, fields: []string{"releases[0].clusters[0]"}},
+		{name: "invalid selector", releases: []Release{{Name: "a", HelmOpts: chart, ClusterSelector: "region in eu"}}, fields: []string{"releases[0].clusterSelector"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := Config{ManagedCluster: 1, Releases: c.releases}
+			if got := fieldsOf(validateReleases(cfg, fieldLines{})); !equalStrings(got, c.fields) {
+				t.Errorf("expect errors of %v, got %v", c.fields, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package pkg
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/Masterminds/semver/v3"
+	"k8s.io/klog/v2"
+)
+
+// DefaultSemver is the vela-core chart version used if helmOpts.version is not set
+const DefaultSemver = "1.2.4"
+
+// Version specs besides versions and constraints
+const (
+	// VersionLatest is the highest version including pre-releases
+	VersionLatest = "latest"
+	// VersionStable is the highest version without pre-release
+	VersionStable = "stable"
+)
+
+// isExactVersion tells if spec is a version rather than a constraint
+func isExactVersion(spec string) bool {
+	_, err := semver.StrictNewVersion(spec)
+	return err == nil
+}
+
+// versionMatcher returns the function checking versions against spec, spec is a version,
+// a constraint like ~1.2 or >=1.3 <1.5, latest or stable
+func versionMatcher(spec string) (func(v *semver.Version) bool, error) {
+	switch spec {
+	case VersionLatest:
+		return func(*semver.Version) bool { return true }, nil
+	case VersionStable:
+		return func(v *semver.Version) bool { return v.Prerelease() == "" }, nil
+	}
+	c, err := semver.NewConstraint(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid version %q, expect a version, a constraint like ~1.2, %s or %s", spec, VersionLatest, VersionStable)
+	}
+	return c.Check, nil
+}
+
+// pickVersion returns the highest of candidates matching spec
+func pickVersion(spec string, candidates []string) (string, error) {
+	match, err := versionMatcher(spec)
+	if err != nil {
+		return "", err
+	}
+	var matched []*semver.Version
+	for _, c := range candidates {
+		if v, err := semver.NewVersion(c); err == nil && match(v) {
+			matched = append(matched, v)
+		}
+	}
+	if len(matched) == 0 {
+		return "", fmt.Errorf("no version matches %q", spec)
+	}
+	sort.Sort(semver.Collection(matched))
+	return matched[len(matched)-1].Original(), nil
+}
+
+// resolveChartVersion resolves version spec of chart to a version available in source, versions of cached
+// charts are used if source can't be reached
+func resolveChartVersion(chart, spec string, source chartSource, cache *chartCache) (string, error) {
+	if isExactVersion(spec) {
+		return spec, nil
+	}
+	candidates, err := source.versions()
+	if err != nil {
+		klog.Warningf("Fail to list versions of chart %s, resolving %q with cached charts: %v", chart, spec, err)
+		if candidates, err = cache.versions(chart); err != nil {
+			return "", err
+		}
+	}
+	version, err := pickVersion(spec, candidates)
+	if err != nil {
+		return "", fmt.Errorf("fail to resolve %s version: %w", chart, err)
+	}
+	return version, nil
+}
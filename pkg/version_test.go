@@ -0,0 +1,94 @@
+package pkg
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestIsExactVersion(t *testing.T) {
+	for spec, want := range map[string]bool{"1.2.4": true, "1.3.0-beta.1": true, "v1.2.4": false, "~1.2": false, "1.2": false, "latest": false} {
+		if got := isExactVersion(spec); got != want {
+			t.Errorf("%s: expect %v, got %v", spec, want, got)
+		}
+	}
+}
+
+func TestPickVersion(t *testing.T) {
+	candidates := []string{"1.1.9", "1.2.0", "1.2.4", "1.3.0-beta.1", "1.3.0", "v1.4.0-rc.0", "invalid"}
+	cases := []struct {
+		spec string
+		want string
+		err  string
+	}{
+		{spec: "latest", want: "v1.4.0-rc.0"},
+		{spec: "stable", want: "1.3.0"},
+		{spec: "~1.2", want: "1.2.4"},
+		{spec: "1.2.0", want: "1.2.0"},
+		{spec: ">=1.2 <1.3", want: "1.2.4"},
+		{spec: ">=1.3.0-0", want: "v1.4.0-rc.0"},
+		{spec: "~2.0", err: `no version matches "~2.0"`},
+		{spec: "newest", err: `invalid version "newest"`},
+	}
+	for _, c := range cases {
+		t.Run(c.spec, func(t *testing.T) {
+			got, err := pickVersion(c.spec, candidates)
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("expect error %q, got %v", c.err, err)
+				}
+				return
+			}
+			if err != nil || got != c.want {
+				t.Errorf("expect %s, got %s, %v", c.want, got, err)
+			}
+		})
+	}
+}
+
+// fakeChartSource lists versions without downloading anything
+type fakeChartSource struct {
+	list []string
+	err  error
+}
+
+func (s fakeChartSource) locate(version string) (string, error) {
+	return "", errors.New("not supported")
+}
+
+func (s fakeChartSource) versions() ([]string, error) {
+	return s.list, s.err
+}
+
+func TestResolveChartVersion(t *testing.T) {
+	cache := &chartCache{dir: t.TempDir()}
+	if err := cache.add(cacheEntry{Source: "https://a/vela-core-1.1.0.tgz", Chart: velaCoreChartName, Version: "1.1.0", File: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name   string
+		spec   string
+		source fakeChartSource
+		want   string
+		fail   bool
+	}{
+		{name: "exact version isn't looked up", spec: "9.9.9", source: fakeChartSource{err: errors.New("offline")}, want: "9.9.9"},
+		{name: "from source", spec: "~1.2", source: fakeChartSource{list: []string{"1.2.0", "1.2.4", "1.3.0"}}, want: "1.2.4"},
+		{name: "from cache if offline", spec: "stable", source: fakeChartSource{err: errors.New("offline")}, want: "1.1.0"},
+		{name: "no match", spec: "~1.2", source: fakeChartSource{err: errors.New("offline")}, fail: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := resolveChartVersion(velaCoreChartName, c.spec, c.source, cache)
+			if c.fail {
+				if err == nil {
+					t.Fatalf("expect an error, got %s", got)
+				}
+				return
+			}
+			if err != nil || got != c.want {
+				t.Errorf("expect %s, got %s, %v", c.want, got, err)
+			}
+		})
+	}
+}
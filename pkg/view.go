@@ -0,0 +1,144 @@
+package pkg
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const maskedValue = "******"
+
+// origin tells where the value of field comes from: default, file:line, environment variable or generated
+func (lc *loadedConfig) origin(field string) string {
+	// collections are overridden as a whole
+	for f := field; ; {
+		if env, ok := lc.Envs[f]; ok {
+			return "env " + env
+		}
+		i := strings.LastIndexAny(f, ".[")
+		if i < 0 {
+			break
+		}
+		f = f[:i]
+	}
+	if file, ok := lc.Generated[field]; ok {
+		return "generated " + file
+	}
+	if line, ok := lc.Lines[field]; ok {
+		return fmt.Sprintf("%s:%d", lc.File, line)
+	}
+	return "default"
+}
+
+// isSecretField tells if the field may contain credentials
+func isSecretField(field string) bool {
+	if field == "token" || field == "storage.endpoint" {
+		return true
+	}
+	if !strings.HasPrefix(field, "registries.") {
+		return false
+	}
+	for _, suffix := range []string{".password", ".auth", ".identity_token"} {
+		if strings.HasSuffix(field, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// isProxyURLField tells if the field is a proxy URL, which may contain credentials in its userinfo
+func isProxyURLField(field string) bool {
+	parts := strings.Split(field, ".")
+	return len(parts) == 3 && parts[0] == "proxy" && (parts[2] == "http" || parts[2] == "https")
+}
+
+// maskUserinfo masks the userinfo of URL s, like http://******@proxy:3128. Invalid URLs are masked as a whole.
+func maskUserinfo(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return maskedValue
+	}
+	if u.User == nil {
+		return s
+	}
+	// url.User escapes the mask
+	u.User = nil
+	return strings.Replace(u.String(), "://", "://"+maskedValue+"@", 1)
+}
+
+// renderConfig renders the config as YAML. Secrets are masked unless reveal,
+// each value is commented with its origin if showOrigin.
+func renderConfig(lc *loadedConfig, showOrigin, reveal bool) ([]byte, error) {
+	node := yaml.Node{}
+	if err := node.Encode(lc.Config); err != nil {
+		return nil, err
+	}
+	walkLeaves(&node, reflect.TypeOf(lc.Config), "", func(field string, value *yaml.Node) {
+		if !reveal && value.Kind == yaml.ScalarNode && value.Value != "" && isSecretField(field) {
+			value.Value = maskedValue
+			value.Tag = "!!str"
+		}
+		if !reveal && value.Kind == yaml.ScalarNode && isProxyURLField(field) {
+			value.Value = maskUserinfo(value.Value)
+		}
+		if field == "token" && value.Value == "" && lc.Generated[field] != "" {
+			value.Value = tokenPending
+		}
+		if showOrigin {
+			value.LineComment = lc.origin(field)
+		}
+	})
+	return marshalConfig(&node, false)
+}
+
+// walkLeaves calls visit on every scalar and empty collection in node along with type t
+func walkLeaves(node *yaml.Node, t reflect.Type, path string, visit func(field string, value *yaml.Node)) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, n := range node.Content {
+			walkLeaves(n, t, path, visit)
+		}
+		return
+	case yaml.MappingNode:
+		if len(node.Content) == 0 {
+			break
+		}
+		fields := map[string]reflect.StructField{}
+		if t.Kind() == reflect.Struct {
+			fields = yamlFields(t)
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i].Value
+			switch t.Kind() {
+			case reflect.Map:
+				walkLeaves(node.Content[i+1], t.Elem(), fmt.Sprintf("%s[%s]", path, key), visit)
+			case reflect.Interface:
+				walkLeaves(node.Content[i+1], t, fmt.Sprintf("%s[%s]", path, key), visit)
+			default:
+				if f, ok := fields[key]; ok {
+					walkLeaves(node.Content[i+1], f.Type, joinPath(path, key), visit)
+				}
+			}
+		}
+		return
+	case yaml.SequenceNode:
+		if len(node.Content) == 0 {
+			break
+		}
+		elem := t
+		if t.Kind() != reflect.Interface {
+			elem = t.Elem()
+		}
+		for i, n := range node.Content {
+			walkLeaves(n, elem, fmt.Sprintf("%s[%d]", path, i), visit)
+		}
+		return
+	}
+	visit(path, node)
+}